@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Every PUT, PATCH and DELETE on stores, menu items and order items, and
+// every restore, leaves an audit entry: who, when, which request, the
+// document before and after, and the fields that changed. Documents are
+// kept as they're stored and shown as relaxed extended JSON. The entry is
+// written in the change's own transaction, with before and after read in
+// it too, so a change that can't be audited doesn't happen.
+
+// audit actions
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+)
+
+// auditChange is one field that changed, dotted into subdocuments. Values
+// are extended JSON, empty when the field wasn't there.
+type auditChange struct {
+	Field  string `bson:"field"`
+	Before string `bson:"before"`
+	After  string `bson:"after"`
+}
+
+type auditEntry struct {
+	ID        objectid.ObjectID `bson:"_id"`
+	Resource  string            `bson:"resource"` // the collection
+	Doc       objectid.ObjectID `bson:"doc"`
+	Action    string            `bson:"action"`
+	Actor     string            `bson:"actor"`
+	ActorID   objectid.ObjectID `bson:"actor_id"` // the staff member, if it was one
+	RequestID string            `bson:"request_id"`
+	At        int64             `bson:"at"`
+	Diff      []auditChange     `bson:"diff"`
+}
+
+var auditColl *mongo.Collection
+
+// maxRequestID is as long as a client's X-Request-ID can be.
+const maxRequestID = 64
+
+// withRequestID gives every request an X-Request-ID, the client's if it
+// sent a sensible one, and sends it back.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			if id != "" {
+				if len(id) > maxRequestID {
+					id = id[:maxRequestID]
+				}
+				log.Printf("replacing X-Request-ID %q from %s", id, req.RemoteAddr)
+			}
+			raw := make([]byte, 12)
+			rand.Read(raw)
+			id = hex.EncodeToString(raw)
+			req.Header.Set("X-Request-ID", id)
+		}
+		res.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(res, req)
+	})
+}
+
+// validRequestID is whether id is short and plain enough to keep: letters,
+// digits, dots, dashes and underscores.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '.', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// auditBefore is a document as it is in tx before a change, nil if there's
+// no such document.
+func auditBefore(tx *txn, coll *mongo.Collection, oid objectid.ObjectID) (*bson.Document, error) {
+	docs, err := tx.find(coll, bson.NewDocument(bson.EC.ObjectID("_id", oid)))
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return bson.ReadDocument(docs[0])
+}
+
+// auditActor names whoever made req, with their staff id when they're
+// staff. These endpoints don't all require a token, so no token is fine.
+func auditActor(req *http.Request) (string, objectid.ObjectID) {
+	s, err := staffFor(req)
+	if err != nil {
+		return "unknown token from " + req.RemoteAddr, objectid.NilObjectID
+	}
+	if s == nil {
+		return "anonymous from " + req.RemoteAddr, objectid.NilObjectID
+	}
+	return actor(s), s.ID
+}
+
+// recordAudit records in tx a change req made to oid in coll, given how it
+// was before; how it is after is read back here.
+func recordAudit(tx *txn, req *http.Request, coll *mongo.Collection, oid objectid.ObjectID, action string, before *bson.Document) error {
+	after, err := auditBefore(tx, coll, oid) // nil once it's gone
+	if err != nil {
+		return err
+	}
+	who, whoID := auditActor(req)
+	changes := diffDocuments("", before, after)
+
+	entry := bson.NewDocument(
+		bson.EC.String("resource", coll.Name()),
+		bson.EC.ObjectID("doc", oid),
+		bson.EC.String("action", action),
+		bson.EC.String("actor", who),
+		bson.EC.String("request_id", req.Header.Get("X-Request-ID")),
+		bson.EC.Int64("at", time.Now().Unix()),
+	)
+	if whoID != objectid.NilObjectID {
+		entry.Append(bson.EC.ObjectID("actor_id", whoID))
+	}
+	for _, snapshot := range []struct {
+		key string
+		doc *bson.Document
+	}{{"before", before}, {"after", after}} {
+		if snapshot.doc == nil {
+			entry.Append(bson.EC.Null(snapshot.key))
+		} else {
+			entry.Append(bson.EC.SubDocument(snapshot.key, snapshot.doc))
+		}
+	}
+	diff := make([]*bson.Value, 0, len(changes))
+	for _, change := range changes {
+		diff = append(diff, bson.VC.DocumentFromElements(
+			bson.EC.String("field", change.Field),
+			bson.EC.String("before", change.Before),
+			bson.EC.String("after", change.After),
+		))
+	}
+	entry.Append(bson.EC.ArrayFromElements("diff", diff...))
+
+	if _, err := tx.insertOne(auditColl, entry); err != nil {
+		return fmt.Errorf("recording the audit entry: %s", err)
+	}
+	return nil
+}
+
+// elementJSON is an element's value as extended JSON.
+func elementJSON(elem *bson.Element) string {
+	if elem == nil {
+		return ""
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(bson.NewDocument(elem.Clone()).ToExtJSON(false)), &fields); err != nil {
+		return ""
+	}
+	return string(fields[elem.Key()])
+}
+
+// diffDocuments lists the fields that differ between before and after,
+// either of which may be nil. Subdocuments are compared field by field,
+// anything else as a whole.
+func diffDocuments(prefix string, before, after *bson.Document) []auditChange {
+	changes := make([]auditChange, 0)
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, doc := range []*bson.Document{before, after} {
+		if doc == nil {
+			continue
+		}
+		itr := doc.Iterator()
+		for itr.Next() {
+			key := itr.Element().Key()
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		var was, is *bson.Element
+		if before != nil {
+			was, _ = before.LookupElementErr(key)
+		}
+		if after != nil {
+			is, _ = after.LookupElementErr(key)
+		}
+		if was != nil && is != nil &&
+			was.Value().Type() == bson.TypeEmbeddedDocument && is.Value().Type() == bson.TypeEmbeddedDocument {
+			changes = append(changes, diffDocuments(prefix+key+".", was.Value().MutableDocument(), is.Value().MutableDocument())...)
+			continue
+		}
+		wasJSON, isJSON := elementJSON(was), elementJSON(is)
+		if wasJSON != isJSON {
+			changes = append(changes, auditChange{Field: prefix + key, Before: wasJSON, After: isJSON})
+		}
+	}
+	return changes
+}
+
+// auditView is an audit entry as the API shows it.
+type auditView struct {
+	ID        string          `json:"id"`
+	Resource  string          `json:"resource"`
+	Doc       string          `json:"doc"`
+	Action    string          `json:"action"`
+	Actor     string          `json:"actor"`
+	ActorID   string          `json:"actor_id,omitempty"`
+	RequestID string          `json:"request_id"`
+	At        int64           `json:"at"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	Diff      []auditDiff     `json:"diff"`
+}
+
+type auditDiff struct {
+	Field  string          `json:"field"`
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+// rawJSON is s as JSON, null if it's empty.
+func rawJSON(s string) json.RawMessage {
+	if s == "" {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s)
+}
+
+func newAuditView(rdr bson.Reader) (auditView, error) {
+	var entry auditEntry
+	if err := bson.Unmarshal(rdr, &entry); err != nil {
+		return auditView{}, err
+	}
+	view := auditView{
+		ID:        entry.ID.Hex(),
+		Resource:  entry.Resource,
+		Doc:       entry.Doc.Hex(),
+		Action:    entry.Action,
+		Actor:     entry.Actor,
+		RequestID: entry.RequestID,
+		At:        entry.At,
+		Before:    rawJSON(""),
+		After:     rawJSON(""),
+		Diff:      make([]auditDiff, 0, len(entry.Diff)),
+	}
+	if entry.ActorID != objectid.NilObjectID {
+		view.ActorID = entry.ActorID.Hex()
+	}
+	for _, key := range []string{"before", "after"} {
+		elem, err := rdr.Lookup(key)
+		if err != nil || elem.Value().Type() != bson.TypeEmbeddedDocument {
+			continue
+		}
+		s, err := bson.ToExtJSON(false, elem.Value().ReaderDocument())
+		if err != nil {
+			return view, err
+		}
+		if key == "before" {
+			view.Before = rawJSON(s)
+		} else {
+			view.After = rawJSON(s)
+		}
+	}
+	for _, change := range entry.Diff {
+		view.Diff = append(view.Diff, auditDiff{
+			Field:  change.Field,
+			Before: rawJSON(change.Before),
+			After:  rawJSON(change.After),
+		})
+	}
+	return view, nil
+}
+
+// handleAudit is GET /api/v1/audit for admins, newest first. Filters:
+// ?resource=stores|menu_items|order_items, ?doc=<id>, ?actor=<staff id or
+// actor as shown>, ?from= and ?to= (RFC 3339), ?limit= (100).
+func handleAudit(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" {
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+		return
+	}
+
+	query := req.URL.Query()
+	filter := bson.NewDocument()
+	if resource := query.Get("resource"); resource != "" {
+		filter.Append(bson.EC.String("resource", resource))
+	}
+	if doc := query.Get("doc"); doc != "" {
+		oid, err := objectid.FromHex(doc)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		filter.Append(bson.EC.ObjectID("doc", oid))
+	}
+	if who := query.Get("actor"); who != "" {
+		if oid, err := objectid.FromHex(who); err == nil {
+			filter.Append(bson.EC.ObjectID("actor_id", oid))
+		} else {
+			filter.Append(bson.EC.String("actor", who))
+		}
+	}
+	at := make([]*bson.Element, 0, 2)
+	for _, bound := range []struct{ param, op string }{{"from", "$gte"}, {"to", "$lt"}} {
+		param := query.Get(bound.param)
+		if param == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, param)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		at = append(at, bson.EC.Int64(bound.op, t.Unix()))
+	}
+	if len(at) > 0 {
+		filter.Append(bson.EC.SubDocumentFromElements("at", at...))
+	}
+	limit := int64(100)
+	if param := query.Get("limit"); param != "" {
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || n < 1 {
+			httpError(fmt.Sprintf("Bad limit %q", param))
+			return
+		}
+		limit = n
+	}
+
+	ctx := req.Context()
+	cur, err := auditColl.Find(ctx, filter,
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("at", -1), bson.EC.Int32("_id", -1))),
+		findopt.Limit(limit))
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	defer cur.Close(ctx)
+	list := make([]auditView, 0)
+	for cur.Next(ctx) {
+		rdr, err := cur.DecodeBytes()
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		view, err := newAuditView(rdr)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		list = append(list, view)
+	}
+	if err := cur.Err(); err != nil {
+		httpError(err.Error())
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(list)
+}
+
+func setupAudit() {
+	auditColl = database.Collection("audit")
+
+	http.HandleFunc("/api/v1/audit", handleAudit)
+}
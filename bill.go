@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// A bill is an order's item lines plus the charges on top of them. Every
+// charge is a signed amount, so discounts are negative and the total is
+// simply the subtotal plus all of them. priceOrder makes one from current
+// prices; once an order is submitted the bill is written onto the order and
+// recordedBill reads it back, so later price changes don't rewrite it.
+
+type billLine struct {
+	Item  string `json:"item"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Price string `json:"price"`
+	Total string `json:"total"`
+}
+
+// billCharge is a discount, tax, fee or tip.
+type billCharge struct {
+	Code   string `json:"code" bson:"code"`
+	Descr  string `json:"descr" bson:"descr"`
+	Amount string `json:"amount" bson:"amount" schema:"money"`
+}
+
+type bill struct {
+	Order     string       `json:"order"`
+	State     string       `json:"state"`
+	Lines     []billLine   `json:"lines"`
+	Subtotal  string       `json:"subtotal"`
+	Discounts []billCharge `json:"discounts"`
+	Fees      []billCharge `json:"fees"`
+	Tax       []billCharge `json:"tax"`
+	TaxRate   *taxRate     `json:"tax_rate,omitempty"` // the rates Tax was worked out with
+	Tips      []billCharge `json:"tips"`
+	Total     string       `json:"total"`
+
+	// the menu items as priced, only set by priceOrder
+	menu map[objectid.ObjectID]menuItem
+}
+
+// priceOrder reads the current menu prices for the items on an order and
+// works out its charges.
+func priceOrder(tx *txn, order *orderRecord) (*bill, error) {
+	docs, err := tx.find(orderItemsColl, bson.NewDocument(bson.EC.ObjectID("order", order.ID)))
+	if err != nil {
+		return nil, err
+	}
+	b := &bill{
+		Order:     order.ID.Hex(),
+		State:     order.State,
+		Lines:     make([]billLine, 0),
+		Discounts: make([]billCharge, 0),
+		Fees:      make([]billCharge, 0),
+		Tax:       make([]billCharge, 0),
+		Tips:      make([]billCharge, 0),
+		menu:      make(map[objectid.ObjectID]menuItem),
+	}
+	var subtotal int64
+	for _, doc := range docs {
+		var item orderItemRecord
+		err := bson.Unmarshal(doc, &item)
+		if err != nil {
+			return nil, err
+		}
+		if item.Count <= 0 {
+			continue
+		}
+		var menu menuItem
+		err = tx.findOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", item.Item)), &menu)
+		if err == errNoDocument {
+			return nil, fmt.Errorf("menu item %s no longer exists", item.Item.Hex())
+		}
+		if err != nil {
+			return nil, err
+		}
+		if menu.DeletedAt != 0 {
+			return nil, fmt.Errorf("menu item %s is no longer on the menu", item.Item.Hex())
+		}
+		b.menu[item.Item] = menu
+		price, err := parseCents(menu.Price)
+		if err != nil {
+			return nil, err
+		}
+		line := price * int64(item.Count)
+		subtotal += line
+		b.Lines = append(b.Lines, billLine{
+			Item:  item.Item.Hex(),
+			Name:  menu.Name,
+			Count: item.Count,
+			Price: formatCents(price),
+			Total: formatCents(line),
+		})
+	}
+	b.Subtotal = formatCents(subtotal)
+
+	if order.Promo != "" {
+		discount, err := applyPromo(tx, order, b)
+		if err != nil {
+			return nil, err
+		}
+		b.Discounts = append(b.Discounts, *discount)
+	}
+	if err := applyFees(tx, order, b); err != nil {
+		return nil, err
+	}
+	if err := applyTax(tx, order, b); err != nil {
+		return nil, err
+	}
+	if err := applyTip(order, b); err != nil {
+		return nil, err
+	}
+	return b, b.sum()
+}
+
+// sum works the total out from the subtotal and charges.
+func (b *bill) sum() error {
+	total, err := parseCents(b.Subtotal)
+	if err != nil {
+		return err
+	}
+	for _, charges := range [][]billCharge{b.Discounts, b.Fees, b.Tax, b.Tips} {
+		for _, charge := range charges {
+			cents, err := parseCents(charge.Amount)
+			if err != nil {
+				return err
+			}
+			total += cents
+		}
+	}
+	if total < 0 {
+		total = 0
+	}
+	b.Total = formatCents(total)
+	return nil
+}
+
+// recordedBill is the bill written on the order when it was submitted.
+func (o *orderRecord) recordedBill() *bill {
+	b := &bill{
+		Order:     o.ID.Hex(),
+		State:     o.State,
+		Lines:     make([]billLine, 0, len(o.Lines)),
+		Subtotal:  o.Subtotal,
+		Discounts: append(make([]billCharge, 0), o.Discounts...),
+		Fees:      append(make([]billCharge, 0), o.Fees...),
+		Tax:       append(make([]billCharge, 0), o.Tax...),
+		TaxRate:   o.TaxRate,
+		Tips:      append(make([]billCharge, 0), o.Tips...),
+		Total:     o.Total,
+	}
+	if b.TaxRate != nil {
+		b.TaxRate.IDStr = b.TaxRate.ID.Hex()
+	}
+	for _, line := range o.Lines {
+		b.Lines = append(b.Lines, billLine{
+			Item:  line.Item.Hex(),
+			Name:  line.Name,
+			Count: line.Count,
+			Price: line.Price,
+			Total: line.Total,
+		})
+	}
+	return b
+}
+
+// billElements is what submitOrder records on the order.
+func (b *bill) billElements() []*bson.Element {
+	lines := make([]*bson.Value, 0, len(b.Lines))
+	for _, line := range b.Lines {
+		item, _ := objectid.FromHex(line.Item)
+		lines = append(lines, bson.VC.DocumentFromElements(
+			bson.EC.ObjectID("item", item),
+			bson.EC.String("name", line.Name),
+			bson.EC.Int32("count", int32(line.Count)),
+			bson.EC.String("price", line.Price),
+			bson.EC.String("total", line.Total),
+		))
+	}
+	return []*bson.Element{
+		bson.EC.ArrayFromElements("lines", lines...),
+		bson.EC.String("subtotal", b.Subtotal),
+		chargesElement("discounts", b.Discounts),
+		chargesElement("fees", b.Fees),
+		chargesElement("tax", b.Tax),
+		taxRateElement(b.TaxRate),
+		chargesElement("tips", b.Tips),
+		bson.EC.String("total", b.Total),
+	}
+}
+
+func chargesElement(key string, charges []billCharge) *bson.Element {
+	values := make([]*bson.Value, 0, len(charges))
+	for _, charge := range charges {
+		values = append(values, bson.VC.DocumentFromElements(
+			bson.EC.String("code", charge.Code),
+			bson.EC.String("descr", charge.Descr),
+			bson.EC.String("amount", charge.Amount),
+		))
+	}
+	return bson.EC.ArrayFromElements(key, values...)
+}
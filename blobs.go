@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// blobStore holds uploaded files (menu item images for now) by key. Keys are
+// slash separated paths like "menu/<id>/<version>/thumb.jpg".
+type blobStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Get(ctx context.Context, key string) (*blob, error)
+	Delete(ctx context.Context, key string) error
+}
+
+type blob struct {
+	ContentType string
+	Data        []byte
+	Modified    time.Time
+}
+
+var errNoBlob = fmt.Errorf("blob not found")
+
+var blobs blobStore
+
+// setupBlobs picks the store from BLOB_STORE: "gridfs" (the default) keeps
+// blobs in the tacos database, "fs" writes them under BLOB_DIR.
+func setupBlobs() error {
+	switch kind := getEnv("BLOB_STORE", "gridfs"); kind {
+	case "fs":
+		dir := getEnv("BLOB_DIR", "/var/lib/tacos-api/blobs")
+		blobs = &fsBlobStore{dir: dir}
+		fmt.Printf("Storing blobs in %s\n", dir)
+	case "gridfs":
+		blobs = newGridFSBlobStore(database, "fs")
+		fmt.Println("Storing blobs in GridFS")
+	default:
+		return fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+	return nil
+}
+
+// fsBlobStore keeps each blob as a file, with its content type in a
+// neighbouring .type file.
+type fsBlobStore struct {
+	dir string
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("bad blob key %q", key)
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(clean)), nil
+}
+
+func (s *fsBlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// write then rename so readers never see half a file
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p+".type", []byte(contentType), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *fsBlobStore) Get(ctx context.Context, key string) (*blob, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, errNoBlob
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	contentType, err := ioutil.ReadFile(p + ".type")
+	if err != nil {
+		contentType = []byte("application/octet-stream")
+	}
+	return &blob{ContentType: string(contentType), Data: data, Modified: info.ModTime()}, nil
+}
+
+func (s *fsBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	os.Remove(p + ".type")
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// gridFSBlobStore speaks the GridFS layout (<bucket>.files and
+// <bucket>.chunks) so the blobs can be handled with mongofiles; the vendored
+// driver has no GridFS support of its own. The key is the filename.
+type gridFSBlobStore struct {
+	files  *mongo.Collection
+	chunks *mongo.Collection
+}
+
+const gridFSChunkSize = 255 * 1024
+
+type gridFSFile struct {
+	ID          objectid.ObjectID `bson:"_id"`
+	Length      int64             `bson:"length"`
+	UploadDate  time.Time         `bson:"uploadDate"`
+	ContentType string            `bson:"contentType"`
+}
+
+type gridFSChunk struct {
+	N    int    `bson:"n"`
+	Data []byte `bson:"data"`
+}
+
+func newGridFSBlobStore(db *mongo.Database, bucket string) *gridFSBlobStore {
+	return &gridFSBlobStore{
+		files:  db.Collection(bucket + ".files"),
+		chunks: db.Collection(bucket + ".chunks"),
+	}
+}
+
+func (s *gridFSBlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	fileID := objectid.New()
+	for n := 0; n*gridFSChunkSize < len(data) || n == 0; n++ {
+		end := (n + 1) * gridFSChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := bson.NewDocument(
+			bson.EC.ObjectID("files_id", fileID),
+			bson.EC.Int32("n", int32(n)),
+			bson.EC.Binary("data", data[n*gridFSChunkSize:end]),
+		)
+		if _, err := s.chunks.InsertOne(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	// the files document goes last, readers only find complete blobs
+	file := bson.NewDocument(
+		bson.EC.ObjectID("_id", fileID),
+		bson.EC.Int64("length", int64(len(data))),
+		bson.EC.Int32("chunkSize", gridFSChunkSize),
+		bson.EC.Time("uploadDate", time.Now()),
+		bson.EC.String("filename", key),
+		bson.EC.String("contentType", contentType),
+	)
+	if _, err := s.files.InsertOne(ctx, file); err != nil {
+		return err
+	}
+	// replacing a blob keeps only the newest upload
+	return s.deleteExcept(ctx, key, fileID)
+}
+
+func (s *gridFSBlobStore) Get(ctx context.Context, key string) (*blob, error) {
+	var file gridFSFile
+	err := s.files.FindOne(ctx, bson.NewDocument(bson.EC.String("filename", key)),
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("uploadDate", -1)))).Decode(&file)
+	if err == mongo.ErrNoDocuments {
+		return nil, errNoBlob
+	}
+	if err != nil {
+		return nil, err
+	}
+	cur, err := s.chunks.Find(ctx, bson.NewDocument(bson.EC.ObjectID("files_id", file.ID)),
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("n", 1))))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	data := make([]byte, 0, file.Length)
+	for n := 0; cur.Next(ctx); n++ {
+		var chunk gridFSChunk
+		if err := cur.Decode(&chunk); err != nil {
+			return nil, err
+		}
+		if chunk.N != n {
+			return nil, fmt.Errorf("blob %s is missing chunk %d", key, n)
+		}
+		data = append(data, chunk.Data...)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != file.Length {
+		return nil, fmt.Errorf("blob %s is %d bytes, expected %d", key, len(data), file.Length)
+	}
+	return &blob{ContentType: file.ContentType, Data: data, Modified: file.UploadDate}, nil
+}
+
+func (s *gridFSBlobStore) Delete(ctx context.Context, key string) error {
+	return s.deleteExcept(ctx, key, objectid.NilObjectID)
+}
+
+func (s *gridFSBlobStore) deleteExcept(ctx context.Context, key string, keep objectid.ObjectID) error {
+	cur, err := s.files.Find(ctx, bson.NewDocument(bson.EC.String("filename", key)))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var file gridFSFile
+		if err := cur.Decode(&file); err != nil {
+			return err
+		}
+		if file.ID == keep {
+			continue
+		}
+		if _, err := s.files.DeleteOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", file.ID))); err != nil {
+			return err
+		}
+		if _, err := s.chunks.DeleteMany(ctx, bson.NewDocument(bson.EC.ObjectID("files_id", file.ID))); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// The dashboard is one websocket per store tablet, GET
+// /api/v1/stores/{id}/ws, carrying the kitchen queue, stock levels and the
+// menu. It takes a cashier's token like the queue does; browsers can't set
+// headers on a websocket, so that's a ?ticket= (see staff.go).
+// ?topics=queue,stock picks what to send, all three by default.
+//
+// Every message is a JSON text message with a type. From the server:
+//
+//	{"type":"queue","data":[...]}  the queue, as GET .../queue returns it
+//	{"type":"stock","data":[...]}  stock levels, as GET .../stock
+//	{"type":"menu","data":[...]}   every item on the store's menu
+//	{"type":"reply","id":1,"ok":true,"data":{...}}
+//	{"type":"reply","id":1,"ok":false,"error":"..."}
+//
+// Each topic is sent whole when the socket opens and again whenever it
+// changes, so a client only ever needs the last one of each. From the
+// client, each with an id its reply will carry:
+//
+//	{"id":1,"type":"bump","order":"...","state":"ready"}   state optional
+//	{"id":2,"type":"stock","item":"...","qty":12}
+//	{"id":3,"type":"stock","item":"...","available":false}
+//
+// Stock requests need a manager at the store, as PUT .../stock does.
+//
+// The server pings every 30s and drops a client it hasn't heard a pong
+// from in 60s. A slow client doesn't build up a backlog: changes only mark
+// a topic stale and the latest of it is sent when the socket is free, a
+// write that takes over 10s drops the client, and one that sends requests
+// faster than it reads replies is closed with 1008.
+
+const (
+	dashPingEvery  = 30 * time.Second
+	dashPongWait   = 60 * time.Second
+	dashWriteWait  = 10 * time.Second
+	dashReplyQueue = 16
+)
+
+var dashTopics = []string{"queue", "stock", "menu"}
+
+type dashUpdate struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type dashRequest struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Order     string `json:"order"`
+	State     string `json:"state"`
+	Item      string `json:"item"`
+	Qty       *int   `json:"qty"`
+	Available *bool  `json:"available"`
+}
+
+type dashReply struct {
+	Type  string      `json:"type"`
+	ID    int64       `json:"id"`
+	OK    bool        `json:"ok"`
+	Error string      `json:"error,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+type dashboard struct {
+	conn    *wsConn
+	req     *http.Request
+	store   objectid.ObjectID
+	staff   *staffMember
+	replies chan dashReply
+	done    chan struct{} // closed when the reader stops
+}
+
+// dashFilter reads ?topics=queue,stock
+func dashFilter(req *http.Request) (map[string]bool, error) {
+	topics := make(map[string]bool)
+	param := req.URL.Query().Get("topics")
+	if param == "" {
+		for _, topic := range dashTopics {
+			topics[topic] = true
+		}
+		return topics, nil
+	}
+	for _, topic := range strings.Split(param, ",") {
+		switch topic {
+		case "queue", "stock", "menu":
+			topics[topic] = true
+		default:
+			return nil, fmt.Errorf("unknown topic %q, use queue, stock or menu", topic)
+		}
+	}
+	return topics, nil
+}
+
+// dashMenu is every item on the store's menu, whether or not it can be
+// ordered now; availability comes with stock.
+func dashMenu(ctx context.Context, store objectid.ObjectID) ([]menuItem, error) {
+	cur, err := menuItemsColl.Find(ctx, bson.NewDocument(bson.EC.ObjectID("store", store), notDeleted()))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	list := make([]menuItem, 0)
+	for cur.Next(ctx) {
+		var item menuItem
+		if err := cur.Decode(&item); err != nil {
+			return nil, err
+		}
+		item.fill()
+		item.Images = imageURLs(item.Images)
+		item.Available = true
+		list = append(list, item)
+	}
+	return list, cur.Err()
+}
+
+func (d *dashboard) snapshot(topic string) (interface{}, error) {
+	switch topic {
+	case "queue":
+		return loadQueue(d.req, d.store, queueStates)
+	case "stock":
+		return stockLevels(d.req.Context(), d.store)
+	default:
+		return dashMenu(d.req.Context(), d.store)
+	}
+}
+
+func (d *dashboard) send(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	return d.conn.WriteText(body, dashWriteWait)
+}
+
+// write sends topics as they go stale, replies and pings until the client
+// goes away. Topics not asked for have nil pokes, which never fire.
+func (d *dashboard) write(stale map[string]bool, queuePoke, stockPoke, menuPoke chan struct{}) {
+	ping := time.NewTicker(dashPingEvery)
+	defer ping.Stop()
+	for {
+		for _, topic := range dashTopics {
+			if !stale[topic] {
+				continue
+			}
+			data, err := d.snapshot(topic)
+			if err != nil {
+				log.Printf("dashboard %s %s: %s", d.store.Hex(), topic, err)
+				d.conn.Close(wsInternalErr, "couldn't load "+topic)
+				return
+			}
+			if err := d.send(dashUpdate{Type: topic, Data: data}); err != nil {
+				d.conn.Close(wsGoingAway, "too slow")
+				return
+			}
+			stale[topic] = false
+		}
+
+		select {
+		case <-d.done:
+			return
+		case reply := <-d.replies:
+			if err := d.send(reply); err != nil {
+				d.conn.Close(wsGoingAway, "too slow")
+				return
+			}
+		case <-ping.C:
+			if err := d.conn.Ping(dashWriteWait); err != nil {
+				d.conn.Close(wsGoingAway, "too slow")
+				return
+			}
+		case <-queuePoke:
+			stale["queue"] = true
+		case <-stockPoke:
+			stale["stock"] = true
+		case <-menuPoke:
+			stale["menu"] = true
+		}
+	}
+}
+
+// read handles requests until the client goes away. Replies are queued for
+// the writer; a client that lets them pile up is closed.
+func (d *dashboard) read() {
+	defer close(d.done)
+	d.conn.SetReadDeadline(time.Now().Add(dashPongWait))
+	for {
+		opcode, message, err := d.conn.ReadMessage()
+		if err != nil {
+			if _, ok := err.(*wsCloseError); !ok {
+				d.conn.Close(wsGoingAway, "")
+			}
+			return
+		}
+		reply := dashReply{Type: "reply"}
+		var request dashRequest
+		if opcode != wsText {
+			reply.Error = "requests are JSON text messages"
+		} else if err := json.Unmarshal(message, &request); err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.ID = request.ID
+			reply.Data, err = d.handle(&request)
+			if err != nil {
+				reply.Error = err.Error()
+			}
+		}
+		reply.OK = reply.Error == ""
+		select {
+		case d.replies <- reply:
+		default:
+			d.conn.Close(wsPolicy, "too many replies waiting, read them")
+			return
+		}
+	}
+}
+
+func (d *dashboard) handle(request *dashRequest) (interface{}, error) {
+	switch request.Type {
+	case "bump":
+		oid, err := objectid.FromHex(request.Order)
+		if err != nil {
+			return nil, err
+		}
+		var order *orderRecord
+		err = runTxn(d.req.Context(), func(tx *txn) error {
+			var err error
+			order, err = bumpOrder(tx, d.store, oid, request.State, actor(d.staff))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("order %s bumped to %s by %s", request.Order, order.State, d.staff.Name)
+		orderChanged(oid)
+		return newQueueOrder(order), nil
+
+	case "stock":
+		// the socket only needs a cashier
+		if err := checkStaff(d.staff, roleManager, d.store); err != nil {
+			return nil, err
+		}
+		_, err := setStock(d.req.Context(), d.store, request.Item, request.Qty, request.Available)
+		if err != nil {
+			return nil, err
+		}
+		events.publish(stockKey(d.store))
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("unknown request type %q, use bump or stock", request.Type)
+	}
+}
+
+// handleDashboard is GET /api/v1/stores/{id}/ws
+func handleDashboard(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+	if len(rest) != 0 {
+		http.Error(res, fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path), 404)
+		return
+	}
+	store, err := objectid.FromHex(storeID)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	s, err := requireStaff(req, roleCashier, store)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	topics, err := dashFilter(req)
+	if err != nil {
+		http.Error(res, err.Error(), 400)
+		return
+	}
+
+	// subscribe before the first snapshots so nothing slips in between
+	var queuePoke, stockPoke, menuPoke chan struct{}
+	var stop func()
+	if topics["queue"] {
+		queuePoke, stop = events.subscribe(queueKey(store))
+		defer stop()
+	}
+	if topics["stock"] {
+		stockPoke, stop = events.subscribe(stockKey(store))
+		defer stop()
+	}
+	if topics["menu"] {
+		menuPoke, stop = events.subscribe(menuKey(store))
+		defer stop()
+	}
+
+	conn, err := wsUpgrade(res, req)
+	if err != nil {
+		log.Printf("dashboard %s: %s", storeID, err)
+		return
+	}
+	conn.onPong = func() {
+		conn.SetReadDeadline(time.Now().Add(dashPongWait))
+	}
+	log.Printf("dashboard %s opened by %s", storeID, s.Name)
+	d := &dashboard{
+		conn:    conn,
+		req:     req,
+		store:   store,
+		staff:   s,
+		replies: make(chan dashReply, dashReplyQueue),
+		done:    make(chan struct{}),
+	}
+	go d.read()
+	d.write(topics, queuePoke, stockPoke, menuPoke)
+	<-d.done
+	log.Printf("dashboard %s closed", storeID)
+}
+
+func setupDashboard() {
+	storeRoutes["ws"] = handleDashboard
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+// allergens we label, roughly the major food allergens plus gluten
+var allergens = map[string]bool{
+	"dairy":     true,
+	"eggs":      true,
+	"fish":      true,
+	"shellfish": true,
+	"nuts":      true,
+	"peanuts":   true,
+	"wheat":     true,
+	"gluten":    true,
+	"soy":       true,
+	"sesame":    true,
+}
+
+var dietTags = map[string]bool{
+	"vegetarian":  true,
+	"vegan":       true,
+	"gluten-free": true,
+}
+
+// nutrition is per serving. Grams for the macros.
+type nutrition struct {
+	Calories int     `json:"calories"`
+	Protein  float64 `json:"protein"`
+	Carbs    float64 `json:"carbs"`
+	Fat      float64 `json:"fat"`
+}
+
+// dietSummary describes a whole order: nutrition summed over every serving,
+// any allergen found in any item, and the diet tags every item shares.
+type dietSummary struct {
+	Nutrition nutrition `json:"nutrition"`
+	Allergens []string  `json:"allergens"`
+	Diet      []string  `json:"diet"`
+	// items with no nutrition facts, so the totals are a lower bound
+	Missing []string `json:"missing"`
+}
+
+// cleanTags lower-cases tags and checks them against known.
+func cleanTags(tags []string, known map[string]bool, what string) ([]string, error) {
+	clean := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		if !known[tag] {
+			return nil, fmt.Errorf("unknown %s %q, expected one of %s", what, tag, strings.Join(sortedKeys(known), ", "))
+		}
+		clean = append(clean, tag)
+	}
+	return clean, nil
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func tagsElement(key string, tags []string) *bson.Element {
+	values := make([]*bson.Value, 0, len(tags))
+	for _, tag := range tags {
+		values = append(values, bson.VC.String(tag))
+	}
+	return bson.EC.ArrayFromElements(key, values...)
+}
+
+func nutritionElement(n *nutrition) *bson.Element {
+	return bson.EC.SubDocumentFromElements("nutrition",
+		bson.EC.Int32("calories", int32(n.Calories)),
+		bson.EC.Double("protein", n.Protein),
+		bson.EC.Double("carbs", n.Carbs),
+		bson.EC.Double("fat", n.Fat),
+	)
+}
+
+func (n *nutrition) validate() error {
+	if n.Calories < 0 || n.Protein < 0 || n.Carbs < 0 || n.Fat < 0 {
+		return fmt.Errorf("nutrition facts may not be negative")
+	}
+	return nil
+}
+
+// matchesDiet is the menu filter: item has none of exclude and all of want.
+func matchesDiet(item *menuItem, exclude, want []string) bool {
+	for _, a := range exclude {
+		for _, b := range item.Allergens {
+			if a == b {
+				return false
+			}
+		}
+	}
+	for _, tag := range want {
+		found := false
+		for _, have := range item.Diet {
+			if have == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// summarizeDiet adds up a priced bill.
+func summarizeDiet(b *bill) *dietSummary {
+	sum := &dietSummary{Allergens: make([]string, 0), Diet: make([]string, 0), Missing: make([]string, 0)}
+	found := make(map[string]bool)
+	shared := make(map[string]int)
+	for oid, count := range billCounts(b) {
+		item := b.menu[oid]
+		for _, a := range item.Allergens {
+			found[a] = true
+		}
+		for _, tag := range item.Diet {
+			shared[tag]++
+		}
+		if item.Nutrition == nil {
+			sum.Missing = append(sum.Missing, item.Name)
+			continue
+		}
+		sum.Nutrition.Calories += item.Nutrition.Calories * count
+		sum.Nutrition.Protein += item.Nutrition.Protein * float64(count)
+		sum.Nutrition.Carbs += item.Nutrition.Carbs * float64(count)
+		sum.Nutrition.Fat += item.Nutrition.Fat * float64(count)
+	}
+	sum.Allergens = append(sum.Allergens, sortedKeys(found)...)
+	for tag, n := range shared {
+		if n == len(b.menu) {
+			sum.Diet = append(sum.Diet, tag)
+		}
+	}
+	sort.Strings(sum.Diet)
+	sort.Strings(sum.Missing)
+	return sum
+}
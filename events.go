@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/changestreamopt"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+	"github.com/mongodb/mongo-go-driver/mongo/mongoopt"
+)
+
+// Order events are the entries in an order's history, so they're already
+// stored and numbered: an event's id is its position in the history, which
+// is what Last-Event-ID resumes from and holds across restarts and
+// replicas. The hub only tells streams that an order or a store's queue may
+// have changed, and they read back what's new. Pokes are cheap to repeat,
+// so writes here and the change stream (ORDER_EVENTS=changestream, needs a
+// replica set) can both send them.
+
+const (
+	heartbeatEvery = 15 * time.Second
+	defaultPrep    = 10 * time.Minute // until a store has ready orders to go by
+	prepSample     = 20
+)
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[string]map[chan struct{}]bool
+}
+
+var events = &eventHub{subs: make(map[string]map[chan struct{}]bool)}
+
+// subscribe returns a channel poked when key changes, and the func to stop.
+func (h *eventHub) subscribe(key string) (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	h.mu.Lock()
+	if h.subs[key] == nil {
+		h.subs[key] = make(map[chan struct{}]bool)
+	}
+	h.subs[key][ch] = true
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs[key], ch)
+		if len(h.subs[key]) == 0 {
+			delete(h.subs, key)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// publish pokes everyone on key. A subscriber that hasn't caught up with
+// the last poke already has one waiting, so it never blocks.
+func (h *eventHub) publish(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func orderKey(oid objectid.ObjectID) string { return "order:" + oid.Hex() }
+func queueKey(oid objectid.ObjectID) string { return "queue:" + oid.Hex() }
+func stockKey(oid objectid.ObjectID) string { return "stock:" + oid.Hex() }
+func menuKey(oid objectid.ObjectID) string  { return "menu:" + oid.Hex() }
+
+// orderChanged is called after an order is written.
+func orderChanged(oid objectid.ObjectID) {
+	events.publish(orderKey(oid))
+	var order struct {
+		Store objectid.ObjectID `bson:"store"`
+	}
+	err := ordersColl.FindOne(context.Background(), bson.NewDocument(bson.EC.ObjectID("_id", oid)),
+		findopt.Projection(bson.NewDocument(bson.EC.Int32("store", 1)))).Decode(&order)
+	if err != nil {
+		log.Printf("order %s changed: %s", oid.Hex(), err)
+		return
+	}
+	events.publish(queueKey(order.Store))
+	// submitting and cancelling move stock
+	events.publish(stockKey(order.Store))
+}
+
+// watchOrders pokes the hub from a change stream on orders, so writes made
+// by other replicas reach streams served here. It reopens the stream when
+// it fails and only stops with ctx.
+func watchOrders(ctx context.Context) {
+	for ctx.Err() == nil {
+		cs, err := ordersColl.Watch(ctx, bson.NewArray(),
+			changestreamopt.FullDocument(mongoopt.UpdateLookup),
+			changestreamopt.MaxAwaitTime(heartbeatEvery))
+		if err != nil {
+			log.Printf("watching orders: %s", err)
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		for ctx.Err() == nil {
+			if !cs.Next(ctx) {
+				if cs.Err() != nil {
+					break
+				}
+				continue
+			}
+			change, err := cs.DecodeBytes()
+			if err != nil {
+				log.Printf("reading order change: %s", err)
+				break
+			}
+			if id, err := change.Lookup("documentKey", "_id"); err == nil {
+				events.publish(orderKey(id.Value().ObjectID()))
+			}
+			if store, err := change.Lookup("fullDocument", "store"); err == nil {
+				events.publish(queueKey(store.Value().ObjectID()))
+			}
+		}
+		if err := cs.Err(); err != nil {
+			log.Printf("order change stream: %s", err)
+		}
+		cs.Close(context.Background())
+	}
+}
+
+// orderStatus is the data of an order event.
+type orderStatus struct {
+	Order   string `json:"order"`
+	Event   string `json:"event"`
+	State   string `json:"state"` // the order's state now, not at the event
+	At      int64  `json:"at"`
+	Note    string `json:"note,omitempty"`
+	Amount  string `json:"amount,omitempty"`
+	ReadyAt int64  `json:"ready_at,omitempty"` // estimated until it's ready
+}
+
+// estimateReady guesses when an order will be ready: submission plus how
+// long the store's last few orders took, or when it was ready if it was.
+func estimateReady(ctx context.Context, order *orderRecord) int64 {
+	switch order.State {
+	case orderReady, orderDone:
+		return order.Ready
+	case orderSubmitted, orderPreparing:
+	default:
+		return 0
+	}
+	prep := defaultPrep
+	cur, err := ordersColl.Find(ctx, bson.NewDocument(
+		bson.EC.ObjectID("store", order.storeOID()),
+		bson.EC.SubDocumentFromElements("ready", bson.EC.Int64("$gt", 0)),
+	),
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("ready", -1))),
+		findopt.Limit(prepSample),
+		findopt.Projection(bson.NewDocument(bson.EC.Int32("started", 1), bson.EC.Int32("ready", 1))),
+	)
+	if err == nil {
+		defer cur.Close(ctx)
+		var sum, n int64
+		for cur.Next(ctx) {
+			var done orderRecord
+			if cur.Decode(&done) == nil && done.Ready > done.Started {
+				sum += done.Ready - done.Started
+				n++
+			}
+		}
+		if n > 0 {
+			prep = time.Duration(sum/n) * time.Second
+		}
+	}
+	return order.Started + int64(prep/time.Second)
+}
+
+// sseStream sets res up for server-sent events, or fails if it can't flush.
+func sseStream(res http.ResponseWriter) (http.Flusher, error) {
+	flusher, ok := res.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("streaming isn't supported here")
+	}
+	res.Header().Set("Content-Type", "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.Header().Set("X-Accel-Buffering", "no") // nginx would hold events back
+	res.WriteHeader(http.StatusOK)
+	fmt.Fprintf(res, "retry: %d\n\n", 3000)
+	flusher.Flush()
+	return flusher, nil
+}
+
+// awaitPoke waits for poke, sending a comment every so often so proxies
+// don't drop the connection. false if the client went away.
+func awaitPoke(ctx context.Context, res http.ResponseWriter, flusher http.Flusher, poke chan struct{}) bool {
+	heartbeat := time.NewTicker(heartbeatEvery)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-poke:
+			return true
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return false
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(res http.ResponseWriter, id, event string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(res, "id: %s\nevent: %s\ndata: %s\n\n", id, event, body)
+	return err
+}
+
+// handleOrdersEvents is GET /api/v1/orders/{id}/events, the order's status
+// as server-sent events. Every history entry after Last-Event-ID (all of
+// them without it) comes first, then each one as it happens.
+func handleOrdersEvents(res http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/orders/"), "/")
+	if req.Method != "GET" || len(parts) != 2 || parts[1] != "events" {
+		http.Error(res, fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path), 404)
+		return
+	}
+	oid, err := objectid.FromHex(parts[0])
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	sent := 0
+	if last := req.Header.Get("Last-Event-ID"); last != "" {
+		sent, err = strconv.Atoi(last)
+		if err != nil || sent < 0 {
+			http.Error(res, "Last-Event-ID must be an event id from this stream", 400)
+			return
+		}
+	}
+
+	ctx := req.Context()
+	// subscribe before the first read so nothing slips in between
+	poke, stop := events.subscribe(orderKey(oid))
+	defer stop()
+	var order orderRecord
+	err = ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&order)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	flusher, err := sseStream(res)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	log.Printf("streaming order %s from event %d", oid.Hex(), sent)
+
+	for {
+		if len(order.History) > sent {
+			readyAt := estimateReady(ctx, &order)
+			for ; sent < len(order.History); sent++ {
+				event := order.History[sent]
+				err := writeEvent(res, strconv.Itoa(sent+1), event.Event, orderStatus{
+					Order:   oid.Hex(),
+					Event:   event.Event,
+					State:   order.State,
+					At:      event.At,
+					Note:    event.Note,
+					Amount:  event.Amount,
+					ReadyAt: readyAt,
+				})
+				if err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+
+		if !awaitPoke(ctx, res, flusher, poke) {
+			return
+		}
+		order = orderRecord{}
+		err := ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&order)
+		if err != nil {
+			log.Printf("streaming order %s: %s", oid.Hex(), err)
+			return
+		}
+	}
+}
+
+// handleQueueEvents is GET /api/v1/stores/{id}/queue/events, the whole
+// queue as a "queue" event each time it changes, for kitchen tablets.
+// ?state= filters like the queue itself. Event ids are times in ms, a
+// resumed stream just starts with the queue as it is.
+func handleQueueEvents(res http.ResponseWriter, req *http.Request, store objectid.ObjectID) {
+	states, err := queueFilter(req)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	ctx := req.Context()
+	poke, stop := events.subscribe(queueKey(store))
+	defer stop()
+	flusher, err := sseStream(res)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+
+	for {
+		list, err := loadQueue(req, store, states)
+		if err != nil {
+			log.Printf("streaming queue %s: %s", store.Hex(), err)
+			return
+		}
+		id := strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10)
+		if err := writeEvent(res, id, "queue", list); err != nil {
+			return
+		}
+		flusher.Flush()
+		if !awaitPoke(ctx, res, flusher, poke) {
+			return
+		}
+	}
+}
+
+func setupEvents() {
+	if getEnv("ORDER_EVENTS", "local") == "changestream" {
+		fmt.Println("Watching orders for events")
+		go watchOrders(context.Background())
+	}
+
+	http.HandleFunc("/api/v1/orders/", handleOrdersEvents)
+}
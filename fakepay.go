@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// fakeProvider is a payment processor in memory, for working on checkout
+// without a real one. The card token decides what happens:
+//
+//	tok_visa, or anything else  approved
+//	tok_decline                 declined, "card declined"
+//	tok_insufficient            declined, "insufficient funds"
+//	tok_slow                    approved after PAYMENT_FAKE_DELAY (default 3s)
+//	tok_error                   the processor can't be reached
+//
+// PAYMENT_FAKE_DECLINE_RATE declines that percent of the approved ones at
+// random, to shake out the unhappy paths. Nothing survives a restart.
+type fakeProvider struct {
+	delay       time.Duration
+	declineRate int
+
+	mu    sync.Mutex
+	next  int
+	auths map[string]*fakeAuth
+}
+
+type fakeAuth struct {
+	amount, captured, refunded int64
+	voided                     bool
+}
+
+func newFakeProvider() (*fakeProvider, error) {
+	delay, err := time.ParseDuration(getEnv("PAYMENT_FAKE_DELAY", "3s"))
+	if err != nil {
+		return nil, fmt.Errorf("bad PAYMENT_FAKE_DELAY: %s", err)
+	}
+	rate, err := strconv.Atoi(getEnv("PAYMENT_FAKE_DECLINE_RATE", "0"))
+	if err != nil || rate < 0 || rate > 100 {
+		return nil, fmt.Errorf("PAYMENT_FAKE_DECLINE_RATE must be a percent")
+	}
+	return &fakeProvider{
+		delay:       delay,
+		declineRate: rate,
+		auths:       make(map[string]*fakeAuth),
+	}, nil
+}
+
+func (f *fakeProvider) Name() string {
+	return "fake"
+}
+
+func (f *fakeProvider) Authorize(ctx context.Context, source string, amount int64, order string) (string, error) {
+	switch source {
+	case "tok_decline":
+		return "", &declineError{"card declined"}
+	case "tok_insufficient":
+		return "", &declineError{"insufficient funds"}
+	case "tok_error":
+		return "", fmt.Errorf("fake provider: connection refused")
+	case "tok_slow":
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	if f.declineRate > 0 && rand.Intn(100) < f.declineRate {
+		return "", &declineError{"card declined"}
+	}
+	if amount <= 0 {
+		return "", fmt.Errorf("fake provider: amount must be positive")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.next++
+	ref := fmt.Sprintf("fake_auth_%d", f.next)
+	f.auths[ref] = &fakeAuth{amount: amount}
+	return ref, nil
+}
+
+func (f *fakeProvider) auth(ref string) (*fakeAuth, error) {
+	auth, ok := f.auths[ref]
+	if !ok {
+		return nil, fmt.Errorf("fake provider: no authorization %s", ref)
+	}
+	return auth, nil
+}
+
+func (f *fakeProvider) Capture(ctx context.Context, ref string, amount int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	auth, err := f.auth(ref)
+	if err != nil {
+		return err
+	}
+	if auth.voided || auth.captured > 0 {
+		return fmt.Errorf("fake provider: %s is already settled", ref)
+	}
+	if amount > auth.amount {
+		return fmt.Errorf("fake provider: can't capture more than was authorized")
+	}
+	auth.captured = amount
+	return nil
+}
+
+func (f *fakeProvider) Void(ctx context.Context, ref string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	auth, err := f.auth(ref)
+	if err != nil {
+		return err
+	}
+	if auth.captured > 0 {
+		return fmt.Errorf("fake provider: %s was captured, refund it instead", ref)
+	}
+	auth.voided = true
+	return nil
+}
+
+func (f *fakeProvider) Refund(ctx context.Context, ref string, amount int64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	auth, err := f.auth(ref)
+	if err != nil {
+		return "", err
+	}
+	if amount > auth.captured-auth.refunded {
+		return "", fmt.Errorf("fake provider: refund is more than what's left on %s", ref)
+	}
+	auth.refunded += amount
+	f.next++
+	return fmt.Sprintf("fake_refund_%d", f.next), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// A client that might retry a write, after a timeout say, sends an
+// Idempotency-Key header with it: anything up to 255 characters that's
+// unique to that write. Retries with the same key get the first response
+// back, with Idempotent-Replayed: true, instead of a second order, payment
+// or refund. A key only goes with the request it came with, same method,
+// path and body; another request with it is turned away, as is a retry
+// while the first is still running. Keys are per caller, the staff token
+// or ticket is hashed in with them, so someone else sending the same key
+// doesn't get the response. A 5xx isn't kept, so retrying after one runs
+// the write again, and neither is anything marked Cache-Control: no-store,
+// which the handlers handing out tokens and secrets set. A key whose
+// request died with the server stays in progress. Keys are kept for
+// idempotencyTTL, the TTL index on created clears them out after that.
+// Reads ignore the header.
+
+const (
+	idempotencyTTL        = 24 * time.Hour
+	idempotencyMaxKey     = 255
+	idempotencyMaxRequest = 8 << 20
+	idempotencyMaxStored  = 1 << 20 // responses bigger than this aren't kept
+)
+
+// idempotencyRecord is a key and, once its request is done, the response.
+type idempotencyRecord struct {
+	ID          string    `bson:"_id"` // hash of the key and the caller's credentials
+	Fingerprint string    `bson:"fingerprint"`
+	Done        bool      `bson:"done"`
+	Status      int       `bson:"status"`
+	ContentType string    `bson:"content_type"`
+	Response    []byte    `bson:"response"`
+	Created     time.Time `bson:"created"`
+}
+
+var idempotencyColl *mongo.Collection
+
+// idempotencyRecorder passes a response through, keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotencyRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.body.Len() <= idempotencyMaxStored {
+		r.body.Write(b)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// withIdempotency answers writes that carry an Idempotency-Key, see the
+// top of the file.
+func withIdempotency(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" || req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" {
+			next.ServeHTTP(res, req)
+			return
+		}
+		if len(key) > idempotencyMaxKey {
+			http.Error(res, fmt.Sprintf("Idempotency-Key can be up to %d characters", idempotencyMaxKey), 400)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, idempotencyMaxRequest+1))
+		req.Body.Close()
+		if err != nil {
+			http.Error(res, err.Error(), 400)
+			return
+		}
+		if len(body) > idempotencyMaxRequest {
+			http.Error(res, "Request too big for an Idempotency-Key", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.New()
+		fmt.Fprintf(sum, "%s %s\n", req.Method, req.URL.RequestURI())
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+		id := hashToken(key + "\x00" + req.Header.Get("X-Staff-Token") + "\x00" + req.URL.Query().Get("ticket"))
+
+		ctx := context.Background()
+		_, err = idempotencyColl.InsertOne(ctx, bson.NewDocument(
+			bson.EC.String("_id", id),
+			bson.EC.String("fingerprint", fingerprint),
+			bson.EC.Boolean("done", false),
+			bson.EC.Time("created", time.Now()),
+		))
+		if isDuplicateKey(err) {
+			replayIdempotent(res, id, fingerprint)
+			return
+		}
+		if err != nil {
+			http.Error(res, err.Error(), 500)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: res}
+		next.ServeHTTP(rec, req)
+
+		filter := bson.NewDocument(bson.EC.String("_id", id))
+		if rec.status >= 500 || rec.body.Len() > idempotencyMaxStored ||
+			strings.Contains(res.Header().Get("Cache-Control"), "no-store") {
+			// let a retry run it again
+			if _, err := idempotencyColl.DeleteOne(ctx, filter); err != nil {
+				log.Printf("idempotency: dropping key for %s %s: %s", req.Method, req.URL.Path, err)
+			}
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		_, err = idempotencyColl.UpdateOne(ctx, filter, bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+			bson.EC.Boolean("done", true),
+			bson.EC.Int32("status", int32(rec.status)),
+			bson.EC.String("content_type", res.Header().Get("Content-Type")),
+			bson.EC.Binary("response", rec.body.Bytes()),
+		)))
+		if err != nil {
+			log.Printf("idempotency: keeping the response to %s %s: %s", req.Method, req.URL.Path, err)
+		}
+	})
+}
+
+// replayIdempotent answers a request whose key id is already taken.
+func replayIdempotent(res http.ResponseWriter, id, fingerprint string) {
+	var record idempotencyRecord
+	err := idempotencyColl.FindOne(context.Background(), bson.NewDocument(bson.EC.String("_id", id))).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		// the first one just failed and let its key go
+		http.Error(res, "A request with this Idempotency-Key just failed, retry it", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	if record.Fingerprint != fingerprint {
+		http.Error(res, "This Idempotency-Key was used for a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if !record.Done {
+		http.Error(res, "A request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+	if record.ContentType != "" {
+		res.Header().Set("Content-Type", record.ContentType)
+	}
+	res.Header().Set("Idempotent-Replayed", "true")
+	res.WriteHeader(record.Status)
+	res.Write(record.Response)
+}
+
+func setupIdempotency() {
+	idempotencyColl = database.Collection("idempotency_keys")
+}
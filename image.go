@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder for uploads
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+const (
+	maxImageBytes = 5 << 20
+	maxImageSide  = 6000
+)
+
+// imageSizes are the renditions made from every upload, by longest side.
+// The original is kept as well.
+var imageSizes = []struct {
+	name string
+	side int
+}{
+	{"thumb", 96},
+	{"small", 320},
+	{"large", 960},
+}
+
+// imageURL is where handleImages serves a blob key from.
+func imageURL(key string) string {
+	return "/api/v1/images/" + key
+}
+
+// handleMenuImage is PUT and DELETE on /api/v1/menu/{id}/image. The upload is
+// either the raw image with an image/jpeg or image/png Content-Type, or a
+// multipart form with the file in the "image" field.
+func handleMenuImage(res http.ResponseWriter, req *http.Request, itemID string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	log.Printf("image param: %s", itemID)
+	oid, err := objectid.FromHex(itemID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	var item menuItem
+	err = menuItemsColl.FindOne(context.Background(), bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&item)
+	if err == mongo.ErrNoDocuments {
+		httpError(fmt.Sprintf("Menu item %s not found", itemID))
+		return
+	}
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+
+	switch req.Method {
+	case "PUT":
+		data, err := readUpload(res, req)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		keys, err := storeImage(context.Background(), "menu/"+itemID, data)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		images := bson.NewDocument()
+		for name, key := range keys {
+			images.Append(bson.EC.String(name, key))
+		}
+		setter := bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.SubDocument("images", images)))
+		_, err = updateItemImages(oid, setter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		deleteImages(item.Images)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(imageURLs(keys))
+
+	case "DELETE":
+		unsetter := bson.NewDocument(bson.EC.SubDocumentFromElements("$unset", bson.EC.String("images", "")))
+		matched, err := updateItemImages(oid, unsetter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		deleteImages(item.Images)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(&mongo.UpdateResult{MatchedCount: matched, ModifiedCount: matched})
+
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+	}
+}
+
+// updateItemImages applies update to an item's images and records the menu
+// change, returning how many items matched.
+func updateItemImages(oid objectid.ObjectID, update *bson.Document) (int64, error) {
+	var matched int64
+	err := runTxn(context.Background(), func(tx *txn) error {
+		var err error
+		matched, err = tx.updateOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), update)
+		if err != nil || matched == 0 {
+			return err
+		}
+		store, err := itemStore(tx, oid)
+		if err != nil {
+			return err
+		}
+		return menuChanged(tx, store, oid, "updated")
+	})
+	return matched, err
+}
+
+// handleImages serves blobs. Keys change with every upload, so responses
+// can be cached for good.
+func handleImages(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/api/v1/images/")
+	b, err := blobs.Get(context.Background(), key)
+	if err == errNoBlob {
+		http.NotFound(res, req)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	res.Header().Set("Content-Type", b.ContentType)
+	res.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	res.Header().Set("ETag", strconv.Quote(key))
+	http.ServeContent(res, req, "", b.Modified, bytes.NewReader(b.Data))
+}
+
+func readUpload(res http.ResponseWriter, req *http.Request) ([]byte, error) {
+	req.Body = http.MaxBytesReader(res, req.Body, maxImageBytes)
+	defer req.Body.Close()
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/") {
+		file, _, err := req.FormFile("image")
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ioutil.ReadAll(file)
+	}
+	return ioutil.ReadAll(req.Body)
+}
+
+// storeImage checks an upload, makes the standard sizes and stores them all
+// under prefix. It returns the blob key for each size.
+func storeImage(ctx context.Context, prefix string, data []byte) (map[string]string, error) {
+	contentType := http.DetectContentType(data)
+	var ext string
+	switch contentType {
+	case "image/jpeg":
+		ext = "jpg"
+	case "image/png":
+		ext = "png"
+	default:
+		return nil, fmt.Errorf("image must be a JPEG or PNG, not %s", contentType)
+	}
+	// check the header before decoding so a tiny file can't claim to be huge
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > maxImageSide || config.Height > maxImageSide {
+		return nil, fmt.Errorf("image may be at most %dx%d", maxImageSide, maxImageSide)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	version := strconv.FormatInt(time.Now().UnixNano(), 36)
+	keys := make(map[string]string)
+	keys["original"] = fmt.Sprintf("%s/%s/original.%s", prefix, version, ext)
+	if err := blobs.Put(ctx, keys["original"], contentType, data); err != nil {
+		return nil, err
+	}
+	for _, size := range imageSizes {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, shrink(img, size.side), &jpeg.Options{Quality: 85})
+		if err != nil {
+			return nil, err
+		}
+		key := fmt.Sprintf("%s/%s/%s.jpg", prefix, version, size.name)
+		if err := blobs.Put(ctx, key, "image/jpeg", buf.Bytes()); err != nil {
+			return nil, err
+		}
+		keys[size.name] = key
+	}
+	return keys, nil
+}
+
+func deleteImages(keys map[string]string) {
+	for _, key := range keys {
+		if err := blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("deleting image %s: %s", key, err)
+		}
+	}
+}
+
+func imageURLs(keys map[string]string) map[string]string {
+	urls := make(map[string]string, len(keys))
+	for name, key := range keys {
+		urls[name] = imageURL(key)
+	}
+	return urls
+}
+
+// shrink scales img so its longest side is at most side, averaging every
+// source pixel that lands in each destination pixel. Images already small
+// enough are only flattened onto white, since JPEG has no alpha.
+func shrink(img image.Image, side int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if w > side || h > side {
+		if w >= h {
+			dw, dh = side, h*side/w
+		} else {
+			dw, dh = w*side/h, side
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0 := bounds.Min.Y + y*h/dh
+		sy1 := bounds.Min.Y + (y+1)*h/dh
+		if sy1 == sy0 {
+			sy1++
+		}
+		for x := 0; x < dw; x++ {
+			sx0 := bounds.Min.X + x*w/dw
+			sx1 := bounds.Min.X + (x+1)*w/dw
+			if sx1 == sx0 {
+				sx1++
+			}
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// premultiplied, so adding white for the missing alpha flattens it
+			white := n*0xffff - a
+			dst.Set(x, y, color.RGBA64{
+				R: uint16((r + white) / n),
+				G: uint16((g + white) / n),
+				B: uint16((b + white) / n),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
+
+func setupImages() error {
+	if err := setupBlobs(); err != nil {
+		return err
+	}
+
+	http.HandleFunc("/api/v1/images/", handleImages)
+	return nil
+}
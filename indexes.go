@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// Every index the API relies on is declared in indexSpecs and synced as
+// the server starts: missing ones are created, while ones that differ from
+// their declaration, or that nobody declared, are only reported. Nothing
+// is ever dropped; fixing drift is for someone to do by hand once they've
+// read the report.
+//
+//	tacos-api indexes          create what's missing and report drift
+//	tacos-api indexes check    only report, failing if anything drifted
+//
+// INDEX_SYNC_ON_START=false skips the sync at startup. A new index goes in
+// indexSpecs; changing one means a new name, then dropping the old one.
+
+type indexSpec struct {
+	coll    string
+	keys    *bson.Document
+	name    string // built from keys by default, like store_1_slug_1
+	unique  bool
+	partial *bson.Document // only documents matching this are indexed
+	weights *bson.Document // a text index's fields
+	ttl     time.Duration  // expire documents this long after the BSON date in keys
+}
+
+// indexKeys is an index's keys, ascending by field name or descending
+// with a leading "-".
+func indexKeys(fields ...string) *bson.Document {
+	keys := bson.NewDocument()
+	for _, field := range fields {
+		if strings.HasPrefix(field, "-") {
+			keys.Append(bson.EC.Int32(field[1:], -1))
+			continue
+		}
+		keys.Append(bson.EC.Int32(field, 1))
+	}
+	return keys
+}
+
+// hasSlug limits the slug indexes to documents with a slug, so anything
+// the slugs migration couldn't name doesn't block them.
+func hasSlug() *bson.Document {
+	return bson.NewDocument(bson.EC.SubDocumentFromElements("slug", bson.EC.Boolean("$exists", true)))
+}
+
+var indexSpecs = []indexSpec{
+	{coll: "stores", keys: indexKeys("slug"), unique: true, partial: hasSlug()},
+	{coll: "stores", name: "search",
+		keys:    bson.NewDocument(bson.EC.String("name", "text"), bson.EC.String("city", "text")),
+		weights: bson.NewDocument(bson.EC.Int32("name", 10), bson.EC.Int32("city", 1))},
+
+	{coll: "menu_items", keys: indexKeys("store")},
+	{coll: "menu_items", keys: indexKeys("store", "slug"), unique: true, partial: hasSlug()},
+	{coll: "menu_items", name: "search",
+		keys:    bson.NewDocument(bson.EC.String("name", "text"), bson.EC.String("descr", "text")),
+		weights: bson.NewDocument(bson.EC.Int32("name", 10), bson.EC.Int32("descr", 1))},
+
+	{coll: "orders", keys: indexKeys("cust", "state")},
+	{coll: "orders", keys: indexKeys("store", "state", "started")}, // the queue
+	{coll: "orders", keys: indexKeys("store", "started")},          // reports
+
+	{coll: "order_items", keys: indexKeys("order")},
+	{coll: "order_items", keys: indexKeys("item")},
+
+	{coll: "stock", keys: indexKeys("store", "item"), unique: true},
+
+	{coll: "payments", keys: indexKeys("order")},
+
+	{coll: "promotions", keys: indexKeys("code"), unique: true},
+	{coll: "promo_redemptions", keys: indexKeys("promo", "cust")},
+	{coll: "promo_redemptions", keys: indexKeys("order")},
+
+	{coll: "tax_rates", keys: indexKeys("state", "zip", "version"), unique: true},
+
+	{coll: "staff", keys: indexKeys("token"), unique: true},
+	{coll: "staff_tickets", keys: indexKeys("created"), ttl: staffTicketTTL},
+
+	{coll: "webhook_deliveries", keys: indexKeys("state", "next")},
+	{coll: "webhook_deliveries", keys: indexKeys("hook", "-created")},
+	// the relay may hand over an event twice, a hook only gets it once
+	{coll: "webhook_deliveries", keys: indexKeys("hook", "event_id"), unique: true},
+	{coll: "webhook_dead_letters", keys: indexKeys("hook", "-created")},
+
+	{coll: "outbox", keys: indexKeys("relayed", "at")},
+
+	{coll: "audit", keys: indexKeys("resource", "doc", "-at")},
+	{coll: "audit", keys: indexKeys("actor_id", "-at")},
+	{coll: "audit", keys: indexKeys("-at")},
+
+	{coll: "idempotency_keys", keys: indexKeys("created"), ttl: idempotencyTTL},
+}
+
+func (s indexSpec) indexName() string {
+	if s.name != "" {
+		return s.name
+	}
+	parts := make([]string, 0)
+	itr := s.keys.Iterator()
+	for itr.Next() {
+		elem := itr.Element()
+		parts = append(parts, elem.Key(), valueString(elem.Value()))
+	}
+	return strings.Join(parts, "_")
+}
+
+func (s indexSpec) model() mongo.IndexModel {
+	opts := mongo.NewIndexOptionsBuilder().Name(s.indexName())
+	if s.unique {
+		opts.Unique(true)
+	}
+	if s.partial != nil {
+		opts.PartialFilterExpression(s.partial.Copy())
+	}
+	if s.weights != nil {
+		opts.Weights(s.weights.Copy())
+	}
+	if s.ttl > 0 {
+		opts.ExpireAfterSeconds(int32(s.ttl / time.Second))
+	}
+	return mongo.IndexModel{Keys: s.keys.Copy(), Options: opts.Build()}
+}
+
+// differs lists what about live, the index as the server has it, isn't
+// as declared.
+func (s indexSpec) differs(live *bson.Document) []string {
+	diffs := make([]string, 0)
+	if s.weights != nil {
+		// a text index's keys come back as _fts and _ftsx, the fields are
+		// in its weights
+		if !sameFields(s.weights, subdocument(live, "weights")) {
+			diffs = append(diffs, "weights")
+		}
+	} else if !sameFields(s.keys, subdocument(live, "key")) {
+		diffs = append(diffs, "keys")
+	}
+	unique := false
+	if elem, err := live.LookupElementErr("unique"); err == nil && elem.Value().Type() == bson.TypeBoolean {
+		unique = elem.Value().Boolean()
+	}
+	if unique != s.unique {
+		diffs = append(diffs, "unique")
+	}
+	partial := subdocument(live, "partialFilterExpression")
+	if (s.partial == nil) != (partial == nil) ||
+		(partial != nil && s.partial.ToExtJSON(false) != partial.ToExtJSON(false)) {
+		diffs = append(diffs, "partial filter")
+	}
+	ttl := ""
+	if elem, err := live.LookupElementErr("expireAfterSeconds"); err == nil {
+		ttl = valueString(elem.Value())
+	}
+	if s.ttl > 0 && ttl != strconv.Itoa(int(s.ttl/time.Second)) || s.ttl == 0 && ttl != "" {
+		diffs = append(diffs, "ttl")
+	}
+	return diffs
+}
+
+func subdocument(doc *bson.Document, key string) *bson.Document {
+	elem, err := doc.LookupElementErr(key)
+	if err != nil || elem.Value().Type() != bson.TypeEmbeddedDocument {
+		return nil
+	}
+	return elem.Value().MutableDocument()
+}
+
+// valueString is an index key's or option's value as text; the server may
+// hand back a 1 as a double.
+func valueString(v *bson.Value) string {
+	switch v.Type() {
+	case bson.TypeInt32:
+		return strconv.Itoa(int(v.Int32()))
+	case bson.TypeInt64:
+		return strconv.FormatInt(v.Int64(), 10)
+	case bson.TypeDouble:
+		return strconv.FormatFloat(v.Double(), 'f', -1, 64)
+	case bson.TypeString:
+		return v.StringValue()
+	default:
+		return v.Type().String()
+	}
+}
+
+// sameFields is whether a and b have the same fields in the same order
+// with the same values.
+func sameFields(a, b *bson.Document) bool {
+	if a == nil || b == nil || a.Len() != b.Len() {
+		return a == nil && b == nil
+	}
+	ia, ib := a.Iterator(), b.Iterator()
+	for ia.Next() && ib.Next() {
+		ea, eb := ia.Element(), ib.Element()
+		if ea.Key() != eb.Key() || valueString(ea.Value()) != valueString(eb.Value()) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexDrift is one index that isn't as declared, or that the sync
+// created.
+type indexDrift struct {
+	coll   string
+	index  string
+	issue  string
+	failed bool // creating it did
+}
+
+func (d indexDrift) String() string {
+	return fmt.Sprintf("%s index %s: %s", d.coll, d.index, d.issue)
+}
+
+// liveIndexes is coll's indexes by name.
+func liveIndexes(ctx context.Context, coll *mongo.Collection) (map[string]*bson.Document, error) {
+	cur, err := coll.Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	indexes := make(map[string]*bson.Document)
+	for cur.Next(ctx) {
+		index := bson.NewDocument()
+		if err := cur.Decode(index); err != nil {
+			return nil, err
+		}
+		if elem, err := index.LookupElementErr("name"); err == nil && elem.Value().Type() == bson.TypeString {
+			indexes[elem.Value().StringValue()] = index
+		}
+	}
+	return indexes, cur.Err()
+}
+
+// syncIndexes compares indexSpecs with what's on the server, creating
+// what's missing unless it's only checking.
+func syncIndexes(ctx context.Context, create bool) ([]indexDrift, error) {
+	specs := make(map[string][]indexSpec)
+	colls := make([]string, 0)
+	for _, spec := range indexSpecs {
+		if _, ok := specs[spec.coll]; !ok {
+			colls = append(colls, spec.coll)
+		}
+		specs[spec.coll] = append(specs[spec.coll], spec)
+	}
+
+	drift := make([]indexDrift, 0)
+	for _, name := range colls {
+		coll := database.Collection(name)
+		live, err := liveIndexes(ctx, coll)
+		if err != nil {
+			return nil, fmt.Errorf("listing %s indexes: %s", name, err)
+		}
+		for _, spec := range specs[name] {
+			index := spec.indexName()
+			doc, ok := live[index]
+			delete(live, index)
+			switch {
+			case ok:
+				if diffs := spec.differs(doc); len(diffs) > 0 {
+					drift = append(drift, indexDrift{name, index, "differs in " + strings.Join(diffs, ", "), false})
+				}
+			case !create:
+				drift = append(drift, indexDrift{name, index, "missing", false})
+			default:
+				if _, err := coll.Indexes().CreateOne(ctx, spec.model()); err != nil {
+					drift = append(drift, indexDrift{name, index, "creating it: " + err.Error(), true})
+					continue
+				}
+				drift = append(drift, indexDrift{name, index, "created", false})
+			}
+		}
+		undeclared := make([]string, 0)
+		for index := range live {
+			if index != "_id_" {
+				undeclared = append(undeclared, index)
+			}
+		}
+		sort.Strings(undeclared)
+		for _, index := range undeclared {
+			drift = append(drift, indexDrift{name, index, "not declared, drop it by hand if it's unused", false})
+		}
+	}
+	return drift, nil
+}
+
+// runIndexes is tacos-api indexes ...
+func runIndexes(ctx context.Context, args []string) error {
+	check := len(args) == 1 && args[0] == "check"
+	if len(args) > 0 && !check {
+		return fmt.Errorf("usage: tacos-api indexes [check]")
+	}
+	drift, err := syncIndexes(ctx, !check)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, d := range drift {
+		fmt.Println(d)
+		if d.failed {
+			failed++
+		}
+	}
+	if check && len(drift) > 0 {
+		return fmt.Errorf("%d indexes aren't as declared", len(drift))
+	}
+	if failed > 0 {
+		return fmt.Errorf("couldn't create %d indexes", failed)
+	}
+	return nil
+}
+
+// setupIndexes syncs the indexes at startup, logging drift rather than
+// refusing to start over it.
+func setupIndexes() {
+	if getEnv("INDEX_SYNC_ON_START", "true") != "true" {
+		return
+	}
+	drift, err := syncIndexes(context.Background(), true)
+	if err != nil {
+		log.Printf("syncing indexes: %s", err)
+		return
+	}
+	for _, d := range drift {
+		log.Print(d)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Four references hold the data together:
+//
+//	menu_items.store   the store whose menu an item is on
+//	orders.store       the store an order is from
+//	order_items.order  the order an item is on
+//	order_items.item   the menu item ordered, from the order's store
+//
+// Writes check them: what they point at has to be there and not
+// soft-deleted, and an order can only have its own store's items. Deleting
+// something that's pointed at follows the relation's policy, set with
+// INTEGRITY_POLICIES=relation=policy,...:
+//
+//	restrict      the delete fails while anything live points at it
+//	cascade       what points at it is deleted for good
+//	soft-cascade  what points at it is soft-deleted along with it
+//
+// Defaults are menu_items.store=soft-cascade, orders.store=restrict,
+// order_items.order=cascade, order_items.item=restrict. Live means menu
+// items that aren't deleted, orders that aren't done, refunded or
+// cancelled, and order items on open orders. Purging is stricter: under
+// restrict anything at all pointing at a document keeps it, so purging
+// never leaves orphans, and soft-cascade purges what it soft-deleted. Only
+// menu items can be soft-deleted, so only menu_items.store can
+// soft-cascade.
+//
+// GET /api/v1/integrity (admin) scans for references that are broken
+// already; POST repairs them the way their policy would have and leaves
+// the restrict ones to be looked at.
+
+const (
+	policyRestrict    = "restrict"
+	policyCascade     = "cascade"
+	policySoftCascade = "soft-cascade"
+)
+
+const integrityIssueLimit = 1000
+
+// relation is a reference from child.field to parent's _id.
+type relation struct {
+	Name   string `json:"name"`
+	Policy string `json:"policy"`
+	child  *mongo.Collection
+	field  string
+	parent *mongo.Collection
+	soft   bool                                   // children can be soft-deleted
+	live   func(tx *txn, d *refDoc) (bool, error) // holds up a restrict delete
+}
+
+var relations []*relation
+
+// restrictError is a delete a restrict relation held up.
+type restrictError struct {
+	msg string
+}
+
+func (e *restrictError) Error() string {
+	return e.msg
+}
+
+// refDoc is what relations need of any document that points at another.
+type refDoc struct {
+	ID        objectid.ObjectID `bson:"_id"`
+	Store     objectid.ObjectID `bson:"store"`
+	Order     objectid.ObjectID `bson:"order"`
+	Item      objectid.ObjectID `bson:"item"`
+	State     string            `bson:"state"`
+	DeletedAt int64             `bson:"deleted_at"`
+}
+
+func (d *refDoc) ref(field string) objectid.ObjectID {
+	switch field {
+	case "store":
+		return d.Store
+	case "order":
+		return d.Order
+	default:
+		return d.Item
+	}
+}
+
+// docNoun is what coll holds, for messages.
+func docNoun(coll *mongo.Collection) string {
+	switch coll {
+	case storesColl:
+		return "store"
+	case menuItemsColl:
+		return "menu item"
+	case ordersColl:
+		return "order"
+	default:
+		return "order item"
+	}
+}
+
+// checkRef fails unless oid is in coll and isn't soft-deleted.
+func checkRef(tx *txn, coll *mongo.Collection, oid objectid.ObjectID) error {
+	var d refDoc
+	err := tx.findOne(coll, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &d)
+	if err == errNoDocument {
+		return fmt.Errorf("%s %s not found", docNoun(coll), oid.Hex())
+	}
+	if err != nil {
+		return err
+	}
+	if d.DeletedAt != 0 {
+		return fmt.Errorf("%s %s is deleted", docNoun(coll), oid.Hex())
+	}
+	return nil
+}
+
+// checkOrderItem fails unless an order item can have this order and menu
+// item, either of which may be nil.
+func checkOrderItem(tx *txn, order, item objectid.ObjectID) error {
+	var o, m refDoc
+	if order != objectid.NilObjectID {
+		if err := checkRef(tx, ordersColl, order); err != nil {
+			return err
+		}
+		if err := tx.findOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", order)), &o); err != nil {
+			return err
+		}
+	}
+	if item != objectid.NilObjectID {
+		if err := checkRef(tx, menuItemsColl, item); err != nil {
+			return err
+		}
+		if err := tx.findOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", item)), &m); err != nil {
+			return err
+		}
+	}
+	if order != objectid.NilObjectID && item != objectid.NilObjectID && o.Store != m.Store {
+		return fmt.Errorf("menu item %s isn't on the menu of order %s's store", item.Hex(), order.Hex())
+	}
+	return nil
+}
+
+// deleteRefs applies the policies of what points at oid in coll, which is
+// being soft-deleted at at, or deleted for good if at is 0.
+func deleteRefs(tx *txn, coll *mongo.Collection, oid objectid.ObjectID, at int64) error {
+	for _, rel := range relations {
+		if rel.parent != coll {
+			continue
+		}
+		docs, err := tx.find(rel.child, bson.NewDocument(bson.EC.ObjectID(rel.field, oid)))
+		if err != nil {
+			return err
+		}
+		children := make([]refDoc, len(docs))
+		for i, rdr := range docs {
+			if err := bson.Unmarshal(rdr, &children[i]); err != nil {
+				return err
+			}
+		}
+
+		if rel.Policy == policyRestrict {
+			held := 0
+			for i := range children {
+				live := at == 0
+				if !live {
+					live, err = rel.live(tx, &children[i])
+					if err != nil {
+						return err
+					}
+				}
+				if live {
+					held++
+				}
+			}
+			if held > 0 {
+				return &restrictError{fmt.Sprintf("%s %s still has %d %s pointing at it and %s is restrict",
+					docNoun(coll), oid.Hex(), held, rel.child.Name(), rel.Name)}
+			}
+			continue
+		}
+
+		for i := range children {
+			child := &children[i]
+			if rel.Policy == policySoftCascade && at != 0 {
+				if child.DeletedAt != 0 {
+					continue
+				}
+				err = softDeleteRef(tx, rel, child, at)
+			} else {
+				err = hardDeleteRef(tx, rel, child)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// softDeleteRef soft-deletes child, which points along rel, at at.
+func softDeleteRef(tx *txn, rel *relation, child *refDoc, at int64) error {
+	_, err := tx.updateOne(rel.child, bson.NewDocument(bson.EC.ObjectID("_id", child.ID)), deletedSetter(at))
+	if err != nil {
+		return err
+	}
+	if err := deleteRefs(tx, rel.child, child.ID, at); err != nil {
+		return err
+	}
+	if rel.child == menuItemsColl {
+		return menuChanged(tx, child.Store, child.ID, "deleted")
+	}
+	return nil
+}
+
+// hardDeleteRef deletes child, which points along rel, for good.
+func hardDeleteRef(tx *txn, rel *relation, child *refDoc) error {
+	if err := hardDelete(tx, rel.child, child.ID); err != nil {
+		return err
+	}
+	if rel.child == menuItemsColl && child.DeletedAt == 0 {
+		return menuChanged(tx, child.Store, child.ID, "deleted")
+	}
+	return nil
+}
+
+// hardDelete deletes oid in coll for good, after what points at it, and
+// any stock levels it had.
+func hardDelete(tx *txn, coll *mongo.Collection, oid objectid.ObjectID) error {
+	if err := deleteRefs(tx, coll, oid, 0); err != nil {
+		return err
+	}
+	if coll == storesColl || coll == menuItemsColl {
+		field := "store"
+		if coll == menuItemsColl {
+			field = "item"
+		}
+		levels, err := tx.find(stockColl, bson.NewDocument(bson.EC.ObjectID(field, oid)))
+		if err != nil {
+			return err
+		}
+		for _, rdr := range levels {
+			var level refDoc
+			if err := bson.Unmarshal(rdr, &level); err != nil {
+				return err
+			}
+			if _, err := tx.deleteOne(stockColl, bson.NewDocument(bson.EC.ObjectID("_id", level.ID))); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.deleteOne(coll, bson.NewDocument(bson.EC.ObjectID("_id", oid)))
+	return err
+}
+
+// integrityIssue is a broken reference the scan found.
+type integrityIssue struct {
+	Relation string `json:"relation"`
+	Policy   string `json:"policy"`
+	Doc      string `json:"doc"` // the one pointing
+	Ref      string `json:"ref"` // what it points at
+	Problem  string `json:"problem"`
+	Repair   string `json:"repair,omitempty"` // what repairing did
+	rel      *relation
+	child    refDoc
+}
+
+type integrityReport struct {
+	Relations []*relation      `json:"relations"`
+	Issues    []integrityIssue `json:"issues"`
+	Truncated bool             `json:"truncated"` // there were more than these
+}
+
+// loadRefs is every document in coll, by id.
+func loadRefs(ctx context.Context, coll *mongo.Collection) (map[objectid.ObjectID]refDoc, error) {
+	cur, err := coll.Find(ctx, bson.NewDocument(), findopt.Projection(bson.NewDocument(
+		bson.EC.Int32("store", 1),
+		bson.EC.Int32("order", 1),
+		bson.EC.Int32("item", 1),
+		bson.EC.Int32("state", 1),
+		bson.EC.Int32("deleted_at", 1),
+	)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	docs := make(map[objectid.ObjectID]refDoc)
+	for cur.Next(ctx) {
+		var d refDoc
+		if err := cur.Decode(&d); err != nil {
+			return nil, err
+		}
+		docs[d.ID] = d
+	}
+	return docs, cur.Err()
+}
+
+// scanIntegrity finds references to documents that aren't there, and order
+// items from another store's menu.
+func scanIntegrity(ctx context.Context) (*integrityReport, error) {
+	report := &integrityReport{Relations: relations, Issues: make([]integrityIssue, 0)}
+	docs := make(map[*mongo.Collection]map[objectid.ObjectID]refDoc)
+	for _, coll := range []*mongo.Collection{storesColl, menuItemsColl, ordersColl, orderItemsColl} {
+		loaded, err := loadRefs(ctx, coll)
+		if err != nil {
+			return nil, err
+		}
+		docs[coll] = loaded
+	}
+	add := func(rel *relation, child refDoc, ref objectid.ObjectID, problem string) {
+		if len(report.Issues) == integrityIssueLimit {
+			report.Truncated = true
+			return
+		}
+		report.Issues = append(report.Issues, integrityIssue{
+			Relation: rel.Name,
+			Policy:   rel.Policy,
+			Doc:      child.ID.Hex(),
+			Ref:      ref.Hex(),
+			Problem:  problem,
+			rel:      rel,
+			child:    child,
+		})
+	}
+	for _, rel := range relations {
+		for _, child := range docs[rel.child] {
+			ref := child.ref(rel.field)
+			if ref == objectid.NilObjectID {
+				continue
+			}
+			parent, ok := docs[rel.parent][ref]
+			if !ok {
+				add(rel, child, ref, fmt.Sprintf("%s %s doesn't exist", docNoun(rel.parent), ref.Hex()))
+				continue
+			}
+			if rel.parent == menuItemsColl {
+				order, ok := docs[ordersColl][child.Order]
+				if ok && order.Store != parent.Store {
+					add(rel, child, ref, fmt.Sprintf("menu item %s is from another store than order %s", ref.Hex(), child.Order.Hex()))
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// repairIssue fixes a broken reference the way its policy would have.
+func repairIssue(ctx context.Context, issue *integrityIssue) {
+	rel := issue.rel
+	if rel.Policy == policyRestrict {
+		issue.Repair = "left alone, " + rel.Name + " is restrict"
+		return
+	}
+	err := runTxn(ctx, func(tx *txn) error {
+		if rel.Policy == policySoftCascade {
+			if issue.child.DeletedAt != 0 {
+				return nil
+			}
+			return softDeleteRef(tx, rel, &issue.child, time.Now().Unix())
+		}
+		return hardDeleteRef(tx, rel, &issue.child)
+	})
+	switch {
+	case err != nil:
+		issue.Repair = "failed: " + err.Error()
+	case rel.Policy == policySoftCascade:
+		issue.Repair = "soft-deleted " + docNoun(rel.child)
+	default:
+		issue.Repair = "deleted " + docNoun(rel.child)
+	}
+	log.Printf("integrity repair, %s %s: %s", rel.Name, issue.Doc, issue.Repair)
+}
+
+// handleIntegrity is GET /api/v1/integrity to scan and POST to scan and
+// repair, admin only.
+func handleIntegrity(res http.ResponseWriter, req *http.Request) {
+	if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	report, err := scanIntegrity(req.Context())
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	if req.Method == "POST" {
+		for i := range report.Issues {
+			repairIssue(req.Context(), &report.Issues[i])
+		}
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(report)
+}
+
+func setupIntegrity() error {
+	undeleted := func(tx *txn, d *refDoc) (bool, error) {
+		return d.DeletedAt == 0, nil
+	}
+	unfinished := func(tx *txn, d *refDoc) (bool, error) {
+		switch d.State {
+		case orderDone, orderRefunded, orderCancelled:
+			return false, nil
+		}
+		return true, nil
+	}
+	onOpenOrder := func(tx *txn, d *refDoc) (bool, error) {
+		var order refDoc
+		err := tx.findOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", d.Order)), &order)
+		if err == errNoDocument {
+			return false, nil
+		}
+		return order.State == orderOpen, err
+	}
+	relations = []*relation{
+		{Name: "menu_items.store", Policy: policySoftCascade, child: menuItemsColl, field: "store", parent: storesColl, soft: true, live: undeleted},
+		{Name: "orders.store", Policy: policyRestrict, child: ordersColl, field: "store", parent: storesColl, live: unfinished},
+		{Name: "order_items.order", Policy: policyCascade, child: orderItemsColl, field: "order", parent: ordersColl, live: onOpenOrder},
+		{Name: "order_items.item", Policy: policyRestrict, child: orderItemsColl, field: "item", parent: menuItemsColl, live: onOpenOrder},
+	}
+
+	for _, setting := range strings.Split(getEnv("INTEGRITY_POLICIES", ""), ",") {
+		if setting == "" {
+			continue
+		}
+		parts := strings.SplitN(setting, "=", 2)
+		var rel *relation
+		for _, r := range relations {
+			if r.Name == parts[0] {
+				rel = r
+			}
+		}
+		if rel == nil || len(parts) != 2 {
+			return fmt.Errorf("unknown INTEGRITY_POLICIES entry %q", setting)
+		}
+		switch parts[1] {
+		case policyRestrict, policyCascade:
+		case policySoftCascade:
+			if !rel.soft {
+				return fmt.Errorf("INTEGRITY_POLICIES: %s can't soft-cascade, only menu_items.store can", rel.Name)
+			}
+		default:
+			return fmt.Errorf("unknown INTEGRITY_POLICIES policy %q, use restrict, cascade or soft-cascade", parts[1])
+		}
+		rel.Policy = parts[1]
+	}
+
+	http.HandleFunc("/api/v1/integrity", handleIntegrity)
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/bson/objectid"
@@ -16,18 +17,103 @@ import (
 )
 
 type menuItem struct {
-	ID    objectid.ObjectID `bson:"_id"`
-	Key   string            `json:"key"`
-	Type  string            `json:"type"`
-	Store string            `json:"store"`
-	Name  string            `json:"name"`
-	Slug  string            `json:"slug"`
-	Descr string            `json:"descr"`
-	Price string            `json:"price"`
+	ID      objectid.ObjectID  `bson:"_id" json:"-"`
+	Key     string             `bson:"-" json:"key"`
+	Type    string             `json:"type" schema:"required,enum=base|filling|topping"`
+	Store   string             `bson:"-" json:"store"`
+	StoreID *objectid.ObjectID `bson:"store,omitempty" json:"-"` // nil if it's on no store's menu
+	Name    string             `json:"name"`
+	Slug    string             `json:"slug" schema:"required"`
+	Descr   string             `json:"descr"`
+	Price   string             `json:"price" schema:"price"`
+	Avail   []availWindow      `json:"avail"` // when it can be ordered, always if empty
+
+	Allergens []string   `json:"allergens"`
+	Diet      []string   `json:"diet"` // vegetarian, vegan, gluten-free
+	Nutrition *nutrition `json:"nutrition,omitempty"`
+
+	TaxCategory string `bson:"tax_category" json:"tax_category"` // prepared if empty
+
+	Images map[string]string `bson:"images,omitempty" json:"images,omitempty"` // blob keys by size, URLs in responses
+
+	DeletedAt int64 `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"` // unix, 0 unless soft-deleted
+
+	// filled in from the store's stock when listing
+	Available bool `bson:"-" json:"available"`
+	Stock     *int `bson:"-" json:"stock,omitempty"`
 }
 
 var menuItemsColl *mongo.Collection
 
+// fill sets the fields the API shows in place of stored ones.
+func (item *menuItem) fill() {
+	item.Key = item.ID.Hex()
+	if item.StoreID != nil {
+		item.Store = item.StoreID.Hex()
+	}
+}
+
+func (item *menuItem) storeOID() objectid.ObjectID {
+	if item.StoreID == nil {
+		return objectid.NilObjectID
+	}
+	return *item.StoreID
+}
+
+// slugScope is where item's slug has to be unique.
+func (item *menuItem) slugScope() *bson.Document {
+	if item.StoreID == nil {
+		return bson.NewDocument(bson.EC.Null("store"))
+	}
+	return bson.NewDocument(bson.EC.ObjectID("store", *item.StoreID))
+}
+
+// validate checks an item that's about to be written, lower-casing its
+// tags and days and writing its price out in full on the way.
+func (item *menuItem) validate() error {
+	switch item.Type {
+	case "base", "filling", "topping":
+	case "":
+		return fmt.Errorf("Type is required")
+	default:
+		return fmt.Errorf("Type must be one of base, filling, topping")
+	}
+	if item.Price == "" {
+		return fmt.Errorf("Price is required")
+	}
+	price, err := parseCents(item.Price)
+	if err != nil {
+		return fmt.Errorf("Price %q: %s", item.Price, err)
+	}
+	if price < 0 {
+		return fmt.Errorf("Price can't be negative")
+	}
+	item.Price = formatCents(price)
+	if err := validateAvail(item.Avail); err != nil {
+		return err
+	}
+	for i := range item.Avail {
+		for j, day := range item.Avail[i].Days {
+			item.Avail[i].Days[j] = strings.ToLower(day)
+		}
+	}
+	if item.Allergens, err = cleanTags(item.Allergens, allergens, "allergen"); err != nil {
+		return err
+	}
+	if item.Diet, err = cleanTags(item.Diet, dietTags, "diet"); err != nil {
+		return err
+	}
+	if item.Nutrition != nil {
+		if err := item.Nutrition.validate(); err != nil {
+			return err
+		}
+	}
+	if item.TaxCategory != "" && !taxCategories[item.TaxCategory] {
+		return fmt.Errorf("Unknown tax category %s", item.TaxCategory)
+	}
+	return nil
+}
+
 func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 	httpError := func(msg string) {
 		// todo: restrict this to debug only
@@ -39,8 +125,22 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, msg, 500)
 	}
 
+	if strings.HasSuffix(req.URL.Path, "/image") {
+		itemID := strings.TrimPrefix(req.URL.Path, "/api/v1/menu/")
+		handleMenuImage(res, req, strings.TrimSuffix(itemID, "/image"))
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/restore") {
+		itemID := strings.TrimPrefix(req.URL.Path, "/api/v1/menu/")
+		handleRestore(res, req, menuItemsColl, strings.TrimSuffix(itemID, "/restore"))
+		return
+	}
+
 	switch req.Method {
-	case "GET": // list items for store, id in path
+	case "GET": // list items for store, id in path; ?available=true hides sold out items
+		// only items orderable now are listed, ?at=<RFC 3339 time> previews
+		// another time and ?all=true lists everything; ?include_deleted=true
+		// adds deleted items
 		itemID := strings.TrimPrefix(req.URL.Path, "/api/v1/menu/")
 		log.Printf("get param: %s", itemID)
 		oid, err := objectid.FromHex(itemID)
@@ -48,7 +148,43 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 			httpError(err.Error())
 			return
 		}
-		filter := bson.NewDocument(bson.EC.ObjectID("store", oid))
+		loc, err := storeLocation(context.Background(), oid)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		at := time.Now()
+		if param := req.URL.Query().Get("at"); param != "" {
+			at, err = time.Parse(time.RFC3339, param)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		scheduled := req.URL.Query().Get("all") != "true"
+		// ?exclude_allergens=nuts,dairy and ?diet=vegan,gluten-free
+		var exclude, diet []string
+		if param := req.URL.Query().Get("exclude_allergens"); param != "" {
+			exclude, err = cleanTags(strings.Split(param, ","), allergens, "allergen")
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		if param := req.URL.Query().Get("diet"); param != "" {
+			diet, err = cleanTags(strings.Split(param, ","), dietTags, "diet")
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		levels, err := loadStock(context.Background(), oid)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		onlyAvailable := req.URL.Query().Get("available") == "true"
+		filter := liveFilter(req, bson.NewDocument(bson.EC.ObjectID("store", oid)))
 		cur, err := menuItemsColl.Find(context.Background(), filter)
 		if err != nil {
 			httpError(err.Error())
@@ -63,7 +199,25 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 				httpError(err.Error())
 				return
 			}
-			item.Key = item.ID.Hex()
+			item.fill()
+			item.Images = imageURLs(item.Images)
+			item.Available = true
+			if level, ok := levels[item.ID]; ok {
+				item.Available = level.inStock()
+				if level.Tracked {
+					qty := level.Qty
+					item.Stock = &qty
+				}
+			}
+			if onlyAvailable && !item.Available {
+				continue
+			}
+			if scheduled && !orderableAt(item.Avail, at.In(loc)) {
+				continue
+			}
+			if !matchesDiet(&item, exclude, diet) {
+				continue
+			}
 			fmt.Printf("item: %+v\n", item)
 			fmt.Printf("name = %+v\n", item.Name)
 			list = append(list, item)
@@ -72,7 +226,6 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 		json.NewEncoder(res).Encode(list)
 
 	case "PUT": // add item
-		// todo: make sure everything is specified and valid
 		decoder := json.NewDecoder(req.Body)
 		defer req.Body.Close()
 		var item menuItem
@@ -82,60 +235,63 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		fmt.Printf("item: %+v\n", item)
-		inserts := make([]*bson.Element, 0)
-		if item.Type != "" {
-			inserts = append(inserts, bson.EC.String("type", item.Type))
-			switch item.Type {
-			case "base", "filling", "topping":
-				break
-			default:
-				httpError("Type must be one of base, filling, topping")
-				return
-			}
-		} else {
-			httpError("Type is required")
+		if err := item.validate(); err != nil {
+			httpError(err.Error())
 			return
 		}
+		item.StoreID = nil
 		if item.Store != "" {
 			oid, err := objectid.FromHex(item.Store)
 			if err != nil {
 				httpError(err.Error())
 				return
 			}
-			inserts = append(inserts, bson.EC.ObjectID("store", oid))
-		}
-		if item.Name != "" {
-			inserts = append(inserts, bson.EC.String("name", item.Name))
+			item.StoreID = &oid
 		}
+		// unique within the store, from the name unless the client picked one
+		slugBase := item.Name
 		if item.Slug != "" {
-			inserts = append(inserts, bson.EC.String("slug", item.Slug))
+			slugBase = item.Slug
 		}
-		if item.Descr != "" {
-			inserts = append(inserts, bson.EC.String("descr", item.Descr))
-		}
-		if item.Price != "" {
-			inserts = append(inserts, bson.EC.String("price", item.Price))
+		item.ID = objectid.New()
+		item.Slug, err = uniqueSlug(context.Background(), menuItemsColl, item.slugScope(), slugBase, item.ID)
+		if err != nil {
+			httpError(err.Error())
+			return
 		}
-		fmt.Printf("inserts: %+v\n", inserts)
-		inserter := bson.NewDocument()
-		for _, update := range inserts {
-			inserter.Append(update)
+		// images are added with PUT .../image
+		item.Images = nil
+		item.DeletedAt = 0
+		inserter, err := bson.NewDocumentEncoder().EncodeDocument(&item)
+		if err != nil {
+			httpError(err.Error())
+			return
 		}
 		fmt.Printf("inserter: %+v\n", inserter)
-		result, err := menuItemsColl.InsertOne(context.Background(), inserter, nil)
+		err = runTxn(context.Background(), func(tx *txn) error {
+			store := item.storeOID()
+			if store != objectid.NilObjectID {
+				if err := checkRef(tx, storesColl, store); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.insertOne(menuItemsColl, inserter); err != nil {
+				return err
+			}
+			if err := menuChanged(tx, store, item.ID, "added"); err != nil {
+				return err
+			}
+			return recordAudit(tx, req, menuItemsColl, item.ID, auditCreate, nil)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
-		fmt.Printf("result: %+v\n", result)
+		fmt.Printf("item: %s\n", item.ID.Hex())
 		res.Header().Set("Content-Type", "application/json")
-		if oid, ok := result.InsertedID.(objectid.ObjectID); ok {
-			json.NewEncoder(res).Encode(insert{oid.Hex()})
-		} else {
-			json.NewEncoder(res).Encode(result)
-		}
+		json.NewEncoder(res).Encode(insert{item.ID.Hex()})
 
-	case "PATCH": // edit item, id in path
+	case "PATCH": // edit item, id in path, with a JSON merge patch (see patch.go)
 		itemID := strings.TrimPrefix(req.URL.Path, "/api/v1/menu/")
 		log.Printf("patch param: %s", itemID)
 		oid, err := objectid.FromHex(itemID)
@@ -143,47 +299,73 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 			httpError(err.Error())
 			return
 		}
-		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid))
-		decoder := json.NewDecoder(req.Body)
-		defer req.Body.Close()
-		var item menuItem
-		err = decoder.Decode(&item)
+		patch, err := readPatch(req)
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid), notDeleted())
 		fmt.Printf("updater: %+v\n", updater)
-		updates := make([]*bson.Element, 0)
-		if item.Type != "" {
-			httpError("Item type may not be changed")
-		}
-		if item.Store != "" {
-			httpError("Item store may not be changed")
-		}
-		if item.Name != "" {
-			updates = append(updates, bson.EC.String("name", item.Name))
-		}
-		if item.Slug != "" {
-			updates = append(updates, bson.EC.String("slug", item.Slug))
-		}
-		if item.Descr != "" {
-			updates = append(updates, bson.EC.String("descr", item.Descr))
-		}
-		if item.Price != "" {
-			updates = append(updates, bson.EC.String("price", item.Price))
-		}
-		fmt.Printf("updates: %+v\n", updates)
-		subdoc := bson.NewDocument()
-		for _, update := range updates {
-			subdoc.Append(update)
-		}
-		setter := bson.NewDocument(bson.EC.SubDocument("$set", subdoc))
-		fmt.Printf("setter: %+v\n", setter)
-		result, err := menuItemsColl.UpdateOne(context.Background(), updater, setter, nil)
+		var matched int64
+		err = runTxn(context.Background(), func(tx *txn) error {
+			before, err := auditBefore(tx, menuItemsColl, oid)
+			if err != nil {
+				return err
+			}
+			var current menuItem
+			err = tx.findOne(menuItemsColl, updater, &current)
+			if err == errNoDocument {
+				matched = 0
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			current.fill()
+			var item menuItem
+			if err := applyPatch(patch, &current, &item); err != nil {
+				return err
+			}
+			// images are changed with PUT .../image
+			item.ID, item.StoreID, item.Images, item.DeletedAt = current.ID, current.StoreID, current.Images, current.DeletedAt
+			if item.Type != current.Type {
+				return fmt.Errorf("Item type may not be changed")
+			}
+			if item.Store != current.Store {
+				return fmt.Errorf("Item store may not be changed")
+			}
+			if err := item.validate(); err != nil {
+				return err
+			}
+			// renaming keeps the slug, it only changes when asked
+			if item.Slug != current.Slug {
+				item.Slug, err = uniqueSlug(tx.ctx, menuItemsColl, item.slugScope(), item.Slug, oid)
+				if err != nil {
+					return err
+				}
+			}
+			setter, err := updateFor(&item)
+			if err != nil {
+				return err
+			}
+			if item.Slug != current.Slug && current.Slug != "" {
+				setter.Append(slugHistory(current.Slug))
+			}
+			fmt.Printf("setter: %+v\n", setter)
+			matched, err = tx.updateOne(menuItemsColl, updater, setter)
+			if err != nil || matched == 0 {
+				return err
+			}
+			if err := menuChanged(tx, item.storeOID(), oid, "updated"); err != nil {
+				return err
+			}
+			return recordAudit(tx, req, menuItemsColl, oid, auditUpdate, before)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		result := &mongo.UpdateResult{MatchedCount: matched, ModifiedCount: matched}
 		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(res).Encode(result)
@@ -196,12 +378,23 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 			httpError(err.Error())
 			return
 		}
-		deleter := bson.NewDocument(bson.EC.ObjectID("_id", oid))
-		result, err := menuItemsColl.DeleteOne(context.Background(), deleter, nil)
+		var deleted int64
+		err = runTxn(context.Background(), func(tx *txn) error {
+			before, err := auditBefore(tx, menuItemsColl, oid)
+			if err != nil {
+				return err
+			}
+			deleted, err = softDeleteItem(tx, oid)
+			if err != nil || deleted == 0 {
+				return err
+			}
+			return recordAudit(tx, req, menuItemsColl, oid, auditDelete, before)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		result := &mongo.DeleteResult{DeletedCount: deleted}
 		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(res).Encode(result)
@@ -229,6 +422,28 @@ func handleMenuItems(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// itemStore is the store a menu item is on, nil if it's on none.
+func itemStore(tx *txn, oid objectid.ObjectID) (objectid.ObjectID, error) {
+	var item struct {
+		Store objectid.ObjectID `bson:"store"`
+	}
+	err := tx.findOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &item)
+	return item.Store, err
+}
+
+// menuChanged records in tx that an item on store's menu was added,
+// updated, deleted or restored. Items on no store's menu don't make events.
+func menuChanged(tx *txn, store, item objectid.ObjectID, change string) error {
+	if store == objectid.NilObjectID {
+		return nil
+	}
+	return addOutbox(tx, webhookMenuChanged, store, item, struct {
+		Store  string `json:"store"`
+		Item   string `json:"item"`
+		Change string `json:"change"`
+	}{store.Hex(), item.Hex(), change})
+}
+
 func setupMenuItems() {
 	menuItemsColl = database.Collection("menu_items")
 
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// A lease is a document in locks that one replica owns until it runs out,
+// for work only one of them should do at a time. The owner renews it well
+// before then.
+
+var locksColl *mongo.Collection
+
+// leaseOwner names this process as a lease owner.
+func leaseOwner() string {
+	host, _ := os.Hostname()
+	nonce := make([]byte, 4)
+	rand.Read(nonce)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(nonce))
+}
+
+// holdLease takes or renews the lease key for ttl, false if another
+// replica has it.
+func holdLease(ctx context.Context, key, owner string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := locksColl.UpdateOne(ctx,
+		bson.NewDocument(
+			bson.EC.String("_id", key),
+			bson.EC.ArrayFromElements("$or",
+				bson.VC.DocumentFromElements(bson.EC.String("owner", owner)),
+				bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("until", bson.EC.Int64("$lt", now.UnixNano()))),
+			),
+		),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+			bson.EC.String("owner", owner),
+			bson.EC.Int64("until", now.Add(ttl).UnixNano()),
+		)),
+		updateopt.Upsert(true))
+	if isDuplicateKey(err) {
+		// the lease is someone else's and hasn't run out
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// releaseLease gives the lease key up early, if owner still has it.
+func releaseLease(ctx context.Context, key, owner string) error {
+	_, err := locksColl.DeleteOne(ctx, bson.NewDocument(
+		bson.EC.String("_id", key),
+		bson.EC.String("owner", owner),
+	))
+	return err
+}
@@ -21,6 +21,9 @@ type insert struct {
 var client *mongo.Client
 var database *mongo.Database
 
+// stats is shared so anything can report metrics
+var stats statsd.Statter
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -28,44 +31,106 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
+// connectMongo sets up client and database
+func connectMongo() {
+	timeout := time.Second * 2
+	opt1 := clientopt.ConnectTimeout(timeout)
+	opt2 := clientopt.ServerSelectionTimeout(timeout)
+	opt3 := clientopt.SocketTimeout(timeout)
+
+	mongoUrl := fmt.Sprintf("mongodb://%s:27017", getEnv("MONGO_HOST", "localhost"))
+	fmt.Printf("Connecting to Mongo at %s\n", mongoUrl)
+	var err error
+	client, err = mongo.Connect(context.Background(), mongoUrl, opt1, opt2, opt3)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	database = client.Database("tacos")
+	locksColl = database.Collection("locks")
+	detectTxnSupport()
+	setupMigrations()
+}
+
 func main() {
+	// tacos-api migrate|indexes|schema|staff ..., see migrate.go,
+	// indexes.go, schema.go and staff.go
+	commands := map[string]func(context.Context, []string) error{
+		"migrate": runMigrate,
+		"indexes": runIndexes,
+		"schema":  runSchema,
+		"staff":   runStaff,
+	}
+	if len(os.Args) > 1 && commands[os.Args[1]] != nil {
+		connectMongo()
+		if err := commands[os.Args[1]](context.Background(), os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	var err error
 
 	// create a statsd client
 	// The basic client sends one stat per packet (for compatibility).
-	statsdClient, err := statsd.NewClient("127.0.0.1:8125", "test-client")
+	stats, err = statsd.NewClient("127.0.0.1:8125", "test-client")
 	// handle any errors
 	if err != nil {
 		log.Fatal(err)
 	}
 	// make sure to clean up
-	defer statsdClient.Close()
+	defer stats.Close()
 
 	port := ":32001"
 
-	timeout := time.Second * 2
-	opt1 := clientopt.ConnectTimeout(timeout)
-	opt2 := clientopt.ServerSelectionTimeout(timeout)
-	opt3 := clientopt.SocketTimeout(timeout)
-
-	mongoUrl := fmt.Sprintf("mongodb://%s:27017", getEnv("MONGO_HOST", "localhost"))
-	fmt.Printf("Connecting to Mongo at %s\n", mongoUrl)
-	client, err = mongo.Connect(context.Background(), mongoUrl, opt1, opt2, opt3)
-	if err != nil {
+	connectMongo()
+	if getEnv("MIGRATE_ON_START", "true") == "true" {
+		if err := migrateUp(context.Background(), 0); err != nil {
+			log.Fatal(err)
+		}
+	}
+	setupIndexes()
+	if err := setupSchemas(); err != nil {
 		log.Fatal(err)
 	}
 
-	database = client.Database("tacos")
-
 	// send a stat every second
-	go forever(statsdClient)
+	go forever(stats)
 
 	setupStores()
 	setupMenuItems()
 	setupOrderItems()
+	setupStock()
+	if err := setupImages(); err != nil {
+		log.Fatal(err)
+	}
+	setupSlugs()
+	setupSearch()
+	setupPromos()
+	setupTax()
+	setupStaff()
+	if err := setupPayments(); err != nil {
+		log.Fatal(err)
+	}
+	setupReports()
+	setupQueue()
+	setupEvents()
+	setupDashboard()
+	setupWebhooks()
+	if err := setupOutbox(); err != nil {
+		log.Fatal(err)
+	}
+	setupAudit()
+	setupIdempotency()
+	if err := setupIntegrity(); err != nil {
+		log.Fatal(err)
+	}
+	if err := setupSoftDelete(); err != nil {
+		log.Fatal(err)
+	}
 
 	fmt.Printf("Listening (%s)...\n", port)
-	http.ListenAndServe(port, nil)
+	http.ListenAndServe(port, withRequestID(withIdempotency(http.DefaultServeMux)))
 }
 
 // Send a stat
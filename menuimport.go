@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// A store's whole menu goes in and out as CSV or JSON, for editing in a
+// spreadsheet. GET /api/v1/stores/{id}/menu/export?format=csv|json
+// (json by default) lists the items that aren't deleted, by slug. POST
+// /api/v1/stores/{id}/menu/import takes the same back, CSV if it's sent as
+// text/csv or with ?format=csv; ?dry_run=true checks it and says what it
+// would do without doing it. Both need a manager of the store.
+//
+// Rows are matched to items by slug, made from the name if a row has none,
+// and an item's old slug finds it too. A matched item gets the row's
+// values, a deleted one is restored, and anything else is added. Columns or
+// fields a file leaves out are left alone, empty ones are emptied, and
+// items the file doesn't mention stay as they are. Every row is checked
+// first and if any is wrong nothing is written and the reply, a 422, says
+// what's wrong with each.
+//
+// In CSV allergens and diet are lists like "dairy,eggs", nutrition is the
+// calories, protein, carbs and fat columns, and avail is windows separated
+// by ";", each some days, a time range and a date range, any of them left
+// out: "mon tue wed thu fri 11:00-14:00; sat sun 10:00- 2018-12-01..".
+
+const (
+	menuImportMaxRows  = 5000
+	menuImportMaxBytes = 5 << 20
+)
+
+// menuRow is a menu item as it's imported and exported.
+type menuRow struct {
+	Slug        string        `json:"slug"`
+	Name        string        `json:"name"`
+	Type        string        `json:"type"`
+	Descr       string        `json:"descr"`
+	Price       string        `json:"price"`
+	TaxCategory string        `json:"tax_category"`
+	Allergens   []string      `json:"allergens"`
+	Diet        []string      `json:"diet"`
+	Avail       []availWindow `json:"avail"`
+	Nutrition   *nutrition    `json:"nutrition"`
+}
+
+var menuColumns = []string{"slug", "name", "type", "descr", "price", "tax_category",
+	"allergens", "diet", "avail", "calories", "protein", "carbs", "fat"}
+
+var menuFields = map[string]bool{"slug": true, "name": true, "type": true, "descr": true, "price": true,
+	"tax_category": true, "allergens": true, "diet": true, "avail": true, "nutrition": true}
+
+// importRow is one row of an import and what became of it.
+type importRow struct {
+	Row    int      `json:"row"` // from 1, the header is CSV's row 1
+	Slug   string   `json:"slug"`
+	Action string   `json:"action,omitempty"` // create, update, restore or unchanged
+	Item   string   `json:"item,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+
+	menu menuRow
+	has  map[string]bool // the fields the row sets
+	oid  objectid.ObjectID
+}
+
+func (r *importRow) fail(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+type importReport struct {
+	DryRun    bool        `json:"dry_run"`
+	Created   int         `json:"created"`
+	Updated   int         `json:"updated"`
+	Restored  int         `json:"restored"`
+	Unchanged int         `json:"unchanged"`
+	Errors    int         `json:"errors"` // rows with errors
+	Rows      []importRow `json:"rows"`
+}
+
+func toMenuRow(item *menuItem) menuRow {
+	return menuRow{
+		Slug:        item.Slug,
+		Name:        item.Name,
+		Type:        item.Type,
+		Descr:       item.Descr,
+		Price:       item.Price,
+		TaxCategory: item.TaxCategory,
+		Allergens:   item.Allergens,
+		Diet:        item.Diet,
+		Avail:       item.Avail,
+		Nutrition:   item.Nutrition,
+	}
+}
+
+// formatAvail is windows as a CSV cell, see the top of the file.
+func formatAvail(windows []availWindow) string {
+	cells := make([]string, 0, len(windows))
+	for _, w := range windows {
+		parts := make([]string, 0, len(w.Days)+2)
+		for _, day := range w.Days {
+			parts = append(parts, strings.ToLower(day))
+		}
+		if w.From != "" || w.Until != "" {
+			parts = append(parts, w.From+"-"+w.Until)
+		}
+		if w.Start != "" || w.End != "" {
+			parts = append(parts, w.Start+".."+w.End)
+		}
+		cells = append(cells, strings.Join(parts, " "))
+	}
+	return strings.Join(cells, "; ")
+}
+
+// parseAvail reads formatAvail's cells.
+func parseAvail(cell string) ([]availWindow, error) {
+	windows := make([]availWindow, 0)
+	for _, part := range strings.Split(cell, ";") {
+		fields := strings.Fields(part)
+		if len(fields) == 0 {
+			continue
+		}
+		var w availWindow
+		for _, field := range fields {
+			field = strings.ToLower(field)
+			if _, ok := weekdays[field]; ok {
+				w.Days = append(w.Days, field)
+				continue
+			}
+			if dates := strings.SplitN(field, "..", 2); len(dates) == 2 {
+				w.Start, w.End = dates[0], dates[1]
+				continue
+			}
+			if clocks := strings.SplitN(field, "-", 2); len(clocks) == 2 && strings.Contains(field, ":") {
+				w.From, w.Until = clocks[0], clocks[1]
+				continue
+			}
+			return nil, fmt.Errorf("avail: don't know what %q is, expected days, 11:00-14:00 or 2018-12-01..2019-01-06", field)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+// splitList reads "dairy, eggs"
+func splitList(cell string) []string {
+	list := make([]string, 0)
+	for _, tag := range strings.Split(cell, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			list = append(list, tag)
+		}
+	}
+	return list
+}
+
+func readMenuCSV(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("the file is empty, it needs a header row")
+	}
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, col := range menuColumns {
+		known[col] = true
+	}
+	cols := make(map[string]int)
+	for i, col := range header {
+		col = strings.ToLower(strings.TrimSpace(col))
+		if !known[col] {
+			return nil, fmt.Errorf("unknown column %q, expected some of %s", col, strings.Join(menuColumns, ", "))
+		}
+		if _, dup := cols[col]; dup {
+			return nil, fmt.Errorf("column %q is there twice", col)
+		}
+		cols[col] = i
+	}
+
+	rows := make([]importRow, 0)
+	for n := 2; ; n++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == menuImportMaxRows {
+			return nil, fmt.Errorf("more than %d rows", menuImportMaxRows)
+		}
+		row := importRow{Row: n, has: make(map[string]bool)}
+		cell := func(col string) (string, bool) {
+			i, ok := cols[col]
+			if !ok {
+				return "", false
+			}
+			row.has[col] = true
+			return strings.TrimSpace(record[i]), true
+		}
+		m := &row.menu
+		m.Slug, _ = cell("slug")
+		m.Name, _ = cell("name")
+		m.Type, _ = cell("type")
+		m.Descr, _ = cell("descr")
+		m.Price, _ = cell("price")
+		m.TaxCategory, _ = cell("tax_category")
+		if v, ok := cell("allergens"); ok {
+			m.Allergens = splitList(v)
+		}
+		if v, ok := cell("diet"); ok {
+			m.Diet = splitList(v)
+		}
+		if v, ok := cell("avail"); ok {
+			if m.Avail, err = parseAvail(v); err != nil {
+				row.fail("%s", err)
+			}
+		}
+		var facts nutrition
+		given := false
+		for _, col := range []string{"calories", "protein", "carbs", "fat"} {
+			v, ok := cell(col)
+			if !ok {
+				continue
+			}
+			row.has["nutrition"] = true
+			delete(row.has, col)
+			if v == "" {
+				continue
+			}
+			given = true
+			if col == "calories" {
+				facts.Calories, err = strconv.Atoi(v)
+			} else {
+				var f float64
+				f, err = strconv.ParseFloat(v, 64)
+				switch col {
+				case "protein":
+					facts.Protein = f
+				case "carbs":
+					facts.Carbs = f
+				default:
+					facts.Fat = f
+				}
+			}
+			if err != nil {
+				row.fail("%s %q isn't a number", col, v)
+			}
+		}
+		if given {
+			m.Nutrition = &facts
+		}
+		rows = append(rows, row)
+	}
+}
+
+func readMenuJSON(r io.Reader) ([]importRow, error) {
+	var raws []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raws); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of menu items: %s", err)
+	}
+	if len(raws) > menuImportMaxRows {
+		return nil, fmt.Errorf("more than %d rows", menuImportMaxRows)
+	}
+	rows := make([]importRow, 0, len(raws))
+	for i, raw := range raws {
+		row := importRow{Row: i + 1, has: make(map[string]bool)}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			row.fail("%s", err)
+		}
+		for field := range fields {
+			if !menuFields[field] {
+				row.fail("unknown field %q", field)
+			}
+			row.has[field] = true
+		}
+		if len(row.Errors) == 0 {
+			if err := json.Unmarshal(raw, &row.menu); err != nil {
+				row.fail("%s", err)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// check cleans up and validates what the row sets.
+func (r *importRow) check() {
+	m := &r.menu
+	m.Slug = strings.TrimSpace(m.Slug)
+	m.Name = strings.TrimSpace(m.Name)
+	m.Type = strings.TrimSpace(m.Type)
+	m.Price = strings.TrimSpace(m.Price)
+	m.TaxCategory = strings.TrimSpace(m.TaxCategory)
+	if m.Slug == "" {
+		m.Slug = slugify(m.Name)
+	} else if slug := slugify(m.Slug); slug != m.Slug {
+		r.fail("slug %q should be %q", m.Slug, slug)
+	}
+	r.Slug = m.Slug
+	switch {
+	case m.Slug == "":
+		r.fail("needs a slug or a name")
+	case reservedItemSlugs[m.Slug]:
+		r.fail("slug %q is taken by /menu/%s", m.Slug, m.Slug)
+	}
+	if r.has["name"] && m.Name == "" {
+		r.fail("name can't be empty")
+	}
+	switch m.Type {
+	case "", "base", "filling", "topping":
+	default:
+		r.fail("type must be one of base, filling, topping")
+	}
+	if m.Price != "" {
+		if _, err := parseCents(m.Price); err != nil {
+			r.fail("price %q: %s", m.Price, err)
+		}
+	}
+	if m.TaxCategory != "" && !taxCategories[m.TaxCategory] {
+		r.fail("unknown tax category %s", m.TaxCategory)
+	}
+	var err error
+	if m.Allergens, err = cleanTags(m.Allergens, allergens, "allergen"); err != nil {
+		r.fail("%s", err)
+	}
+	if m.Diet, err = cleanTags(m.Diet, dietTags, "diet"); err != nil {
+		r.fail("%s", err)
+	}
+	if err := validateAvail(m.Avail); err != nil {
+		r.fail("%s", err)
+	}
+	if m.Nutrition != nil {
+		if err := m.Nutrition.validate(); err != nil {
+			r.fail("%s", err)
+		}
+	}
+}
+
+// menuValue is a field of m as text, to tell whether an import changes it.
+func menuValue(m *menuRow, field string) string {
+	switch field {
+	case "name":
+		return m.Name
+	case "type":
+		return m.Type
+	case "descr":
+		return m.Descr
+	case "price":
+		return m.Price
+	case "tax_category":
+		return m.TaxCategory
+	case "allergens":
+		return strings.Join(m.Allergens, ",")
+	case "diet":
+		return strings.Join(m.Diet, ",")
+	case "avail":
+		return formatAvail(m.Avail)
+	case "nutrition":
+		if m.Nutrition == nil {
+			return ""
+		}
+		return fmt.Sprintf("%+v", *m.Nutrition)
+	}
+	return ""
+}
+
+// menuElements are what the row sets and what it empties, besides its
+// slug and type.
+func (r *importRow) menuElements() (set []*bson.Element, unset []string) {
+	m := &r.menu
+	for _, field := range []string{"name", "descr", "price", "tax_category"} {
+		if !r.has[field] {
+			continue
+		}
+		value := menuValue(m, field)
+		if value == "" && field != "descr" {
+			unset = append(unset, field)
+		} else {
+			set = append(set, bson.EC.String(field, value))
+		}
+	}
+	if r.has["allergens"] {
+		set = append(set, tagsElement("allergens", m.Allergens))
+	}
+	if r.has["diet"] {
+		set = append(set, tagsElement("diet", m.Diet))
+	}
+	if r.has["avail"] {
+		set = append(set, availElement(m.Avail))
+	}
+	if r.has["nutrition"] {
+		if m.Nutrition == nil {
+			unset = append(unset, "nutrition")
+		} else {
+			set = append(set, nutritionElement(m.Nutrition))
+		}
+	}
+	return set, unset
+}
+
+// planImport decides what to do with each row given the store's items,
+// deleted ones too.
+func planImport(ctx context.Context, store objectid.ObjectID, rows []importRow) error {
+	cur, err := menuItemsColl.Find(ctx, bson.NewDocument(bson.EC.ObjectID("store", store)))
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	items := make(map[string]*menuItem)
+	moved := make(map[string]*menuItem)
+	for cur.Next(ctx) {
+		rdr, err := cur.DecodeBytes()
+		if err != nil {
+			return err
+		}
+		item := new(menuItem)
+		var old struct {
+			OldSlugs []string `bson:"old_slugs"`
+		}
+		if err := bson.Unmarshal(rdr, item); err != nil {
+			return err
+		}
+		if err := bson.Unmarshal(rdr, &old); err != nil {
+			return err
+		}
+		items[item.Slug] = item
+		for _, slug := range old.OldSlugs {
+			moved[slug] = item
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	seen := make(map[string]int)
+	for i := range rows {
+		r := &rows[i]
+		r.check()
+		if first, dup := seen[r.Slug]; dup && r.Slug != "" {
+			r.fail("slug %q is on row %d too", r.Slug, first)
+		} else {
+			seen[r.Slug] = r.Row
+		}
+		if len(r.Errors) > 0 {
+			continue
+		}
+		item := items[r.Slug]
+		if item == nil {
+			item = moved[r.Slug]
+		}
+		if item == nil {
+			if r.menu.Name == "" {
+				r.fail("a new item needs a name")
+			}
+			if r.menu.Type == "" {
+				r.fail("a new item needs a type")
+			}
+			r.Action = "create"
+			continue
+		}
+		r.oid = item.ID
+		r.Item = item.ID.Hex()
+		current := toMenuRow(item)
+		if r.has["type"] && r.menu.Type != "" && r.menu.Type != current.Type {
+			r.fail("type may not be changed, it's %s", current.Type)
+		}
+		r.Action = "unchanged"
+		for field := range r.has {
+			if field != "slug" && field != "type" && menuValue(&r.menu, field) != menuValue(&current, field) {
+				r.Action = "update"
+			}
+		}
+		if item.DeletedAt != 0 {
+			r.Action = "restore"
+		}
+	}
+	return nil
+}
+
+// writeImport makes the changes req planned for rows, all of them or none,
+// auditing each.
+func writeImport(req *http.Request, store objectid.ObjectID, rows []importRow) error {
+	return runTxn(req.Context(), func(tx *txn) error {
+		if err := checkRef(tx, storesColl, store); err != nil {
+			return err
+		}
+		for i := range rows {
+			r := &rows[i]
+			set, unset := r.menuElements()
+			switch r.Action {
+			case "create":
+				doc := bson.NewDocument(
+					bson.EC.String("type", r.menu.Type),
+					bson.EC.ObjectID("store", store),
+					bson.EC.String("slug", r.Slug),
+				)
+				for _, elem := range set {
+					doc.Append(elem)
+				}
+				oid, err := tx.insertOne(menuItemsColl, doc)
+				if err != nil {
+					return err
+				}
+				r.oid = oid
+				r.Item = oid.Hex()
+				if err := menuChanged(tx, store, oid, "added"); err != nil {
+					return err
+				}
+				if err := recordAudit(tx, req, menuItemsColl, oid, auditCreate, nil); err != nil {
+					return err
+				}
+
+			case "update", "restore":
+				if r.Action == "restore" {
+					unset = append(unset, "deleted_at")
+				}
+				setter := bson.NewDocument()
+				if len(set) > 0 {
+					setter.Append(bson.EC.SubDocumentFromElements("$set", set...))
+				}
+				if len(unset) > 0 {
+					fields := make([]*bson.Element, 0, len(unset))
+					for _, field := range unset {
+						fields = append(fields, bson.EC.String(field, ""))
+					}
+					setter.Append(bson.EC.SubDocumentFromElements("$unset", fields...))
+				}
+				if setter.Len() == 0 {
+					continue
+				}
+				before, err := auditBefore(tx, menuItemsColl, r.oid)
+				if err != nil {
+					return err
+				}
+				if _, err := tx.updateOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", r.oid)), setter); err != nil {
+					return err
+				}
+				change, action := "updated", auditUpdate
+				if r.Action == "restore" {
+					change, action = "restored", auditRestore
+				}
+				if err := menuChanged(tx, store, r.oid, change); err != nil {
+					return err
+				}
+				if err := recordAudit(tx, req, menuItemsColl, r.oid, action, before); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// handleMenuImport is POST /api/v1/stores/{id}/menu/import
+func handleMenuImport(res http.ResponseWriter, req *http.Request, store *Store) {
+	if req.Method != "POST" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	query := req.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+		if strings.HasPrefix(req.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		}
+	}
+	body := http.MaxBytesReader(res, req.Body, menuImportMaxBytes)
+	defer body.Close()
+	var rows []importRow
+	var err error
+	switch format {
+	case "csv":
+		rows, err = readMenuCSV(body)
+	case "json":
+		rows, err = readMenuJSON(body)
+	default:
+		err = fmt.Errorf("unknown format %q, use csv or json", format)
+	}
+	if err != nil {
+		http.Error(res, err.Error(), 400)
+		return
+	}
+
+	ctx := req.Context()
+	if err := planImport(ctx, store.ID, rows); err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	report := importReport{DryRun: query.Get("dry_run") == "true", Rows: rows}
+	for _, r := range rows {
+		if len(r.Errors) > 0 {
+			report.Errors++
+		}
+	}
+	status := http.StatusOK
+	if report.Errors > 0 {
+		status = http.StatusUnprocessableEntity
+	} else if !report.DryRun {
+		if err := writeImport(req, store.ID, rows); err != nil {
+			http.Error(res, err.Error(), http.StatusConflict)
+			return
+		}
+	}
+	for _, r := range rows {
+		switch r.Action {
+		case "create":
+			report.Created++
+		case "update":
+			report.Updated++
+		case "restore":
+			report.Restored++
+		case "unchanged":
+			report.Unchanged++
+		}
+	}
+	if report.Errors > 0 {
+		report.Created, report.Updated, report.Restored, report.Unchanged = 0, 0, 0, 0
+	} else if !report.DryRun {
+		log.Printf("menu import for store %s: %d created, %d updated, %d restored, %d unchanged",
+			store.IDStr, report.Created, report.Updated, report.Restored, report.Unchanged)
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	json.NewEncoder(res).Encode(report)
+}
+
+// handleMenuExport is GET /api/v1/stores/{id}/menu/export
+func handleMenuExport(res http.ResponseWriter, req *http.Request, store *Store) {
+	if req.Method != "GET" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "csv" && format != "json" {
+		http.Error(res, fmt.Sprintf("unknown format %q, use csv or json", format), 400)
+		return
+	}
+	ctx := req.Context()
+	cur, err := menuItemsColl.Find(ctx, bson.NewDocument(bson.EC.ObjectID("store", store.ID), notDeleted()))
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	defer cur.Close(ctx)
+	rows := make([]menuRow, 0)
+	for cur.Next(ctx) {
+		var item menuItem
+		if err := cur.Decode(&item); err != nil {
+			http.Error(res, err.Error(), 500)
+			return
+		}
+		rows = append(rows, toMenuRow(&item))
+	}
+	if err := cur.Err(); err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Slug < rows[j].Slug })
+
+	name := store.Slug
+	if name == "" {
+		name = store.IDStr
+	}
+	name += "-menu-" + time.Now().Format(dateLayout)
+	if format != "csv" {
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+		json.NewEncoder(res).Encode(rows)
+		return
+	}
+
+	res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+	w := csv.NewWriter(res)
+	w.Write(menuColumns)
+	for i := range rows {
+		m := &rows[i]
+		record := []string{m.Slug, m.Name, m.Type, m.Descr, m.Price, m.TaxCategory,
+			strings.Join(m.Allergens, ","), strings.Join(m.Diet, ","), formatAvail(m.Avail), "", "", "", ""}
+		if n := m.Nutrition; n != nil {
+			record[9] = strconv.Itoa(n.Calories)
+			record[10] = strconv.FormatFloat(n.Protein, 'f', -1, 64)
+			record[11] = strconv.FormatFloat(n.Carbs, 'f', -1, 64)
+			record[12] = strconv.FormatFloat(n.Fat, 'f', -1, 64)
+		}
+		w.Write(record)
+	}
+	w.Flush()
+}
+
+// handleMenuTransfer is /api/v1/stores/{id}/menu/import and /export, for
+// the store's managers.
+func handleMenuTransfer(res http.ResponseWriter, req *http.Request, storeID, which string) {
+	store, _, err := resolveStore(req, storeID)
+	if err != nil {
+		http.Error(res, err.Error(), 404)
+		return
+	}
+	if _, err := requireStaff(req, roleManager, store.ID); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	if which == "import" {
+		handleMenuImport(res, req, store)
+	} else {
+		handleMenuExport(res, req, store)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// Changes to what's stored are migrations, numbered and applied in order,
+// each recorded in schema_migrations once it's done:
+//
+//	tacos-api migrate            same as up
+//	tacos-api migrate up [n]     apply the next n pending, all of them by default
+//	tacos-api migrate down [n]   undo the last n applied, 1 by default
+//	tacos-api migrate status     list them
+//	tacos-api migrate seed       apply what's pending, then load the demo stores
+//
+// The server applies pending ones itself as it starts unless
+// MIGRATE_ON_START=false. Whoever migrates holds the migrations lease and
+// anyone else waits for it, so replicas starting together migrate once.
+// A migration without a down can't be undone. New ones go at the end of
+// migrations with the next number; never renumber or edit one that's out.
+
+const (
+	migrateLeaseKey = "migrations"
+	migrateLease    = time.Minute
+	migrateWait     = 10 * time.Minute // for someone else's migration to finish
+)
+
+type migration struct {
+	version int32
+	name    string
+	up      func(ctx context.Context) error
+	down    func(ctx context.Context) error // nil if it can't be undone
+}
+
+var migrations = []migration{
+	{1, "slugs for stores and menu items", backfillSlugs, dropSlugs},
+}
+
+// appliedMigration is a migration as recorded in schema_migrations.
+type appliedMigration struct {
+	Version int32  `bson:"_id"`
+	Name    string `bson:"name"`
+	At      int64  `bson:"applied_at"` // unix
+	TookMs  int64  `bson:"took_ms"`
+}
+
+var migrationsColl *mongo.Collection
+
+func appliedMigrations(ctx context.Context) (map[int32]appliedMigration, error) {
+	cur, err := migrationsColl.Find(ctx, bson.NewDocument())
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	applied := make(map[int32]appliedMigration)
+	for cur.Next(ctx) {
+		var m appliedMigration
+		if err := cur.Decode(&m); err != nil {
+			return nil, err
+		}
+		applied[m.Version] = m
+	}
+	return applied, cur.Err()
+}
+
+// withMigrationLease runs fn holding the migrations lease, waiting for it
+// while another replica has it.
+func withMigrationLease(ctx context.Context, fn func() error) error {
+	owner := leaseOwner()
+	deadline := time.Now().Add(migrateWait)
+	for {
+		ok, err := holdLease(ctx, migrateLeaseKey, owner, migrateLease)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("waited %s for another replica's migration to finish", migrateWait)
+		}
+		log.Printf("waiting for another replica's migration")
+		time.Sleep(2 * time.Second)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tick := time.NewTicker(migrateLease / 3)
+		defer tick.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+				if _, err := holdLease(ctx, migrateLeaseKey, owner, migrateLease); err != nil {
+					log.Printf("renewing the migrations lease: %s", err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(done)
+		if err := releaseLease(context.Background(), migrateLeaseKey, owner); err != nil {
+			log.Printf("releasing the migrations lease: %s", err)
+		}
+	}()
+	return fn()
+}
+
+// migrateUp applies up to n pending migrations, all of them if n is 0.
+func migrateUp(ctx context.Context, n int) error {
+	return withMigrationLease(ctx, func() error {
+		applied, err := appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		done := 0
+		for _, m := range migrations {
+			if _, ok := applied[m.version]; ok {
+				continue
+			}
+			if n > 0 && done == n {
+				break
+			}
+			log.Printf("migration %d, %s: applying", m.version, m.name)
+			start := time.Now()
+			if err := m.up(ctx); err != nil {
+				return fmt.Errorf("migration %d, %s: %s", m.version, m.name, err)
+			}
+			_, err := migrationsColl.InsertOne(ctx, bson.NewDocument(
+				bson.EC.Int32("_id", m.version),
+				bson.EC.String("name", m.name),
+				bson.EC.Int64("applied_at", time.Now().Unix()),
+				bson.EC.Int64("took_ms", int64(time.Since(start)/time.Millisecond)),
+			))
+			if err != nil {
+				return err
+			}
+			done++
+		}
+		if done > 0 {
+			log.Printf("applied %d migrations", done)
+		}
+		return nil
+	})
+}
+
+// migrateDown undoes the last n applied migrations.
+func migrateDown(ctx context.Context, n int) error {
+	return withMigrationLease(ctx, func() error {
+		applied, err := appliedMigrations(ctx)
+		if err != nil {
+			return err
+		}
+		known := make(map[int32]migration)
+		for _, m := range migrations {
+			known[m.version] = m
+		}
+		versions := make([]int, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, int(version))
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		if n > len(versions) {
+			n = len(versions)
+		}
+		for _, version := range versions[:n] {
+			m, ok := known[int32(version)]
+			if !ok {
+				return fmt.Errorf("migration %d, %s, is from a newer build, undo it with that", version, applied[int32(version)].Name)
+			}
+			if m.down == nil {
+				return fmt.Errorf("migration %d, %s, can't be undone", m.version, m.name)
+			}
+			log.Printf("migration %d, %s: undoing", m.version, m.name)
+			if err := m.down(ctx); err != nil {
+				return fmt.Errorf("migration %d, %s: %s", m.version, m.name, err)
+			}
+			_, err := migrationsColl.DeleteOne(ctx, bson.NewDocument(bson.EC.Int32("_id", m.version)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func migrateStatus(ctx context.Context) error {
+	applied, err := appliedMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		state := "pending"
+		if a, ok := applied[m.version]; ok {
+			state = "applied " + time.Unix(a.At, 0).UTC().Format(time.RFC3339)
+			delete(applied, m.version)
+		}
+		fmt.Printf("%4d  %-30s  %s\n", m.version, state, m.name)
+	}
+	for _, a := range applied {
+		fmt.Printf("%4d  %-30s  %s\n", a.Version, "applied by a newer build", a.Name)
+	}
+	return nil
+}
+
+// runMigrate is tacos-api migrate ...
+func runMigrate(ctx context.Context, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	n := 0
+	if command == "down" {
+		n = 1
+	}
+	if len(args) > 1 {
+		var err error
+		n, err = strconv.Atoi(args[1])
+		if err != nil || n < 1 || (command != "up" && command != "down") {
+			return fmt.Errorf("usage: tacos-api migrate [up [n] | down [n] | status | seed]")
+		}
+	}
+	switch command {
+	case "up":
+		return migrateUp(ctx, n)
+	case "down":
+		return migrateDown(ctx, n)
+	case "status":
+		return migrateStatus(ctx)
+	case "seed":
+		if err := migrateUp(ctx, 0); err != nil {
+			return err
+		}
+		return seedDemo(ctx)
+	default:
+		return fmt.Errorf("usage: tacos-api migrate [up [n] | down [n] | status | seed]")
+	}
+}
+
+// dropSlugs undoes backfillSlugs, and the slugs given since. The
+// validators require a slug, so they come off first; the next start puts
+// them back and, migrating up again, backfills the slugs before it does.
+func dropSlugs(ctx context.Context) error {
+	unset := bson.NewDocument(bson.EC.SubDocumentFromElements("$unset",
+		bson.EC.String("slug", ""),
+		bson.EC.String("old_slugs", ""),
+	))
+	for _, coll := range []*mongo.Collection{storesColl, menuItemsColl} {
+		if err := dropSchema(ctx, coll.Name()); err != nil {
+			return fmt.Errorf("taking the %s validator off: %s", coll.Name(), err)
+		}
+		if _, err := coll.UpdateMany(ctx, bson.NewDocument(), unset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupMigrations comes before the other setups, which expect the
+// migrations to have run, so it opens the collections they need itself.
+func setupMigrations() {
+	migrationsColl = database.Collection("schema_migrations")
+	storesColl = database.Collection("stores")
+	menuItemsColl = database.Collection("menu_items")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Prices are stored the way the seed fixtures write them, as decimal strings like
+// "2.00" or ".50". Anything that adds them up works in whole cents.
+
+func parseCents(price string) (int64, error) {
+	return parseFixed(price, 2)
+}
+
+// parseFixed reads a decimal string as an integer count of 10^-places.
+func parseFixed(value string, places int) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	neg := strings.HasPrefix(value, "-")
+	digits := strings.TrimPrefix(value, "-")
+	whole, frac := digits, ""
+	if i := strings.Index(digits, "."); i >= 0 {
+		whole, frac = digits[:i], digits[i+1:]
+	}
+	if len(frac) > places {
+		return 0, fmt.Errorf("%q has more than %d decimal places", value, places)
+	}
+	for len(frac) < places {
+		frac += "0"
+	}
+	if whole == "" {
+		whole = "0"
+	}
+	w, err := strconv.ParseUint(whole, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	f, err := strconv.ParseUint(frac, 10, 63)
+	if err != nil && frac != "" {
+		return 0, fmt.Errorf("invalid number %q", value)
+	}
+	scale := int64(1)
+	for i := 0; i < places; i++ {
+		scale *= 10
+	}
+	n := int64(w)*scale + int64(f)
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/bson/objectid"
@@ -18,8 +19,80 @@ import (
 type orderTrans struct {
 	Cust    string `json:"cust"`
 	Store   string `json:"store"`
+	State   string `json:"state"`
 	Started int    `json:"started"` // timestamp
 	Done    int    `json:"done"`    // timestamp
+	Total   string `json:"total"`
+}
+
+// order states, in the order an order moves through them
+const (
+	orderOpen      = "open"
+	orderSubmitted = "submitted"
+	orderPreparing = "preparing"
+	orderReady     = "ready"
+	orderDone      = "done"     // picked up
+	orderRefunded  = "refunded" // all of it, after it was paid
+	orderCancelled = "cancelled"
+)
+
+// orderRecord is an order as stored, with the references still ObjectIDs.
+type orderRecord struct {
+	ID    objectid.ObjectID  `bson:"_id"`
+	Cust  *objectid.ObjectID `bson:"cust,omitempty"`  // nil if it wasn't given
+	Store *objectid.ObjectID `bson:"store,omitempty"` // nil if it wasn't given
+	State string             `bson:"state" schema:"required,enum=open|submitted|preparing|ready|done|refunded|cancelled"`
+	Promo string             `bson:"promo,omitempty"`
+	Tip   *orderTip          `bson:"tip,omitempty"`
+
+	Started   int64 `bson:"started,omitempty"`
+	Ready     int64 `bson:"ready,omitempty"`
+	Cancelled int64 `bson:"cancelled,omitempty"`
+
+	// the bill, once submitted
+	Lines     []orderLine  `bson:"lines,omitempty"`
+	Subtotal  string       `bson:"subtotal,omitempty" schema:"money"`
+	Discounts []billCharge `bson:"discounts,omitempty"`
+	Fees      []billCharge `bson:"fees,omitempty"`
+	Tax       []billCharge `bson:"tax,omitempty"`
+	TaxRate   *taxRate     `bson:"tax_rate,omitempty"`
+	Tips      []billCharge `bson:"tips,omitempty"`
+	Total     string       `bson:"total,omitempty" schema:"money"`
+
+	Refunded string        `bson:"refunded,omitempty" schema:"money"` // sum of Refunds
+	Refunds  []orderRefund `bson:"refunds,omitempty"`
+	History  []orderEvent  `bson:"history,omitempty"`
+}
+
+func (o *orderRecord) custOID() objectid.ObjectID {
+	if o.Cust == nil {
+		return objectid.NilObjectID
+	}
+	return *o.Cust
+}
+
+func (o *orderRecord) storeOID() objectid.ObjectID {
+	if o.Store == nil {
+		return objectid.NilObjectID
+	}
+	return *o.Store
+}
+
+// orderLine is a bill line as recorded on a submitted order.
+type orderLine struct {
+	Item  objectid.ObjectID `bson:"item"`
+	Name  string            `bson:"name"`
+	Count int               `bson:"count"`
+	Price string            `bson:"price" schema:"price"`
+	Total string            `bson:"total" schema:"money"`
+}
+
+// orderItemRecord is an order item as stored.
+type orderItemRecord struct {
+	ID    objectid.ObjectID `bson:"_id"`
+	Order objectid.ObjectID `bson:"order" schema:"required"`
+	Item  objectid.ObjectID `bson:"item" schema:"required"`
+	Count int               `bson:"count"`
 }
 
 type orderItem struct {
@@ -28,6 +101,28 @@ type orderItem struct {
 	Count int    `json:"count"`
 }
 
+// view is item as the API shows it.
+func (item orderItemRecord) view() orderItem {
+	return orderItem{Order: item.Order.Hex(), Item: item.Item.Hex(), Count: item.Count}
+}
+
+// record is item as stored, less its ID.
+func (item orderItem) record() (orderItemRecord, error) {
+	var record orderItemRecord
+	var err error
+	if item.Count < 0 {
+		return record, fmt.Errorf("Count can't be negative")
+	}
+	if record.Order, err = objectid.FromHex(item.Order); err != nil {
+		return record, fmt.Errorf("Order: %s", err)
+	}
+	if record.Item, err = objectid.FromHex(item.Item); err != nil {
+		return record, fmt.Errorf("Item: %s", err)
+	}
+	record.Count = item.Count
+	return record, nil
+}
+
 var ordersColl *mongo.Collection
 var orderItemsColl *mongo.Collection
 
@@ -42,6 +137,32 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 		http.Error(res, msg, 500)
 	}
 
+	if strings.HasSuffix(req.URL.Path, "/promo") {
+		orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
+		handleOrderPromo(res, req, strings.TrimSuffix(orderID, "/promo"))
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/tip") {
+		orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
+		handleOrderTip(res, req, strings.TrimSuffix(orderID, "/tip"))
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/history") {
+		orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
+		handleOrderHistory(res, req, strings.TrimSuffix(orderID, "/history"))
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/refund") {
+		orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
+		handleOrderRefund(res, req, strings.TrimSuffix(orderID, "/refund"))
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, "/payments") {
+		orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
+		handleOrderPayments(res, req, strings.TrimSuffix(orderID, "/payments"))
+		return
+	}
+
 	switch req.Method {
 	case "POST":
 		if req.URL.Path == "/api/v1/order" {
@@ -55,57 +176,146 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 				return
 			}
 			fmt.Printf("order: %+v\n", order)
-			inserts := make([]*bson.Element, 0)
+			record := orderRecord{ID: objectid.New(), State: orderOpen}
 			if order.Cust != "" {
-				oid, err := objectid.FromHex(order.Cust)
+				cust, err := objectid.FromHex(order.Cust)
 				if err != nil {
 					httpError(err.Error())
 					return
 				}
-				inserts = append(inserts, bson.EC.ObjectID("cust", oid))
+				record.Cust = &cust
 			}
 			if order.Store != "" {
-				oid, err := objectid.FromHex(order.Store)
+				store, err := objectid.FromHex(order.Store)
 				if err != nil {
 					httpError(err.Error())
 					return
 				}
-				inserts = append(inserts, bson.EC.ObjectID("store", oid))
+				record.Store = &store
 			}
-			fmt.Printf("inserts: %+v\n", inserts)
-			inserter := bson.NewDocument()
-			for _, update := range inserts {
-				inserter.Append(update)
+			inserter, err := bson.NewDocumentEncoder().EncodeDocument(&record)
+			if err != nil {
+				httpError(err.Error())
+				return
 			}
 			fmt.Printf("inserter: %+v\n", inserter)
-			result, err := ordersColl.InsertOne(context.Background(), inserter, nil)
+			// the order and its created event go in together
+			oid, store := record.ID, record.storeOID()
+			err = runTxn(context.Background(), func(tx *txn) error {
+				if store != objectid.NilObjectID {
+					if err := checkRef(tx, storesColl, store); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.insertOne(ordersColl, inserter); err != nil {
+					return err
+				}
+				return addOutbox(tx, webhookOrderCreated, store, oid, struct {
+					Order string `json:"order"`
+					Store string `json:"store"`
+					Cust  string `json:"cust,omitempty"`
+				}{oid.Hex(), order.Store, order.Cust})
+			})
 			if err != nil {
 				httpError(err.Error())
 				return
 			}
-			fmt.Printf("result: %+v\n", result)
+			fmt.Printf("order: %s\n", oid.Hex())
 			res.Header().Set("Content-Type", "application/json")
-			if oid, ok := result.InsertedID.(objectid.ObjectID); ok {
-				json.NewEncoder(res).Encode(insert{oid.Hex()})
-			} else {
-				json.NewEncoder(res).Encode(result)
-			}
-		} else {
+			json.NewEncoder(res).Encode(insert{oid.Hex()})
+		} else { // submit order, id in path, or cancel with /cancel after it
 			orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
 			log.Printf("post param: %s", orderID)
-			httpError("this is done")
+			action := submitOrder
+			cancelling := strings.HasSuffix(orderID, "/cancel")
+			var who, reason string
+			if cancelling {
+				orderID = strings.TrimSuffix(orderID, "/cancel")
+				s, err := staffFor(req)
+				if err != nil {
+					http.Error(res, err.Error(), http.StatusForbidden)
+					return
+				}
+				who = actor(s)
+				if req.ContentLength != 0 {
+					var body struct {
+						Reason string `json:"reason"`
+					}
+					defer req.Body.Close()
+					if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+						httpError(err.Error())
+						return
+					}
+					reason = body.Reason
+				}
+				action = func(tx *txn, oid objectid.ObjectID) (*bill, error) {
+					return cancelOrder(tx, oid, s, reason)
+				}
+			}
+			oid, err := objectid.FromHex(orderID)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			var b *bill
+			err = runTxn(context.Background(), func(tx *txn) error {
+				var err error
+				b, err = action(tx, oid)
+				return err
+			})
+			if _, ok := err.(*staffError); ok {
+				http.Error(res, err.Error(), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			orderChanged(oid)
+			if cancelling {
+				// the order is cancelled either way, this gives the money back
+				err = settlePayments(req.Context(), oid, who, reason)
+				if err != nil {
+					httpError(fmt.Sprintf("Order cancelled but its payment wasn't returned: %s", err))
+					return
+				}
+			}
+			fmt.Printf("bill: %+v\n", b)
+			res.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(res).Encode(b)
 		}
 
 	case "GET": // list items for order, id in path
 		orderID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
 		log.Printf("get param: %s", orderID)
+		if strings.HasSuffix(orderID, "/nutrition") { // allergens and totals for the whole order
+			oid, err := objectid.FromHex(strings.TrimSuffix(orderID, "/nutrition"))
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			var b *bill
+			err = runTxn(context.Background(), func(tx *txn) error {
+				order := orderRecord{ID: oid}
+				var err error
+				b, err = priceOrder(tx, &order)
+				return err
+			})
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(res).Encode(summarizeDiet(b))
+			return
+		}
 		oid, err := objectid.FromHex(orderID)
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
 		// todo: validate order id?
-		filter := bson.NewDocument(bson.EC.ObjectID("store", oid))
+		filter := bson.NewDocument(bson.EC.ObjectID("order", oid))
 		cur, err := orderItemsColl.Find(context.Background(), filter)
 		if err != nil {
 			httpError(err.Error())
@@ -114,12 +324,13 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 		defer cur.Close(context.Background())
 		list := make([]orderItem, 0)
 		for cur.Next(context.Background()) {
-			var item orderItem
-			err := cur.Decode(&item)
+			var record orderItemRecord
+			err := cur.Decode(&record)
 			if err != nil {
 				httpError(err.Error())
 				return
 			}
+			item := record.view()
 			fmt.Printf("item: %+v\n", item)
 			list = append(list, item)
 		}
@@ -127,7 +338,6 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 		json.NewEncoder(res).Encode(list)
 
 	case "PUT": // add item
-		// todo: make sure everything is specified and valid
 		decoder := json.NewDecoder(req.Body)
 		defer req.Body.Close()
 		var item orderItem
@@ -137,46 +347,37 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		fmt.Printf("item: %+v\n", item)
-		inserts := make([]*bson.Element, 0)
-		if item.Order != "" {
-			oid, err := objectid.FromHex(item.Order)
-			if err != nil {
-				httpError(err.Error())
-				return
-			}
-			inserts = append(inserts, bson.EC.ObjectID("order", oid))
-		}
-		if item.Item != "" {
-			oid, err := objectid.FromHex(item.Item)
-			if err != nil {
-				httpError(err.Error())
-				return
-			}
-			inserts = append(inserts, bson.EC.ObjectID("item", oid))
-		}
-		if item.Count != 0 {
-			inserts = append(inserts, bson.EC.Int32("count", int32(item.Count)))
+		record, err := item.record()
+		if err != nil {
+			httpError(err.Error())
+			return
 		}
-		fmt.Printf("inserts: %+v\n", inserts)
-		inserter := bson.NewDocument()
-		for _, update := range inserts {
-			inserter.Append(update)
+		record.ID = objectid.New()
+		inserter, err := bson.NewDocumentEncoder().EncodeDocument(&record)
+		if err != nil {
+			httpError(err.Error())
+			return
 		}
 		fmt.Printf("inserter: %+v\n", inserter)
-		result, err := orderItemsColl.InsertOne(context.Background(), inserter, nil)
+		// the order and the menu item have to be there, and from one store
+		err = runTxn(context.Background(), func(tx *txn) error {
+			if err := checkOrderItem(tx, record.Order, record.Item); err != nil {
+				return err
+			}
+			if _, err := tx.insertOne(orderItemsColl, inserter); err != nil {
+				return err
+			}
+			return recordAudit(tx, req, orderItemsColl, record.ID, auditCreate, nil)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
-		fmt.Printf("result: %+v\n", result)
+		fmt.Printf("order item: %s\n", record.ID.Hex())
 		res.Header().Set("Content-Type", "application/json")
-		if oid, ok := result.InsertedID.(objectid.ObjectID); ok {
-			json.NewEncoder(res).Encode(insert{oid.Hex()})
-		} else {
-			json.NewEncoder(res).Encode(result)
-		}
+		json.NewEncoder(res).Encode(insert{record.ID.Hex()})
 
-	case "PATCH": // edit item, id in path
+	case "PATCH": // edit item, id in path, with a JSON merge patch (see patch.go)
 		itemID := strings.TrimPrefix(req.URL.Path, "/api/v1/order/")
 		log.Printf("patch param: %s", itemID)
 		oid, err := objectid.FromHex(itemID)
@@ -184,38 +385,60 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 			httpError(err.Error())
 			return
 		}
-		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid))
-		decoder := json.NewDecoder(req.Body)
-		defer req.Body.Close()
-		var item orderItem
-		err = decoder.Decode(&item)
+		patch, err := readPatch(req)
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid))
 		fmt.Printf("updater: %+v\n", updater)
-		updates := make([]*bson.Element, 0)
-		if item.Order != "" {
-			httpError("Item order may not be changed")
-		}
-		if item.Item != "" {
-			httpError("Item id may not be changed")
-		}
-		if item.Count != 0 {
-			updates = append(updates, bson.EC.Int32("count", int32(item.Count)))
-		}
-		fmt.Printf("updates: %+v\n", updates)
-		subdoc := bson.NewDocument()
-		for _, update := range updates {
-			subdoc.Append(update)
-		}
-		setter := bson.NewDocument(bson.EC.SubDocument("$set", subdoc))
-		fmt.Printf("setter: %+v\n", setter)
-		result, err := orderItemsColl.UpdateOne(context.Background(), updater, setter, nil)
+		var matched int64
+		err = runTxn(context.Background(), func(tx *txn) error {
+			before, err := auditBefore(tx, orderItemsColl, oid)
+			if err != nil {
+				return err
+			}
+			var current orderItemRecord
+			err = tx.findOne(orderItemsColl, updater, &current)
+			if err == errNoDocument {
+				matched = 0
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			view := current.view()
+			var item orderItem
+			if err := applyPatch(patch, &view, &item); err != nil {
+				return err
+			}
+			if item.Order != view.Order {
+				return fmt.Errorf("Item order may not be changed")
+			}
+			if item.Item != view.Item {
+				return fmt.Errorf("Item id may not be changed")
+			}
+			record, err := item.record()
+			if err != nil {
+				return err
+			}
+			record.ID = current.ID
+			setter, err := updateFor(&record)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("setter: %+v\n", setter)
+			matched, err = tx.updateOne(orderItemsColl, updater, setter)
+			if err != nil || matched == 0 {
+				return err
+			}
+			return recordAudit(tx, req, orderItemsColl, oid, auditUpdate, before)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		result := &mongo.UpdateResult{MatchedCount: matched, ModifiedCount: matched}
 		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(res).Encode(result)
@@ -229,11 +452,23 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		deleter := bson.NewDocument(bson.EC.ObjectID("_id", oid))
-		result, err := orderItemsColl.DeleteOne(context.Background(), deleter, nil)
+		var deleted int64
+		err = runTxn(context.Background(), func(tx *txn) error {
+			before, err := auditBefore(tx, orderItemsColl, oid)
+			if err != nil {
+				return err
+			}
+			deleted, err = tx.deleteOne(orderItemsColl, deleter)
+			if err != nil || deleted == 0 {
+				return err
+			}
+			return recordAudit(tx, req, orderItemsColl, oid, auditDelete, before)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		result := &mongo.DeleteResult{DeletedCount: deleted}
 		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(res).Encode(result)
@@ -261,6 +496,147 @@ func handleOrderItems(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// submitOrder prices an open order and moves it to submitted. It has to run
+// in a transaction: the prices it reads and the total it writes must agree.
+func submitOrder(tx *txn, oid objectid.ObjectID) (*bill, error) {
+	var order orderRecord
+	err := tx.findOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &order)
+	if err == errNoDocument {
+		return nil, fmt.Errorf("order %s not found", oid.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	if order.State != "" && order.State != orderOpen {
+		return nil, fmt.Errorf("order is already %s", order.State)
+	}
+	b, err := priceOrder(tx, &order)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Lines) == 0 {
+		return nil, fmt.Errorf("order has no items")
+	}
+	loc, err := storeLocation(tx.ctx, order.storeOID())
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().In(loc)
+	for _, menu := range b.menu {
+		if !orderableAt(menu.Avail, now) {
+			return nil, fmt.Errorf("%s isn't available right now", menu.Name)
+		}
+	}
+	err = reserveStock(tx, order.storeOID(), b)
+	if err != nil {
+		return nil, err
+	}
+
+	err = redeemPromo(tx, &order)
+	if err != nil {
+		return nil, err
+	}
+
+	// guard on the state we read so two submits can't both win
+	filter := bson.NewDocument(
+		bson.EC.ObjectID("_id", oid),
+		bson.EC.SubDocumentFromElements("state", bson.EC.ArrayFromElements("$in",
+			bson.VC.String(orderOpen), bson.VC.Null())),
+	)
+	setter := bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set", append([]*bson.Element{
+			bson.EC.String("state", orderSubmitted),
+			bson.EC.Int64("started", time.Now().Unix()),
+		}, b.billElements()...)...),
+		bson.EC.SubDocumentFromElements("$push", historyElement(orderSubmitted, "customer", "", b.Total)),
+	)
+	matched, err := tx.updateOne(ordersColl, filter, setter)
+	if err != nil {
+		return nil, err
+	}
+	if matched == 0 {
+		return nil, fmt.Errorf("order was submitted concurrently")
+	}
+	b.State = orderSubmitted
+	if err := addOutbox(tx, webhookOrderSubmitted, order.storeOID(), oid, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// cancelOrder cancels an order the kitchen hasn't started on and puts back
+// any stock it took. Payments are settled after, outside the transaction,
+// by settlePayments. The customer can cancel an open order with nothing
+// paid on it, s, who may be nil, has to be a cashier at the store for
+// anything else.
+func cancelOrder(tx *txn, oid objectid.ObjectID, s *staffMember, reason string) (*bill, error) {
+	var order orderRecord
+	err := tx.findOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &order)
+	if err == errNoDocument {
+		return nil, fmt.Errorf("order %s not found", oid.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := order.State
+	if state == "" {
+		state = orderOpen
+	}
+	if state != orderOpen && state != orderSubmitted {
+		return nil, fmt.Errorf("order is %s and can no longer be cancelled", state)
+	}
+	paid, err := tx.find(paymentsColl, bson.NewDocument(
+		bson.EC.ObjectID("order", oid),
+		bson.EC.SubDocumentFromElements("state", bson.EC.ArrayFromElements("$in",
+			bson.VC.String(paymentPending), bson.VC.String(paymentAuthorized), bson.VC.String(paymentCaptured))),
+	))
+	if err != nil {
+		return nil, err
+	}
+	if state != orderOpen || len(paid) > 0 {
+		if err := checkStaff(s, roleCashier, order.storeOID()); err != nil {
+			return nil, err
+		}
+	}
+	who := actor(s)
+	b := order.recordedBill()
+	if state == orderSubmitted {
+		err = releaseStock(tx, order.storeOID(), b)
+		if err != nil {
+			return nil, err
+		}
+		err = releasePromo(tx, &order)
+		if err != nil {
+			return nil, err
+		}
+	}
+	filter := bson.NewDocument(bson.EC.ObjectID("_id", oid))
+	if order.State == "" {
+		filter.Append(bson.EC.Null("state"))
+	} else {
+		filter.Append(bson.EC.String("state", order.State))
+	}
+	setter := bson.NewDocument(
+		bson.EC.SubDocumentFromElements("$set",
+			bson.EC.String("state", orderCancelled),
+			bson.EC.Int64("cancelled", time.Now().Unix()),
+		),
+		bson.EC.SubDocumentFromElements("$push", historyElement(orderCancelled, who, reason, "")),
+	)
+	matched, err := tx.updateOne(ordersColl, filter, setter)
+	if err != nil {
+		return nil, err
+	}
+	if matched == 0 {
+		return nil, fmt.Errorf("order changed while cancelling, try again")
+	}
+	b.State = orderCancelled
+	if err := addOutbox(tx, webhookOrderCancelled, order.storeOID(), oid, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
 func setupOrderItems() {
 	ordersColl = database.Collection("orders")
 	orderItemsColl = database.Collection("order_items")
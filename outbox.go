@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Events about orders and menus are written to the outbox in the same
+// runTxn as the change they describe, so an event is stored if and only if
+// its change is. The relay publishes them to the sinks in OUTBOX_SINKS
+// (webhooks,hub,log by default) and only then marks them relayed, so a
+// crash in between means they're published again: at least once, and the
+// outbox id goes along as the event id for sinks and receivers to drop
+// repeats by. Events go out in the order they were written, by the
+// writer's clock; one replica relays at a time, holding a lease.
+//
+// Without transactions (a standalone mongod) the outbox write is undone
+// with the rest of a failed txn, but a crash halfway can still leave one
+// without the other, see runTxn.
+
+const (
+	outboxBatch    = 100
+	outboxPoll     = time.Second
+	outboxLease    = 15 * time.Second
+	outboxLeaseKey = "outbox-relay"
+	outboxKeep     = 7 * 24 * time.Hour // relayed events are kept this long
+)
+
+// outboxEvent is an event waiting for the relay, or relayed.
+type outboxEvent struct {
+	ID      objectid.ObjectID `bson:"_id" json:"id"`
+	Event   string            `bson:"event" json:"event"`
+	Store   objectid.ObjectID `bson:"store" json:"store"`
+	Subject objectid.ObjectID `bson:"subject" json:"subject"` // the order or menu item
+	Data    string            `bson:"data" json:"data"`       // JSON
+	At      int64             `bson:"at" json:"at"`           // ns
+	Relayed int64             `bson:"relayed" json:"relayed"` // ns, 0 until it is
+}
+
+// outboxSink is somewhere the relay publishes events. Publish may see an
+// event more than once.
+type outboxSink interface {
+	Name() string
+	Publish(ctx context.Context, e *outboxEvent) error
+}
+
+var outboxColl *mongo.Collection
+
+var outboxSinks []outboxSink
+var relayPoke = make(chan struct{}, 1)
+
+type relayStatus struct {
+	Sinks   []string `json:"sinks"`
+	Leader  bool     `json:"leader"`
+	Pending int64    `json:"pending"`
+	LagMs   int64    `json:"lag_ms"`  // age of the oldest unrelayed event
+	LastMs  int64    `json:"last_ms"` // write to relay, for the last event relayed
+	Relayed int64    `json:"relayed"` // events relayed by this process
+	Error   string   `json:"error,omitempty"`
+}
+
+// relayStats is what the relay last saw, for /api/v1/outbox.
+var relayStats struct {
+	sync.Mutex
+	relayStatus
+}
+
+// addOutbox records event in tx, to be relayed once tx commits.
+func addOutbox(tx *txn, event string, store, subject objectid.ObjectID, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = tx.insertOne(outboxColl, bson.NewDocument(
+		bson.EC.String("event", event),
+		bson.EC.ObjectID("store", store),
+		bson.EC.ObjectID("subject", subject),
+		bson.EC.String("data", string(body)),
+		bson.EC.Int64("at", time.Now().UnixNano()),
+		bson.EC.Int64("relayed", 0),
+	))
+	if err != nil {
+		return err
+	}
+	tx.afterCommit = append(tx.afterCommit, wakeRelay)
+	return nil
+}
+
+func wakeRelay() {
+	select {
+	case relayPoke <- struct{}{}:
+	default:
+	}
+}
+
+type webhookSink struct{}
+
+func (webhookSink) Name() string { return "webhooks" }
+
+func (webhookSink) Publish(ctx context.Context, e *outboxEvent) error {
+	p := webhookPayload{
+		ID:    e.ID.Hex(),
+		Event: e.Event,
+		At:    e.At / int64(time.Second),
+		Data:  json.RawMessage(e.Data),
+	}
+	if e.Store != objectid.NilObjectID {
+		p.Store = e.Store.Hex()
+	}
+	return queueWebhooks(ctx, &p)
+}
+
+// hubSink pokes the streams that show what the event changed, here. Other
+// replicas' streams hear about orders from the change stream.
+type hubSink struct{}
+
+func (hubSink) Name() string { return "hub" }
+
+func (hubSink) Publish(ctx context.Context, e *outboxEvent) error {
+	if e.Event == webhookMenuChanged {
+		events.publish(menuKey(e.Store))
+		return nil
+	}
+	events.publish(orderKey(e.Subject))
+	events.publish(queueKey(e.Store))
+	events.publish(stockKey(e.Store))
+	return nil
+}
+
+type logSink struct{}
+
+func (logSink) Name() string { return "log" }
+
+func (logSink) Publish(ctx context.Context, e *outboxEvent) error {
+	log.Printf("event %s %s store %s subject %s: %s", e.ID.Hex(), e.Event, e.Store.Hex(), e.Subject.Hex(), e.Data)
+	return nil
+}
+
+// relayOutbox publishes what's in the outbox until ctx is done.
+func relayOutbox(ctx context.Context) {
+	owner := leaseOwner()
+	tick := time.NewTicker(outboxPoll)
+	defer tick.Stop()
+	var purged time.Time
+	for {
+		leader, err := holdLease(ctx, outboxLeaseKey, owner, outboxLease)
+		if err != nil {
+			log.Printf("outbox relay lease: %s", err)
+		}
+		if leader {
+			err = relayBatch(ctx)
+			if err != nil {
+				log.Printf("outbox relay: %s", err)
+			}
+			if time.Since(purged) > time.Hour {
+				purgeOutbox(ctx)
+				purged = time.Now()
+			}
+		}
+		relayStats.Lock()
+		relayStats.Leader = leader
+		relayStats.Error = ""
+		if err != nil {
+			relayStats.Error = err.Error()
+		}
+		relayStats.Unlock()
+		reportOutbox(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-relayPoke:
+		}
+	}
+}
+
+// relayBatch publishes pending events oldest first, stopping at the first
+// one a sink fails on so nothing overtakes it.
+func relayBatch(ctx context.Context) error {
+	for {
+		cur, err := outboxColl.Find(ctx, bson.NewDocument(bson.EC.Int64("relayed", 0)),
+			findopt.Sort(bson.NewDocument(bson.EC.Int32("at", 1), bson.EC.Int32("_id", 1))),
+			findopt.Limit(outboxBatch))
+		if err != nil {
+			return err
+		}
+		batch := make([]outboxEvent, 0, outboxBatch)
+		for cur.Next(ctx) {
+			var e outboxEvent
+			if err := cur.Decode(&e); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+			batch = append(batch, e)
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := range batch {
+			e := &batch[i]
+			for _, sink := range outboxSinks {
+				if err := sink.Publish(ctx, e); err != nil {
+					return fmt.Errorf("%s sink, event %s: %s", sink.Name(), e.ID.Hex(), err)
+				}
+			}
+			now := time.Now().UnixNano()
+			_, err := outboxColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", e.ID)),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Int64("relayed", now))))
+			if err != nil {
+				return err
+			}
+			lag := (now - e.At) / int64(time.Millisecond)
+			if stats != nil {
+				stats.Timing("outbox.relay_lag", lag, 1.0)
+			}
+			relayStats.Lock()
+			relayStats.LastMs = lag
+			relayStats.Relayed++
+			relayStats.Unlock()
+		}
+		if len(batch) < outboxBatch {
+			return nil
+		}
+	}
+}
+
+// purgeOutbox drops events relayed more than outboxKeep ago.
+func purgeOutbox(ctx context.Context) {
+	result, err := outboxColl.DeleteMany(ctx, bson.NewDocument(
+		bson.EC.SubDocumentFromElements("relayed",
+			bson.EC.Int64("$gt", 0),
+			bson.EC.Int64("$lt", time.Now().Add(-outboxKeep).UnixNano()),
+		),
+	))
+	if err != nil {
+		log.Printf("purging outbox: %s", err)
+		return
+	}
+	if result.DeletedCount > 0 {
+		log.Printf("purged %d relayed events from the outbox", result.DeletedCount)
+	}
+}
+
+// reportOutbox gauges how far behind the relay is.
+func reportOutbox(ctx context.Context) {
+	filter := bson.NewDocument(bson.EC.Int64("relayed", 0))
+	pending, err := outboxColl.Count(ctx, filter)
+	if err != nil {
+		return
+	}
+	var oldest outboxEvent
+	lag := int64(0)
+	err = outboxColl.FindOne(ctx, filter,
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("at", 1)))).Decode(&oldest)
+	if err == nil {
+		lag = (time.Now().UnixNano() - oldest.At) / int64(time.Millisecond)
+	}
+	if stats != nil {
+		stats.Gauge("outbox.pending", pending, 1.0)
+		stats.Gauge("outbox.lag_ms", lag, 1.0)
+	}
+	relayStats.Lock()
+	relayStats.Pending = pending
+	relayStats.LagMs = lag
+	relayStats.Unlock()
+}
+
+// handleOutbox is GET /api/v1/outbox for admins, how the relay is doing.
+func handleOutbox(res http.ResponseWriter, req *http.Request) {
+	if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	if req.Method != "GET" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 500)
+		return
+	}
+	relayStats.Lock()
+	status := relayStats.relayStatus
+	relayStats.Unlock()
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(status)
+}
+
+func setupOutbox() error {
+	outboxColl = database.Collection("outbox")
+
+	for _, name := range strings.Split(getEnv("OUTBOX_SINKS", "webhooks,hub,log"), ",") {
+		switch name {
+		case "webhooks":
+			outboxSinks = append(outboxSinks, webhookSink{})
+		case "hub":
+			outboxSinks = append(outboxSinks, hubSink{})
+		case "log":
+			outboxSinks = append(outboxSinks, logSink{})
+		case "":
+			continue
+		default:
+			return fmt.Errorf("unknown OUTBOX_SINKS entry %q", name)
+		}
+		relayStats.Sinks = append(relayStats.Sinks, name)
+	}
+
+	go relayOutbox(context.Background())
+
+	http.HandleFunc("/api/v1/outbox", handleOutbox)
+	return nil
+}
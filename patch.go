@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+// PATCH bodies are JSON merge patches (RFC 7386): a field in the patch
+// replaces what's stored, zero values included, null clears it, and
+// anything left out stays as it is. Objects merge field by field, arrays
+// are replaced whole. A handler applies the patch to the resource as the
+// API shows it, validates the result like something new, and writes all
+// of it back with updateFor.
+
+const mergePatchType = "application/merge-patch+json"
+
+// readPatch decodes req's merge patch. Plain application/json is taken
+// as one too.
+func readPatch(req *http.Request) (interface{}, error) {
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		mt, _, err := mime.ParseMediaType(ct)
+		if err != nil {
+			return nil, err
+		}
+		if mt != mergePatchType && mt != "application/json" {
+			return nil, fmt.Errorf("PATCH takes a JSON merge patch, %s, not %s", mergePatchType, mt)
+		}
+	}
+	defer req.Body.Close()
+	decoder := json.NewDecoder(req.Body)
+	decoder.UseNumber()
+	var patch interface{}
+	if err := decoder.Decode(&patch); err != nil {
+		return nil, err
+	}
+	if _, ok := patch.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("a merge patch for this has to be a JSON object")
+	}
+	return patch, nil
+}
+
+// mergePatch is target, decoded JSON, with patch applied.
+func mergePatch(target, patch interface{}) interface{} {
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	merged, ok := target.(map[string]interface{})
+	if !ok {
+		merged = make(map[string]interface{})
+	}
+	for key, value := range fields {
+		if value == nil {
+			delete(merged, key)
+			continue
+		}
+		merged[key] = mergePatch(merged[key], value)
+	}
+	return merged
+}
+
+// applyPatch applies patch to current and decodes the result into next,
+// which should start out zero so cleared fields end up that way.
+func applyPatch(patch interface{}, current, next interface{}) error {
+	b, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var target interface{}
+	if err := decoder.Decode(&target); err != nil {
+		return err
+	}
+	if b, err = json.Marshal(mergePatch(target, patch)); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, next)
+}
+
+// updateFor is the update that makes a stored document match v, a model
+// struct: whatever it stores is $set and whatever it leaves out, with
+// omitempty, is $unset. _id stays as it is.
+func updateFor(v interface{}) (*bson.Document, error) {
+	doc, err := bson.NewDocumentEncoder().EncodeDocument(v)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.NewDocument()
+	itr := doc.Iterator()
+	for itr.Next() {
+		if elem := itr.Element(); elem.Key() != "_id" {
+			set.Append(elem.Clone())
+		}
+	}
+	unset := bson.NewDocument()
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	for i := 0; i < t.NumField(); i++ {
+		key := bsonKey(t.Field(i))
+		if key == "" || key == "_id" {
+			continue
+		}
+		if _, err := doc.LookupElementErr(key); err != nil {
+			unset.Append(bson.EC.String(key, ""))
+		}
+	}
+	update := bson.NewDocument(bson.EC.SubDocument("$set", set))
+	if unset.Len() > 0 {
+		update.Append(bson.EC.SubDocument("$unset", unset))
+	}
+	return update, nil
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// PaymentProvider is a card processor. Amounts are in cents. Authorize holds
+// the money on the customer's card and returns the processor's reference
+// for it, which the other calls take. A declined card is a *declineError
+// error, anything else went wrong talking to the processor.
+type PaymentProvider interface {
+	Name() string
+	Authorize(ctx context.Context, source string, amount int64, order string) (string, error)
+	Capture(ctx context.Context, ref string, amount int64) error
+	Void(ctx context.Context, ref string) error
+	Refund(ctx context.Context, ref string, amount int64) (string, error)
+}
+
+type declineError struct {
+	Reason string
+}
+
+func (e *declineError) Error() string {
+	return "payment declined: " + e.Reason
+}
+
+var payments PaymentProvider
+
+// payment states
+const (
+	paymentPending    = "pending" // sent to the provider, no answer yet
+	paymentAuthorized = "authorized"
+	paymentCaptured   = "captured"
+	paymentVoided     = "voided"
+	paymentDeclined   = "declined"
+	paymentFailed     = "failed"
+)
+
+// paymentRecord is one attempt to pay for an order. Refunded only grows,
+// up to Captured.
+type paymentRecord struct {
+	ID       objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr    string            `bson:"-" json:"id"`
+	Order    objectid.ObjectID `bson:"order" json:"-"`
+	OrderStr string            `bson:"-" json:"order"`
+	Provider string            `bson:"provider" json:"provider"`
+	Ref      string            `bson:"ref" json:"ref"`
+	State    string            `bson:"state" json:"state"`
+	Reason   string            `bson:"reason" json:"reason,omitempty"`
+	Amount   string            `bson:"amount" json:"amount"`
+	Captured string            `bson:"captured" json:"captured"`
+	Refunded string            `bson:"refunded" json:"refunded"`
+	Created  int64             `bson:"created" json:"created"`
+	Updated  int64             `bson:"updated" json:"updated"`
+}
+
+var paymentsColl *mongo.Collection
+
+// payClaim is how long recordPendingPayment's claim on an order lasts if
+// it never gets to give it up.
+const payClaim = time.Minute
+
+// setupPayments picks the provider from PAYMENT_PROVIDER. Only "fake" so
+// far, see fakeProvider for what it does.
+func setupPayments() error {
+	switch kind := getEnv("PAYMENT_PROVIDER", "fake"); kind {
+	case "fake":
+		fake, err := newFakeProvider()
+		if err != nil {
+			return err
+		}
+		payments = fake
+		fmt.Println("Using the fake payment provider")
+	default:
+		return fmt.Errorf("unknown PAYMENT_PROVIDER %q", kind)
+	}
+	paymentsColl = database.Collection("payments")
+
+	http.HandleFunc("/api/v1/payments/", handlePayments)
+	return nil
+}
+
+func (p *paymentRecord) fill() {
+	p.IDStr = p.ID.Hex()
+	p.OrderStr = p.Order.Hex()
+}
+
+func findPayment(ctx context.Context, oid objectid.ObjectID) (*paymentRecord, error) {
+	var p paymentRecord
+	err := paymentsColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&p)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("payment %s not found", oid.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.fill()
+	return &p, nil
+}
+
+func orderPayments(ctx context.Context, order objectid.ObjectID) ([]paymentRecord, error) {
+	cur, err := paymentsColl.Find(ctx, bson.NewDocument(bson.EC.ObjectID("order", order)),
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("created", 1))))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	list := make([]paymentRecord, 0)
+	for cur.Next(ctx) {
+		var p paymentRecord
+		if err := cur.Decode(&p); err != nil {
+			return nil, err
+		}
+		p.fill()
+		list = append(list, p)
+	}
+	return list, cur.Err()
+}
+
+// movePayment sets fields on a payment if it's still in state from, so two
+// requests can't both capture or void it. Returns false if it had moved on.
+func movePayment(ctx context.Context, p *paymentRecord, from string, sets ...*bson.Element) (bool, error) {
+	sets = append(sets, bson.EC.Int64("updated", time.Now().Unix()))
+	result, err := paymentsColl.UpdateOne(ctx,
+		bson.NewDocument(bson.EC.ObjectID("_id", p.ID), bson.EC.String("state", from)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$set", sets...)))
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
+
+// payableStates are the order states a payment can be taken in.
+var payableStates = []string{orderSubmitted, orderPreparing, orderReady, orderDone}
+
+// payOrder authorizes the total of a submitted order, and captures it too
+// if capture is set. The payment is recorded as pending before the provider
+// is called, so a crash in between leaves a trace to reconcile. An order
+// cancelled while the provider was answering has the hold voided again,
+// settlePayments only sees payments that got as far as authorized.
+func payOrder(ctx context.Context, oid objectid.ObjectID, source string, capture bool) (*paymentRecord, error) {
+	var order orderRecord
+	err := ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&order)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("order %s not found", oid.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch order.State {
+	case orderSubmitted, orderPreparing, orderReady, orderDone:
+	default:
+		return nil, fmt.Errorf("order is %s, only submitted orders can be paid", order.State)
+	}
+	amount, err := parseCents(order.Total)
+	if err != nil {
+		return nil, err
+	}
+	p, err := recordPendingPayment(ctx, oid, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := payments.Authorize(ctx, source, amount, oid.Hex())
+	if declined, ok := err.(*declineError); ok {
+		p.State, p.Reason = paymentDeclined, declined.Reason
+		if _, err := movePayment(ctx, p, paymentPending,
+			bson.EC.String("state", p.State), bson.EC.String("reason", p.Reason)); err != nil {
+			return nil, err
+		}
+		return p, declined
+	}
+	if err != nil {
+		p.State, p.Reason = paymentFailed, err.Error()
+		if _, err := movePayment(ctx, p, paymentPending,
+			bson.EC.String("state", p.State), bson.EC.String("reason", p.Reason)); err != nil {
+			log.Printf("payment %s: %s", p.IDStr, err)
+		}
+		return nil, err
+	}
+	p.Ref, p.State = ref, paymentAuthorized
+	if _, err := movePayment(ctx, p, paymentPending,
+		bson.EC.String("ref", p.Ref), bson.EC.String("state", p.State)); err != nil {
+		return nil, err
+	}
+	var current struct {
+		State string `bson:"state"`
+	}
+	err = ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&current)
+	if err != nil {
+		return nil, err
+	}
+	if current.State == orderCancelled {
+		if err := voidPayment(ctx, p); err != nil {
+			return nil, fmt.Errorf("order was cancelled while paying and voiding the payment failed: %s", err)
+		}
+		return nil, fmt.Errorf("order was cancelled while paying, the payment was voided")
+	}
+	if capture {
+		if err := capturePayment(ctx, p); err != nil {
+			return p, err
+		}
+	}
+	_, err = ordersColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid)),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$push",
+			historyElement(p.State, "customer", payments.Name(), p.Amount))))
+	if err == nil {
+		orderChanged(oid)
+	}
+	return p, err
+}
+
+// recordPendingPayment records a pending payment of amount cents for order
+// unless it already has one under way or done. It claims the order while it
+// looks, so two requests can't both find it unpaid and both charge the card;
+// once the pending payment is recorded it's what keeps the next one out.
+// The claim only takes an order in one of payableStates.
+func recordPendingPayment(ctx context.Context, order objectid.ObjectID, amount int64) (*paymentRecord, error) {
+	claim := time.Now().UnixNano()
+	result, err := ordersColl.UpdateOne(ctx,
+		bson.NewDocument(
+			bson.EC.ObjectID("_id", order),
+			bson.EC.SubDocumentFromElements("state", stringsElement("$in", payableStates)),
+			bson.EC.ArrayFromElements("$or",
+				bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("paying", bson.EC.Boolean("$exists", false))),
+				// whoever claimed it before died holding it
+				bson.VC.DocumentFromElements(bson.EC.SubDocumentFromElements("paying", bson.EC.Int64("$lt", claim-int64(payClaim)))),
+			),
+		),
+		bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Int64("paying", claim))))
+	if err != nil {
+		return nil, err
+	}
+	if result.MatchedCount == 0 {
+		return nil, fmt.Errorf("order is already being paid or can no longer be paid")
+	}
+	defer func() {
+		_, err := ordersColl.UpdateOne(context.Background(),
+			bson.NewDocument(bson.EC.ObjectID("_id", order), bson.EC.Int64("paying", claim)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$unset", bson.EC.String("paying", ""))))
+		if err != nil {
+			log.Printf("order %s: giving up the payment claim: %s", order.Hex(), err)
+		}
+	}()
+
+	existing, err := orderPayments(ctx, order)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range existing {
+		switch p.State {
+		case paymentPending, paymentAuthorized, paymentCaptured:
+			return nil, fmt.Errorf("order already has a payment %s", p.State)
+		}
+	}
+
+	now := time.Now().Unix()
+	p := &paymentRecord{
+		Order:    order,
+		Provider: payments.Name(),
+		State:    paymentPending,
+		Amount:   formatCents(amount),
+		Captured: formatCents(0),
+		Refunded: formatCents(0),
+		Created:  now,
+		Updated:  now,
+	}
+	inserted, err := paymentsColl.InsertOne(ctx, bson.NewDocument(
+		bson.EC.ObjectID("order", p.Order),
+		bson.EC.String("provider", p.Provider),
+		bson.EC.String("ref", ""),
+		bson.EC.String("state", p.State),
+		bson.EC.String("amount", p.Amount),
+		bson.EC.String("captured", p.Captured),
+		bson.EC.String("refunded", p.Refunded),
+		bson.EC.Int64("created", p.Created),
+		bson.EC.Int64("updated", p.Updated),
+	))
+	if err != nil {
+		return nil, err
+	}
+	p.ID = inserted.InsertedID.(objectid.ObjectID)
+	p.fill()
+	return p, nil
+}
+
+func capturePayment(ctx context.Context, p *paymentRecord) error {
+	if p.State != paymentAuthorized {
+		return fmt.Errorf("payment is %s and can't be captured", p.State)
+	}
+	amount, err := parseCents(p.Amount)
+	if err != nil {
+		return err
+	}
+	if err := payments.Capture(ctx, p.Ref, amount); err != nil {
+		return err
+	}
+	moved, err := movePayment(ctx, p, paymentAuthorized,
+		bson.EC.String("state", paymentCaptured), bson.EC.String("captured", p.Amount))
+	if err != nil {
+		return err
+	}
+	if !moved {
+		return fmt.Errorf("payment changed while capturing")
+	}
+	p.State, p.Captured = paymentCaptured, p.Amount
+	return nil
+}
+
+func voidPayment(ctx context.Context, p *paymentRecord) error {
+	if p.State != paymentAuthorized {
+		return fmt.Errorf("payment is %s and can't be voided", p.State)
+	}
+	if err := payments.Void(ctx, p.Ref); err != nil {
+		return err
+	}
+	moved, err := movePayment(ctx, p, paymentAuthorized, bson.EC.String("state", paymentVoided))
+	if err != nil {
+		return err
+	}
+	if !moved {
+		return fmt.Errorf("payment changed while voiding")
+	}
+	p.State = paymentVoided
+	return nil
+}
+
+// refundPayment gives back amount cents of a captured payment, or all that
+// is left if amount is 0, and returns the provider's reference for it.
+func refundPayment(ctx context.Context, p *paymentRecord, amount int64) (string, error) {
+	if p.State != paymentCaptured {
+		return "", fmt.Errorf("payment is %s and can't be refunded", p.State)
+	}
+	captured, err := parseCents(p.Captured)
+	if err != nil {
+		return "", err
+	}
+	refunded, err := parseCents(p.Refunded)
+	if err != nil {
+		return "", err
+	}
+	left := captured - refunded
+	if amount == 0 {
+		amount = left
+	}
+	if amount <= 0 || amount > left {
+		return "", fmt.Errorf("can refund up to %s", formatCents(left))
+	}
+	// claim the amount first, so two refunds can't both take the last of it
+	claim := func(from, to string) error {
+		result, err := paymentsColl.UpdateOne(ctx,
+			bson.NewDocument(
+				bson.EC.ObjectID("_id", p.ID),
+				bson.EC.String("state", paymentCaptured),
+				bson.EC.String("refunded", from),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+				bson.EC.String("refunded", to),
+				bson.EC.Int64("updated", time.Now().Unix()),
+			)))
+		if err == nil && result.MatchedCount == 0 {
+			err = fmt.Errorf("payment changed while refunding")
+		}
+		return err
+	}
+	if err := claim(p.Refunded, formatCents(refunded+amount)); err != nil {
+		return "", err
+	}
+	ref, err := payments.Refund(ctx, p.Ref, amount)
+	if err != nil {
+		if undoErr := claim(formatCents(refunded+amount), p.Refunded); undoErr != nil {
+			log.Printf("payment %s: refund failed and couldn't be put back: %s", p.IDStr, undoErr)
+		}
+		return "", err
+	}
+	p.Refunded = formatCents(refunded + amount)
+	return ref, nil
+}
+
+// handleOrderPayments is /api/v1/order/{id}/payments: GET lists them, POST
+// {source, capture} pays for the order.
+func handleOrderPayments(res http.ResponseWriter, req *http.Request, orderID string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	oid, err := objectid.FromHex(orderID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	switch req.Method {
+	case "GET":
+		list, err := orderPayments(context.Background(), oid)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case "POST":
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var body struct {
+			Source  string `json:"source"` // card token
+			Capture bool   `json:"capture"`
+		}
+		err := decoder.Decode(&body)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if body.Source == "" {
+			httpError("Source is required")
+			return
+		}
+		p, err := payOrder(req.Context(), oid, body.Source, body.Capture)
+		if declined, ok := err.(*declineError); ok {
+			res.Header().Set("Content-Type", "application/json")
+			res.WriteHeader(http.StatusPaymentRequired)
+			json.NewEncoder(res).Encode(p)
+			log.Printf("order %s: %s", orderID, declined)
+			return
+		}
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("payment: %+v\n", p)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(p)
+
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+	}
+}
+
+// handlePayments is /api/v1/payments/{id}: GET it, or POST to /capture or
+// /void, which take a cashier. Refunds go through the order, see
+// handleOrderRefund.
+func handlePayments(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/payments/"), "/")
+	oid, err := objectid.FromHex(parts[0])
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	ctx := req.Context()
+	p, err := findPayment(ctx, oid)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	if req.Method == "POST" {
+		var order orderRecord
+		err := ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", p.Order))).Decode(&order)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if _, err := requireStaff(req, roleCashier, order.storeOID()); err != nil {
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	switch {
+	case req.Method == "GET" && action == "":
+	case req.Method == "POST" && action == "capture":
+		err = capturePayment(ctx, p)
+	case req.Method == "POST" && action == "void":
+		err = voidPayment(ctx, p)
+	default:
+		httpError(fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path))
+		return
+	}
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(p)
+}
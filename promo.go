@@ -0,0 +1,501 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// promotion is a promo code. Kind decides how the discount is worked out:
+//
+//	percent  Percent off the subtotal ("10% off at Silly Tacos")
+//	fixed    Amount off ("$2 off orders over $10", with MinSubtotal)
+//	bogo     for every BuyCount items of BuyType, GetCount items of GetType
+//	         free, cheapest first ("free topping with any filling")
+//
+// Codes are matched case-insensitively. A code is only good between Starts
+// and Ends (either may be empty), at Store if set, MaxUses times overall
+// and MaxPerCust times per customer (0 is unlimited); a code with
+// MaxPerCust can't go on an order without a customer, there'd be no
+// telling guests apart. Uses only count when an order with the code is
+// submitted.
+type promotion struct {
+	ID          objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr       string            `bson:"-" json:"id"`
+	Code        string            `json:"code"`
+	Descr       string            `json:"descr"`
+	Kind        string            `json:"kind"`
+	Store       string            `bson:"-" json:"store"`
+	StoreID     objectid.ObjectID `bson:"store" json:"-"`
+	Percent     int               `json:"percent"`
+	Amount      string            `json:"amount"`
+	MinSubtotal string            `bson:"min_subtotal" json:"min_subtotal"`
+	BuyType     string            `bson:"buy_type" json:"buy_type"`
+	BuyCount    int               `bson:"buy_count" json:"buy_count"`
+	GetType     string            `bson:"get_type" json:"get_type"`
+	GetCount    int               `bson:"get_count" json:"get_count"`
+	Starts      string            `json:"starts"` // RFC 3339
+	Ends        string            `json:"ends"`
+	MaxUses     int               `bson:"max_uses" json:"max_uses"`
+	MaxPerCust  int               `bson:"max_per_cust" json:"max_per_cust"`
+	Uses        int               `json:"uses"`
+	Active      bool              `json:"active"`
+}
+
+var promosColl *mongo.Collection
+var redemptionsColl *mongo.Collection
+
+func (p *promotion) validate() error {
+	switch p.Kind {
+	case "percent":
+		if p.Percent <= 0 || p.Percent > 100 {
+			return fmt.Errorf("percent must be between 1 and 100")
+		}
+	case "fixed":
+		cents, err := parseCents(p.Amount)
+		if err != nil {
+			return err
+		}
+		if cents <= 0 {
+			return fmt.Errorf("amount must be more than zero")
+		}
+	case "bogo":
+		if p.BuyType == "" || p.GetType == "" || p.BuyCount < 1 || p.GetCount < 1 {
+			return fmt.Errorf("buy_type, buy_count, get_type and get_count are required")
+		}
+	default:
+		return fmt.Errorf("kind must be one of percent, fixed, bogo")
+	}
+	if _, err := parseCents(p.MinSubtotal); err != nil {
+		return err
+	}
+	for _, when := range []string{p.Starts, p.Ends} {
+		if when == "" {
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, when); err != nil {
+			return err
+		}
+	}
+	if p.MaxUses < 0 || p.MaxPerCust < 0 {
+		return fmt.Errorf("usage limits may not be negative")
+	}
+	return nil
+}
+
+// promoElements are the stored fields of p, other than usage.
+func (p *promotion) promoElements() []*bson.Element {
+	elems := []*bson.Element{
+		bson.EC.String("code", strings.ToUpper(p.Code)),
+		bson.EC.String("descr", p.Descr),
+		bson.EC.String("kind", p.Kind),
+		bson.EC.Int32("percent", int32(p.Percent)),
+		bson.EC.String("amount", p.Amount),
+		bson.EC.String("min_subtotal", p.MinSubtotal),
+		bson.EC.String("buy_type", p.BuyType),
+		bson.EC.Int32("buy_count", int32(p.BuyCount)),
+		bson.EC.String("get_type", p.GetType),
+		bson.EC.Int32("get_count", int32(p.GetCount)),
+		bson.EC.String("starts", p.Starts),
+		bson.EC.String("ends", p.Ends),
+		bson.EC.Int32("max_uses", int32(p.MaxUses)),
+		bson.EC.Int32("max_per_cust", int32(p.MaxPerCust)),
+		bson.EC.Boolean("active", p.Active),
+	}
+	if p.StoreID != objectid.NilObjectID {
+		elems = append(elems, bson.EC.ObjectID("store", p.StoreID))
+	} else {
+		elems = append(elems, bson.EC.Null("store"))
+	}
+	return elems
+}
+
+// usable checks everything about the code that doesn't depend on the bill.
+func (p *promotion) usable(tx *txn, order *orderRecord, now time.Time) error {
+	if !p.Active {
+		return fmt.Errorf("promo code %s is not active", p.Code)
+	}
+	if p.Starts != "" {
+		starts, _ := time.Parse(time.RFC3339, p.Starts)
+		if now.Before(starts) {
+			return fmt.Errorf("promo code %s isn't valid yet", p.Code)
+		}
+	}
+	if p.Ends != "" {
+		ends, _ := time.Parse(time.RFC3339, p.Ends)
+		if !now.Before(ends) {
+			return fmt.Errorf("promo code %s has expired", p.Code)
+		}
+	}
+	if p.StoreID != objectid.NilObjectID && p.StoreID != order.storeOID() {
+		return fmt.Errorf("promo code %s isn't valid at this store", p.Code)
+	}
+	if p.MaxUses > 0 && p.Uses >= p.MaxUses {
+		return fmt.Errorf("promo code %s has been used up", p.Code)
+	}
+	if p.MaxPerCust > 0 {
+		if order.Cust == nil {
+			return fmt.Errorf("promo code %s needs an order with a customer", p.Code)
+		}
+		docs, err := tx.find(redemptionsColl, bson.NewDocument(
+			bson.EC.ObjectID("promo", p.ID),
+			bson.EC.ObjectID("cust", order.custOID()),
+		))
+		if err != nil {
+			return err
+		}
+		if len(docs) >= p.MaxPerCust {
+			return fmt.Errorf("promo code %s has already been used on your orders", p.Code)
+		}
+	}
+	return nil
+}
+
+// discount works out the (negative) amount p takes off b.
+func (p *promotion) discount(b *bill) (int64, error) {
+	subtotal, err := parseCents(b.Subtotal)
+	if err != nil {
+		return 0, err
+	}
+	minimum, _ := parseCents(p.MinSubtotal)
+	if subtotal < minimum {
+		return 0, fmt.Errorf("promo code %s needs an order of at least %s", p.Code, formatCents(minimum))
+	}
+
+	var off int64
+	switch p.Kind {
+	case "percent":
+		off = (subtotal*int64(p.Percent) + 50) / 100
+	case "fixed":
+		off, _ = parseCents(p.Amount)
+	case "bogo":
+		// one entry per unit ordered, so the cheapest can be given away
+		var bought int
+		free := make([]int64, 0)
+		for _, line := range b.Lines {
+			oid, _ := objectid.FromHex(line.Item)
+			price, _ := parseCents(line.Price)
+			itemType := b.menu[oid].Type
+			if itemType == p.BuyType {
+				bought += line.Count
+			}
+			if itemType == p.GetType {
+				for i := 0; i < line.Count; i++ {
+					free = append(free, price)
+				}
+			}
+		}
+		sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+		sets := bought / p.BuyCount
+		if p.BuyType == p.GetType {
+			// buy two get one: the free ones come out of the same items
+			sets = bought / (p.BuyCount + p.GetCount)
+		}
+		n := sets * p.GetCount
+		if n > len(free) {
+			n = len(free)
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("promo code %s needs %d %s and a %s", p.Code, p.BuyCount, p.BuyType, p.GetType)
+		}
+		for _, price := range free[:n] {
+			off += price
+		}
+	}
+	if off > subtotal {
+		off = subtotal
+	}
+	return -off, nil
+}
+
+// applyPromo prices the order's promo code against b.
+func applyPromo(tx *txn, order *orderRecord, b *bill) (*billCharge, error) {
+	p, err := findPromo(tx, order.Promo)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.usable(tx, order, time.Now()); err != nil {
+		return nil, err
+	}
+	off, err := p.discount(b)
+	if err != nil {
+		return nil, err
+	}
+	descr := p.Descr
+	if descr == "" {
+		descr = "Promo " + p.Code
+	}
+	return &billCharge{Code: p.Code, Descr: descr, Amount: formatCents(off)}, nil
+}
+
+func findPromo(tx *txn, code string) (*promotion, error) {
+	var p promotion
+	err := tx.findOne(promosColl, bson.NewDocument(bson.EC.String("code", strings.ToUpper(code))), &p)
+	if err == errNoDocument {
+		return nil, fmt.Errorf("unknown promo code %s", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// redeemPromo counts a use of the order's code as it's submitted. The uses
+// guard makes the global limit hold even with orders racing for the last one.
+func redeemPromo(tx *txn, order *orderRecord) error {
+	if order.Promo == "" {
+		return nil
+	}
+	p, err := findPromo(tx, order.Promo)
+	if err != nil {
+		return err
+	}
+	filter := bson.NewDocument(bson.EC.ObjectID("_id", p.ID))
+	if p.MaxUses > 0 {
+		filter.Append(bson.EC.SubDocumentFromElements("uses", bson.EC.Int32("$lt", int32(p.MaxUses))))
+	}
+	inc := bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("uses", 1)))
+	matched, err := tx.updateOne(promosColl, filter, inc)
+	if err != nil {
+		return err
+	}
+	if matched == 0 {
+		return fmt.Errorf("promo code %s has been used up", p.Code)
+	}
+	_, err = tx.insertOne(redemptionsColl, bson.NewDocument(
+		bson.EC.ObjectID("promo", p.ID),
+		bson.EC.ObjectID("order", order.ID),
+		bson.EC.ObjectID("cust", order.custOID()),
+		bson.EC.Time("at", time.Now()),
+	))
+	return err
+}
+
+// releasePromo gives a cancelled order's use back.
+func releasePromo(tx *txn, order *orderRecord) error {
+	if order.Promo == "" {
+		return nil
+	}
+	n, err := tx.deleteOne(redemptionsColl, bson.NewDocument(bson.EC.ObjectID("order", order.ID)))
+	if err != nil || n == 0 {
+		return err
+	}
+	filter := bson.NewDocument(bson.EC.String("code", order.Promo))
+	dec := bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("uses", -1)))
+	_, err = tx.updateOne(promosColl, filter, dec)
+	return err
+}
+
+// handleOrderPromo is POST and DELETE on /api/v1/order/{id}/promo. POST
+// takes {"code": "..."}, checks it against the open order and answers with
+// the repriced bill.
+func handleOrderPromo(res http.ResponseWriter, req *http.Request, orderID string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	log.Printf("promo param: %s", orderID)
+	oid, err := objectid.FromHex(orderID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	code := ""
+	switch req.Method {
+	case "POST":
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var body struct {
+			Code string `json:"code"`
+		}
+		err := decoder.Decode(&body)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		code = strings.ToUpper(strings.TrimSpace(body.Code))
+		if code == "" {
+			httpError("Code is required")
+			return
+		}
+	case "DELETE":
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+		return
+	}
+
+	var b *bill
+	err = runTxn(context.Background(), func(tx *txn) error {
+		var order orderRecord
+		err := tx.findOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &order)
+		if err == errNoDocument {
+			return fmt.Errorf("order %s not found", orderID)
+		}
+		if err != nil {
+			return err
+		}
+		if order.State != "" && order.State != orderOpen {
+			return fmt.Errorf("order is already %s", order.State)
+		}
+		order.Promo = code
+		b, err = priceOrder(tx, &order)
+		if err != nil {
+			return err
+		}
+		setter := bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("promo", code)))
+		_, err = tx.updateOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), setter)
+		return err
+	})
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(b)
+}
+
+// handlePromos manages the codes: /api/v1/promos[/{id}]. Changing them
+// takes an admin.
+func handlePromos(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "GET" {
+		if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	promoID := strings.TrimPrefix(req.URL.Path, "/api/v1/promos/")
+	switch req.Method {
+	case "GET": // list promos
+		cur, err := promosColl.Find(context.Background(), nil)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		defer cur.Close(context.Background())
+		list := make([]promotion, 0)
+		for cur.Next(context.Background()) {
+			var p promotion
+			err := cur.Decode(&p)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			p.IDStr = p.ID.Hex()
+			if p.StoreID != objectid.NilObjectID {
+				p.Store = p.StoreID.Hex()
+			}
+			list = append(list, p)
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case "PUT", "PATCH": // add promo, or replace its terms with id in path
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var p promotion
+		err := decoder.Decode(&p)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("promo: %+v\n", p)
+		if strings.TrimSpace(p.Code) == "" {
+			httpError("Code is required")
+			return
+		}
+		if err := p.validate(); err != nil {
+			httpError(err.Error())
+			return
+		}
+		if p.Store != "" {
+			p.StoreID, err = objectid.FromHex(p.Store)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		if req.Method == "PUT" {
+			inserter := bson.NewDocument(p.promoElements()...)
+			inserter.Append(bson.EC.Int32("uses", 0))
+			result, err := promosColl.InsertOne(context.Background(), inserter)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			res.Header().Set("Content-Type", "application/json")
+			if oid, ok := result.InsertedID.(objectid.ObjectID); ok {
+				json.NewEncoder(res).Encode(insert{oid.Hex()})
+			} else {
+				json.NewEncoder(res).Encode(result)
+			}
+			return
+		}
+		oid, err := objectid.FromHex(promoID)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid))
+		setter := bson.NewDocument(bson.EC.SubDocumentFromElements("$set", p.promoElements()...))
+		result, err := promosColl.UpdateOne(context.Background(), updater, setter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	case "DELETE": // delete promo, id in path
+		oid, err := objectid.FromHex(promoID)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		result, err := promosColl.DeleteOne(context.Background(), bson.NewDocument(bson.EC.ObjectID("_id", oid)))
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+	}
+}
+
+func setupPromos() {
+	promosColl = database.Collection("promotions")
+	redemptionsColl = database.Collection("promo_redemptions")
+
+	http.HandleFunc("/api/v1/promos", handlePromos)
+	http.HandleFunc("/api/v1/promos/", handlePromos)
+}
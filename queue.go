@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// The kitchen queue is a store's orders from submission to pickup. Staff
+// bump each order along: submitted, preparing, ready, done.
+
+// bumps is the state each queue state moves on to.
+var bumps = map[string]string{
+	orderSubmitted: orderPreparing,
+	orderPreparing: orderReady,
+	orderReady:     orderDone,
+}
+
+// queueStates are shown when the request doesn't pick.
+var queueStates = []string{orderSubmitted, orderPreparing, orderReady}
+
+type queueLine struct {
+	Item  string `json:"item"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type queueOrder struct {
+	ID      string      `json:"id"`
+	State   string      `json:"state"`
+	Started int64       `json:"started"` // when it was submitted
+	Changed int64       `json:"changed"` // when it got to State
+	Lines   []queueLine `json:"lines"`
+}
+
+func newQueueOrder(order *orderRecord) queueOrder {
+	q := queueOrder{
+		ID:      order.ID.Hex(),
+		State:   order.State,
+		Started: order.Started,
+		Changed: order.Started,
+		Lines:   make([]queueLine, 0, len(order.Lines)),
+	}
+	for _, event := range order.History {
+		if event.Event == order.State {
+			q.Changed = event.At
+		}
+	}
+	for _, line := range order.Lines {
+		q.Lines = append(q.Lines, queueLine{Item: line.Item.Hex(), Name: line.Name, Count: line.Count})
+	}
+	return q
+}
+
+// loadQueue is the store's orders in states, oldest first.
+func loadQueue(req *http.Request, store objectid.ObjectID, states []string) ([]queueOrder, error) {
+	values := make([]*bson.Value, 0, len(states))
+	for _, state := range states {
+		values = append(values, bson.VC.String(state))
+	}
+	ctx := req.Context()
+	cur, err := ordersColl.Find(ctx, bson.NewDocument(
+		bson.EC.ObjectID("store", store),
+		bson.EC.SubDocumentFromElements("state", bson.EC.ArrayFromElements("$in", values...)),
+	), findopt.Sort(bson.NewDocument(bson.EC.Int32("started", 1))))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	list := make([]queueOrder, 0)
+	for cur.Next(ctx) {
+		var order orderRecord
+		if err := cur.Decode(&order); err != nil {
+			return nil, err
+		}
+		list = append(list, newQueueOrder(&order))
+	}
+	return list, cur.Err()
+}
+
+// queueFilter reads ?state=submitted,preparing
+func queueFilter(req *http.Request) ([]string, error) {
+	param := req.URL.Query().Get("state")
+	if param == "" {
+		return queueStates, nil
+	}
+	states := strings.Split(param, ",")
+	for _, state := range states {
+		if _, ok := bumps[state]; !ok && state != orderDone {
+			return nil, fmt.Errorf("state %q isn't in the queue, use submitted, preparing, ready or done", state)
+		}
+	}
+	return states, nil
+}
+
+// bumpOrder moves an order at store on from the state it's in, or to a
+// given state further along. It's guarded on the state read so two tablets
+// bumping at once only move it once.
+func bumpOrder(tx *txn, store, oid objectid.ObjectID, to, who string) (*orderRecord, error) {
+	var order orderRecord
+	err := tx.findOne(ordersColl, bson.NewDocument(
+		bson.EC.ObjectID("_id", oid),
+		bson.EC.ObjectID("store", store),
+	), &order)
+	if err == errNoDocument {
+		return nil, fmt.Errorf("order %s isn't at this store", oid.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	next, ok := bumps[order.State]
+	if !ok {
+		return nil, fmt.Errorf("order is %s and isn't in the queue", order.State)
+	}
+	if to != "" && to != next {
+		// skipping ahead is fine, going back isn't
+		ahead := false
+		for s := next; s != ""; s = bumps[s] {
+			if s == to {
+				ahead = true
+				break
+			}
+		}
+		if !ahead {
+			return nil, fmt.Errorf("order is %s and can't go to %s", order.State, to)
+		}
+		next = to
+	}
+	now := time.Now().Unix()
+	matched, err := tx.updateOne(ordersColl,
+		bson.NewDocument(bson.EC.ObjectID("_id", oid), bson.EC.String("state", order.State)),
+		bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$set",
+				bson.EC.String("state", next),
+				bson.EC.Int64(next, now),
+			),
+			bson.EC.SubDocumentFromElements("$push", historyElement(next, who, "", "")),
+		))
+	if err != nil {
+		return nil, err
+	}
+	if matched == 0 {
+		return nil, fmt.Errorf("order was bumped concurrently")
+	}
+	order.State = next
+	order.History = append(order.History, orderEvent{At: now, Event: next, Actor: who})
+	if next == orderDone {
+		if err := addOutbox(tx, webhookOrderCompleted, store, oid, newQueueOrder(&order)); err != nil {
+			return nil, err
+		}
+	}
+	return &order, nil
+}
+
+// handleQueue is /api/v1/stores/{id}/queue for store staff. GET lists the
+// queue, ?state= picks which states (submitted, preparing and ready by
+// default), and GET /events streams it. POST /{order}/bump moves an order
+// on, {state} to skip ahead.
+func handleQueue(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	store, err := objectid.FromHex(storeID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	s, err := requireStaff(req, roleCashier, store)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case req.Method == "GET" && len(rest) == 0:
+		states, err := queueFilter(req)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		list, err := loadQueue(req, store, states)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case req.Method == "GET" && len(rest) == 1 && rest[0] == "events":
+		handleQueueEvents(res, req, store)
+
+	case req.Method == "POST" && len(rest) == 2 && rest[1] == "bump":
+		oid, err := objectid.FromHex(rest[0])
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		var body struct {
+			State string `json:"state"`
+		}
+		if req.ContentLength != 0 {
+			defer req.Body.Close()
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		var order *orderRecord
+		err = runTxn(req.Context(), func(tx *txn) error {
+			var err error
+			order, err = bumpOrder(tx, store, oid, body.State, actor(s))
+			return err
+		})
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		log.Printf("order %s bumped to %s by %s", rest[0], order.State, s.Name)
+		orderChanged(oid)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(newQueueOrder(order))
+
+	default:
+		httpError(fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path))
+	}
+}
+
+func setupQueue() {
+	storeRoutes["queue"] = handleQueue
+}
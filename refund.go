@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// orderEvent is an entry in an order's history: what happened, who did it
+// and why, and how much money moved if any.
+type orderEvent struct {
+	At     int64  `bson:"at" json:"at"`
+	Event  string `bson:"event" json:"event"`
+	Actor  string `bson:"actor" json:"actor"`
+	Note   string `bson:"note" json:"note,omitempty"`
+	Amount string `bson:"amount,omitempty" json:"amount,omitempty" schema:"money"`
+}
+
+// orderRefund is money given back on an order, for some of its lines or
+// just an amount. Lines is empty for a full refund or a plain amount.
+type orderRefund struct {
+	At      int64             `bson:"at"`
+	Actor   string            `bson:"actor"`
+	Reason  string            `bson:"reason"`
+	Amount  string            `bson:"amount" schema:"money"`
+	Lines   []refundLine      `bson:"lines"`
+	Payment objectid.ObjectID `bson:"payment"`
+	Ref     string            `bson:"ref"` // the provider's
+}
+
+type refundLine struct {
+	Item  objectid.ObjectID `bson:"item"`
+	Count int               `bson:"count"`
+}
+
+// historyElement goes in a $push to add an entry to the order's history.
+// amount is left out if it's empty.
+func historyElement(event, who, note, amount string) *bson.Element {
+	entry := bson.NewDocument(
+		bson.EC.Int64("at", time.Now().Unix()),
+		bson.EC.String("event", event),
+		bson.EC.String("actor", who),
+		bson.EC.String("note", note),
+	)
+	if amount != "" {
+		entry.Append(bson.EC.String("amount", amount))
+	}
+	return bson.EC.SubDocument("history", entry)
+}
+
+func refundElement(r *orderRefund) *bson.Element {
+	lines := make([]*bson.Value, 0, len(r.Lines))
+	for _, line := range r.Lines {
+		lines = append(lines, bson.VC.DocumentFromElements(
+			bson.EC.ObjectID("item", line.Item),
+			bson.EC.Int32("count", int32(line.Count)),
+		))
+	}
+	return bson.EC.SubDocumentFromElements("refunds",
+		bson.EC.Int64("at", r.At),
+		bson.EC.String("actor", r.Actor),
+		bson.EC.String("reason", r.Reason),
+		bson.EC.String("amount", r.Amount),
+		bson.EC.ArrayFromElements("lines", lines...),
+		bson.EC.ObjectID("payment", r.Payment),
+		bson.EC.String("ref", r.Ref),
+	)
+}
+
+// refundedElement guards an update on how much of the order had been
+// refunded when it was read.
+func refundedElement(refunded string) *bson.Element {
+	if refunded == "" {
+		return bson.EC.Null("refunded")
+	}
+	return bson.EC.String("refunded", refunded)
+}
+
+// refundOrder gives amount cents back on a captured payment of order and
+// records it. The order's refunded total is claimed before the provider is
+// called and put back if that fails, so two refunds can't give back more
+// than was paid between them.
+func refundOrder(ctx context.Context, order *orderRecord, amount int64, r *orderRefund) error {
+	list, err := orderPayments(ctx, order.ID)
+	if err != nil {
+		return err
+	}
+	var p *paymentRecord
+	for i := range list {
+		if list[i].State != paymentCaptured {
+			continue
+		}
+		captured, _ := parseCents(list[i].Captured)
+		refunded, _ := parseCents(list[i].Refunded)
+		if captured-refunded >= amount {
+			p = &list[i]
+			break
+		}
+	}
+	if p == nil {
+		return fmt.Errorf("order has no captured payment with %s left to refund", formatCents(amount))
+	}
+
+	total, err := parseCents(order.Total)
+	if err != nil {
+		return err
+	}
+	before, err := parseCents(order.Refunded)
+	if err != nil {
+		return err
+	}
+	after := formatCents(before + amount)
+	claim := func(from *bson.Element, to string) error {
+		result, err := ordersColl.UpdateOne(ctx,
+			bson.NewDocument(bson.EC.ObjectID("_id", order.ID), from),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("refunded", to))))
+		if err == nil && result.MatchedCount == 0 {
+			err = fmt.Errorf("order changed while refunding, try again")
+		}
+		return err
+	}
+	if err := claim(refundedElement(order.Refunded), after); err != nil {
+		return err
+	}
+	r.Ref, err = refundPayment(ctx, p, amount)
+	if err != nil {
+		if undoErr := claim(refundedElement(after), formatCents(before)); undoErr != nil {
+			log.Printf("order %s: refund failed and couldn't be put back: %s", order.ID.Hex(), undoErr)
+		}
+		return err
+	}
+
+	r.Payment = p.ID
+	r.Amount = formatCents(amount)
+	r.At = time.Now().Unix()
+	sets := bson.NewDocument()
+	if before+amount >= total && order.State != orderCancelled {
+		sets.Append(bson.EC.String("state", orderRefunded))
+	}
+	update := bson.NewDocument(bson.EC.SubDocumentFromElements("$push",
+		refundElement(r),
+		historyElement("refund", r.Actor, r.Reason, r.Amount),
+	))
+	if sets.Len() > 0 {
+		update.Append(bson.EC.SubDocument("$set", sets))
+	}
+	_, err = ordersColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", order.ID)), update)
+	if err != nil {
+		return fmt.Errorf("refunded %s but couldn't record it: %s", r.Amount, err)
+	}
+	order.Refunded = after
+	orderChanged(order.ID)
+	return nil
+}
+
+// settlePayments gives back whatever was paid on a cancelled order: holds
+// are voided and captured payments refunded in full.
+func settlePayments(ctx context.Context, oid objectid.ObjectID, who, reason string) error {
+	list, err := orderPayments(ctx, oid)
+	if err != nil {
+		return err
+	}
+	var order orderRecord
+	for i := range list {
+		p := &list[i]
+		switch p.State {
+		case paymentAuthorized:
+			if err := voidPayment(ctx, p); err != nil {
+				return err
+			}
+			_, err := ordersColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid)),
+				bson.NewDocument(bson.EC.SubDocumentFromElements("$push",
+					historyElement("void", who, reason, p.Amount))))
+			if err != nil {
+				return err
+			}
+			orderChanged(oid)
+		case paymentCaptured:
+			captured, _ := parseCents(p.Captured)
+			refunded, _ := parseCents(p.Refunded)
+			if captured == refunded {
+				continue
+			}
+			// read it again each time, refundOrder guards on it
+			err := ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&order)
+			if err != nil {
+				return err
+			}
+			err = refundOrder(ctx, &order, captured-refunded, &orderRefund{Actor: who, Reason: reason})
+			if err != nil {
+				return err
+			}
+		case paymentPending:
+			log.Printf("order %s cancelled with payment %s still pending", oid.Hex(), p.IDStr)
+		}
+	}
+	return nil
+}
+
+// handleOrderRefund is POST /api/v1/order/{id}/refund, for a manager.
+// {reason, lines: [{item, count}]} refunds those lines, their share of the
+// total after discounts and tax; {reason, amount} refunds an amount; just
+// {reason} refunds whatever is left.
+func handleOrderRefund(res http.ResponseWriter, req *http.Request, orderID string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "POST" {
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+		return
+	}
+	oid, err := objectid.FromHex(orderID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	decoder := json.NewDecoder(req.Body)
+	defer req.Body.Close()
+	var body struct {
+		Reason string      `json:"reason"`
+		Lines  []orderItem `json:"lines"`
+		Amount string      `json:"amount"`
+	}
+	err = decoder.Decode(&body)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	fmt.Printf("refund: %+v\n", body)
+	if strings.TrimSpace(body.Reason) == "" {
+		httpError("Reason is required")
+		return
+	}
+
+	ctx := req.Context()
+	var order orderRecord
+	err = ordersColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&order)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	s, err := requireStaff(req, roleManager, order.storeOID())
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	switch order.State {
+	case "", orderOpen, orderCancelled, orderRefunded:
+		httpError(fmt.Sprintf("Order is %s and can't be refunded", order.State))
+		return
+	}
+
+	total, _ := parseCents(order.Total)
+	refunded, _ := parseCents(order.Refunded)
+	left := total - refunded
+	r := &orderRefund{Actor: actor(s), Reason: body.Reason}
+	var amount int64
+	switch {
+	case len(body.Lines) > 0:
+		amount, r.Lines, err = linesRefund(&order, body.Lines)
+	case body.Amount != "":
+		amount, err = parseCents(body.Amount)
+	default:
+		amount = left
+	}
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	if amount > left && len(r.Lines) > 0 {
+		// clamping would record lines as refunded that weren't paid back
+		httpError(fmt.Sprintf("Those lines come to %s but only %s is left to refund", formatCents(amount), formatCents(left)))
+		return
+	}
+	if amount > left {
+		amount = left
+	}
+	if amount <= 0 {
+		httpError("Nothing left to refund")
+		return
+	}
+
+	err = refundOrder(ctx, &order, amount, r)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	log.Printf("order %s: %s refunded %s", orderID, r.Actor, r.Amount)
+	lines := make([]orderItem, 0, len(r.Lines))
+	for _, line := range r.Lines {
+		lines = append(lines, orderItem{Order: orderID, Item: line.Item.Hex(), Count: line.Count})
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(struct {
+		Order    string      `json:"order"`
+		Amount   string      `json:"amount"`
+		Refunded string      `json:"refunded"`
+		Lines    []orderItem `json:"lines"`
+		Payment  string      `json:"payment"`
+		Ref      string      `json:"ref"`
+	}{orderID, r.Amount, order.Refunded, lines, r.Payment.Hex(), r.Ref})
+}
+
+// linesRefund works out what refunding some of an order's lines comes to:
+// their share of the subtotal applied to the total, so discounts and tax
+// come off in proportion. Counts can't go past what was ordered, less what
+// was already refunded.
+func linesRefund(order *orderRecord, items []orderItem) (int64, []refundLine, error) {
+	done := make(map[objectid.ObjectID]int)
+	for _, r := range order.Refunds {
+		for _, line := range r.Lines {
+			done[line.Item] += line.Count
+		}
+	}
+	var sum int64
+	lines := make([]refundLine, 0, len(items))
+	for _, item := range items {
+		oid, err := objectid.FromHex(item.Item)
+		if err != nil {
+			return 0, nil, err
+		}
+		var ordered *orderLine
+		for i := range order.Lines {
+			if order.Lines[i].Item == oid {
+				ordered = &order.Lines[i]
+			}
+		}
+		if ordered == nil {
+			return 0, nil, fmt.Errorf("item %s isn't on the order", item.Item)
+		}
+		if item.Count <= 0 || item.Count > ordered.Count-done[oid] {
+			return 0, nil, fmt.Errorf("can refund up to %d of %s", ordered.Count-done[oid], ordered.Name)
+		}
+		done[oid] += item.Count
+		price, err := parseCents(ordered.Price)
+		if err != nil {
+			return 0, nil, err
+		}
+		sum += price * int64(item.Count)
+		lines = append(lines, refundLine{Item: oid, Count: item.Count})
+	}
+	subtotal, err := parseCents(order.Subtotal)
+	if err != nil || subtotal == 0 {
+		return 0, nil, err
+	}
+	total, err := parseCents(order.Total)
+	if err != nil {
+		return 0, nil, err
+	}
+	return (sum*total + subtotal/2) / subtotal, lines, nil
+}
+
+// handleOrderHistory is GET /api/v1/order/{id}/history
+func handleOrderHistory(res http.ResponseWriter, req *http.Request, orderID string) {
+	if req.Method != "GET" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	oid, err := objectid.FromHex(orderID)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	var order orderRecord
+	err = ordersColl.FindOne(context.Background(), bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&order)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	history := order.History
+	if history == nil {
+		history = make([]orderEvent, 0)
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(history)
+}
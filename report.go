@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// salesDay sums a store's orders over a day (or the whole report). Sales
+// are what submitted orders came to, tips included; cancelled orders are
+// only counted, refunds come off Net.
+type salesDay struct {
+	Day       string `json:"day,omitempty"`
+	Orders    int    `json:"orders"`
+	Cancelled int    `json:"cancelled"`
+	Subtotal  string `json:"subtotal"`
+	Discounts string `json:"discounts"`
+	Fees      string `json:"fees"`
+	Tax       string `json:"tax"`
+	Tips      string `json:"tips"`
+	Sales     string `json:"sales"`
+	Refunds   string `json:"refunds"`
+	Net       string `json:"net"`
+
+	subtotal, discounts, fees, tax, tips, sales, refunds int64
+}
+
+func (d *salesDay) add(order *orderRecord) {
+	if order.State == orderCancelled {
+		d.Cancelled++
+		// anything paid was given back, so it nets out
+		return
+	}
+	d.Orders++
+	cents := func(s string) int64 {
+		c, _ := parseCents(s)
+		return c
+	}
+	d.subtotal += cents(order.Subtotal)
+	for _, charge := range order.Discounts {
+		d.discounts += cents(charge.Amount)
+	}
+	for _, charge := range order.Fees {
+		d.fees += cents(charge.Amount)
+	}
+	for _, charge := range order.Tax {
+		d.tax += cents(charge.Amount)
+	}
+	for _, charge := range order.Tips {
+		d.tips += cents(charge.Amount)
+	}
+	d.sales += cents(order.Total)
+	d.refunds += cents(order.Refunded)
+}
+
+func (d *salesDay) format() {
+	d.Subtotal = formatCents(d.subtotal)
+	d.Discounts = formatCents(d.discounts)
+	d.Fees = formatCents(d.fees)
+	d.Tax = formatCents(d.tax)
+	d.Tips = formatCents(d.tips)
+	d.Sales = formatCents(d.sales)
+	d.Refunds = formatCents(d.refunds)
+	d.Net = formatCents(d.sales - d.refunds)
+}
+
+// handleSales is GET /api/v1/stores/{id}/sales?from=YYYY-MM-DD&to=YYYY-MM-DD,
+// both days inclusive in the store's time zone and defaulting to today.
+// Orders count on the day they were submitted. Needs a manager.
+func handleSales(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "GET" || len(rest) != 0 {
+		httpError(fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path))
+		return
+	}
+	store, err := objectid.FromHex(storeID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	if _, err := requireStaff(req, roleManager, store); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	ctx := req.Context()
+	loc, err := storeLocation(ctx, store)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	from, to, err := reportRange(req, loc)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+
+	cur, err := ordersColl.Find(ctx, bson.NewDocument(
+		bson.EC.ObjectID("store", store),
+		bson.EC.SubDocumentFromElements("started",
+			bson.EC.Int64("$gte", from.Unix()),
+			bson.EC.Int64("$lt", to.Unix()),
+		),
+	))
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	defer cur.Close(ctx)
+	total := &salesDay{}
+	days := make(map[string]*salesDay)
+	for cur.Next(ctx) {
+		var order orderRecord
+		if err := cur.Decode(&order); err != nil {
+			httpError(err.Error())
+			return
+		}
+		day := time.Unix(order.Started, 0).In(loc).Format(dateLayout)
+		if days[day] == nil {
+			days[day] = &salesDay{Day: day}
+		}
+		days[day].add(&order)
+		total.add(&order)
+	}
+	if err := cur.Err(); err != nil {
+		httpError(err.Error())
+		return
+	}
+
+	report := struct {
+		Store string      `json:"store"`
+		From  string      `json:"from"`
+		To    string      `json:"to"`
+		Total *salesDay   `json:"total"`
+		Days  []*salesDay `json:"days"`
+	}{storeID, from.Format(dateLayout), to.AddDate(0, 0, -1).Format(dateLayout), total, make([]*salesDay, 0, len(days))}
+	total.format()
+	for _, d := range days {
+		d.format()
+		report.Days = append(report.Days, d)
+	}
+	sort.Slice(report.Days, func(i, j int) bool { return report.Days[i].Day < report.Days[j].Day })
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(report)
+}
+
+// reportRange reads ?from= and ?to= as days in loc, and returns the start
+// of from and the start of the day after to.
+func reportRange(req *http.Request, loc *time.Location) (time.Time, time.Time, error) {
+	today := time.Now().In(loc).Format(dateLayout)
+	day := func(key string) (time.Time, error) {
+		value := req.URL.Query().Get(key)
+		if value == "" {
+			value = today
+		}
+		t, err := time.ParseInLocation(dateLayout, value, loc)
+		if err != nil {
+			return t, fmt.Errorf("%s must be a date like 2018-07-01", key)
+		}
+		return t, nil
+	}
+	from, err := day("from")
+	if err != nil {
+		return from, from, err
+	}
+	to, err := day("to")
+	if err != nil {
+		return from, to, err
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("to is before from")
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// tipShift is the tips taken over one shift on one day.
+type tipShift struct {
+	Day    string `json:"day"`
+	Shift  string `json:"shift"`
+	Orders int    `json:"orders"` // orders with a tip
+	Tips   string `json:"tips"`
+
+	tips int64
+}
+
+// handleTips is GET /api/v1/stores/{id}/tips?from=&to=, tips by day and
+// shift for payout, with the same range as the sales report. Cancelled and
+// fully refunded orders don't count. Needs a manager.
+func handleTips(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "GET" || len(rest) != 0 {
+		httpError(fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path))
+		return
+	}
+	oid, err := objectid.FromHex(storeID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	if _, err := requireStaff(req, roleManager, oid); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	ctx := req.Context()
+	var store Store
+	err = storesColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&store)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	loc := zoneOrUTC(store.TZ)
+	from, to, err := reportRange(req, loc)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+
+	cur, err := ordersColl.Find(ctx, bson.NewDocument(
+		bson.EC.ObjectID("store", oid),
+		bson.EC.SubDocumentFromElements("started",
+			bson.EC.Int64("$gte", from.Unix()),
+			bson.EC.Int64("$lt", to.Unix()),
+		),
+		bson.EC.SubDocumentFromElements("state", bson.EC.ArrayFromElements("$nin",
+			bson.VC.String(orderCancelled), bson.VC.String(orderRefunded))),
+		bson.EC.SubDocumentFromElements("tips.0", bson.EC.Boolean("$exists", true)),
+	))
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	defer cur.Close(ctx)
+	shifts := make(map[string]*tipShift)
+	var total int64
+	for cur.Next(ctx) {
+		var order orderRecord
+		if err := cur.Decode(&order); err != nil {
+			httpError(err.Error())
+			return
+		}
+		name, day := shiftAt(store.Shifts, time.Unix(order.Started, 0).In(loc))
+		key := day + "/" + name
+		if shifts[key] == nil {
+			shifts[key] = &tipShift{Day: day, Shift: name}
+		}
+		shifts[key].Orders++
+		for _, charge := range order.Tips {
+			cents, _ := parseCents(charge.Amount)
+			shifts[key].tips += cents
+			total += cents
+		}
+	}
+	if err := cur.Err(); err != nil {
+		httpError(err.Error())
+		return
+	}
+
+	report := struct {
+		Store  string      `json:"store"`
+		From   string      `json:"from"`
+		To     string      `json:"to"`
+		Tips   string      `json:"tips"`
+		Shifts []*tipShift `json:"shifts"`
+	}{storeID, from.Format(dateLayout), to.AddDate(0, 0, -1).Format(dateLayout), formatCents(total), make([]*tipShift, 0, len(shifts))}
+	for _, s := range shifts {
+		s.Tips = formatCents(s.tips)
+		report.Shifts = append(report.Shifts, s)
+	}
+	sort.Slice(report.Shifts, func(i, j int) bool {
+		a, b := report.Shifts[i], report.Shifts[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		return a.Shift < b.Shift
+	})
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(report)
+}
+
+func setupReports() {
+	storeRoutes["sales"] = handleSales
+	storeRoutes["tips"] = handleTips
+}
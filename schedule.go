@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// availWindow is one stretch of time a menu item can be ordered, read in the
+// store's time zone. Empty fields don't restrict anything, so a window with
+// only From/Until is every day, and one with only Start/End is all day for
+// a season. A From later than Until runs past midnight.
+type availWindow struct {
+	Days  []string `json:"days"`  // "mon" ... "sun"
+	From  string   `json:"from"`  // "06:00"
+	Until string   `json:"until"` // "11:00", exclusive
+	Start string   `json:"start"` // "2018-12-01"
+	End   string   `json:"end"`   // "2019-01-06", inclusive
+}
+
+const (
+	clockLayout = "15:04"
+	dateLayout  = "2006-01-02"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (w *availWindow) validate() error {
+	for _, day := range w.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			return fmt.Errorf("unknown day %q, use mon through sun", day)
+		}
+	}
+	for _, clock := range []*string{&w.From, &w.Until} {
+		if *clock == "" {
+			continue
+		}
+		t, err := time.Parse(clockLayout, *clock)
+		if err != nil {
+			return fmt.Errorf("time %q must look like 06:30", *clock)
+		}
+		*clock = t.Format(clockLayout) // "9:00" is "09:00"
+	}
+	for _, date := range []string{w.Start, w.End} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return fmt.Errorf("date %q must look like 2018-12-01", date)
+		}
+	}
+	if w.Start != "" && w.End != "" && w.End < w.Start {
+		return fmt.Errorf("window ends (%s) before it starts (%s)", w.End, w.Start)
+	}
+	return nil
+}
+
+// clockMinutes is a "15:04" clock as minutes after midnight, or def if
+// it's empty or doesn't parse.
+func clockMinutes(clock string, def int) int {
+	t, err := time.Parse(clockLayout, clock)
+	if err != nil {
+		return def
+	}
+	return t.Hour()*60 + t.Minute()
+}
+
+// span is the window's From and Until in minutes after midnight, until -1
+// if it has none, and whether local is in the early hours of a window
+// that runs past midnight, so belongs to the day before.
+func (w *availWindow) span(local time.Time) (from, until int, overnight, yesterday bool) {
+	from, until = clockMinutes(w.From, 0), clockMinutes(w.Until, -1)
+	overnight = until >= 0 && until <= from
+	yesterday = overnight && local.Hour()*60+local.Minute() < until
+	return from, until, overnight, yesterday
+}
+
+// contains reports whether local, already in the store's zone, falls inside
+// the window. Clocks are compared as minutes, not strings, so windows
+// saved before they were written out in full still work.
+func (w *availWindow) contains(local time.Time) bool {
+	date := local.Format(dateLayout)
+	if w.Start != "" && date < w.Start {
+		return false
+	}
+	if w.End != "" && date > w.End {
+		return false
+	}
+
+	day := local.Weekday()
+	clock := local.Hour()*60 + local.Minute()
+	from, until, overnight, yesterday := w.span(local)
+	if yesterday {
+		// the early hours belong to the window that opened yesterday
+		day = (day + 6) % 7
+	}
+	if len(w.Days) > 0 {
+		found := false
+		for _, d := range w.Days {
+			if weekdays[strings.ToLower(d)] == day {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	switch {
+	case overnight:
+		return clock >= from || clock < until
+	case until < 0:
+		return clock >= from
+	default:
+		return clock >= from && clock < until
+	}
+}
+
+// orderableAt reports whether an item with these windows can be ordered at
+// local. No windows means always.
+func orderableAt(windows []availWindow, local time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	for i := range windows {
+		if windows[i].contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAvail(windows []availWindow) error {
+	for i := range windows {
+		if err := windows[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func availElement(windows []availWindow) *bson.Element {
+	values := make([]*bson.Value, 0, len(windows))
+	for _, w := range windows {
+		doc := bson.NewDocument()
+		if len(w.Days) > 0 {
+			days := make([]*bson.Value, 0, len(w.Days))
+			for _, d := range w.Days {
+				days = append(days, bson.VC.String(strings.ToLower(d)))
+			}
+			doc.Append(bson.EC.ArrayFromElements("days", days...))
+		}
+		if w.From != "" {
+			doc.Append(bson.EC.String("from", w.From))
+		}
+		if w.Until != "" {
+			doc.Append(bson.EC.String("until", w.Until))
+		}
+		if w.Start != "" {
+			doc.Append(bson.EC.String("start", w.Start))
+		}
+		if w.End != "" {
+			doc.Append(bson.EC.String("end", w.End))
+		}
+		values = append(values, bson.VC.Document(doc))
+	}
+	return bson.EC.ArrayFromElements("avail", values...)
+}
+
+// storeLocation loads the store's time zone, UTC if it hasn't set one.
+func storeLocation(ctx context.Context, store objectid.ObjectID) (*time.Location, error) {
+	var s Store
+	err := storesColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", store))).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("store %s not found", store.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return zoneOrUTC(s.TZ), nil
+}
+
+func zoneOrUTC(tz string) *time.Location {
+	if tz == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Printf("bad store time zone %q, using UTC: %s", tz, err)
+		return time.UTC
+	}
+	return loc
+}
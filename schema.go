@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/core/command"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// The collections the handlers write field by field carry a $jsonSchema
+// validator generated from the structs they're read into. A field's BSON
+// type follows from its Go type and a schema tag adds what the type
+// can't say:
+//
+//	required      every document has it
+//	money         it's a decimal string like "2.00" or "-0.50", see parseCents
+//	price         money that can't be negative
+//	enum=a|b|c    it's one of these
+//
+// The validators are applied as the server starts, with validationLevel
+// moderate so documents that already fail don't block updates to them.
+// SCHEMA_VALIDATION is the validationAction, error (the default) or warn,
+// or off to leave the validators as they are.
+//
+//	tacos-api schema          apply the validators and list what fails them
+//	tacos-api schema check    only list what fails, failing if anything does
+
+// at least one digit, at most two of them after the point
+const (
+	moneyPattern = `^-?([0-9]+(\.[0-9]{0,2})?|\.[0-9]{1,2})$`
+	pricePattern = `^([0-9]+(\.[0-9]{0,2})?|\.[0-9]{1,2})$`
+)
+
+// schemaReportLimit is how many failing documents a report lists per
+// collection; they're all counted.
+const schemaReportLimit = 50
+
+var schemaColls = []struct {
+	coll  string
+	model reflect.Type
+}{
+	{"stores", reflect.TypeOf(Store{})},
+	{"menu_items", reflect.TypeOf(menuItem{})},
+	{"orders", reflect.TypeOf(orderRecord{})},
+	{"order_items", reflect.TypeOf(orderItemRecord{})},
+}
+
+var tObjectID = reflect.TypeOf(objectid.ObjectID{})
+
+// bsonKey is the key the driver stores a struct field under, "" if it
+// doesn't store it.
+func bsonKey(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag, ok := f.Tag.Lookup("bson")
+	if tag == "-" {
+		return ""
+	}
+	if name := strings.Split(tag, ",")[0]; ok && name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+func stringsElement(key string, values []string) *bson.Element {
+	vals := make([]*bson.Value, 0, len(values))
+	for _, value := range values {
+		vals = append(vals, bson.VC.String(value))
+	}
+	return bson.EC.ArrayFromElements(key, vals...)
+}
+
+// typeSchema is the schema for a value of Go type t. Pointers, slices and
+// maps may be null.
+func typeSchema(t reflect.Type) *bson.Document {
+	nullable := false
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+		nullable = true
+	}
+	var types []string
+	rest := make([]*bson.Element, 0)
+	switch t.Kind() {
+	case reflect.Struct:
+		if t == tObjectID {
+			types = []string{"objectId"}
+			break
+		}
+		types = []string{"object"}
+		properties, required := structSchema(t)
+		rest = append(rest, bson.EC.SubDocument("properties", properties))
+		if len(required) > 0 {
+			rest = append(rest, stringsElement("required", required))
+		}
+	case reflect.Slice:
+		types = []string{"array"}
+		nullable = true
+		rest = append(rest, bson.EC.SubDocument("items", typeSchema(t.Elem())))
+	case reflect.Map:
+		types = []string{"object"}
+		nullable = true
+		rest = append(rest, bson.EC.SubDocument("additionalProperties", typeSchema(t.Elem())))
+	case reflect.String:
+		types = []string{"string"}
+	case reflect.Bool:
+		types = []string{"bool"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		types = []string{"int", "long"}
+	case reflect.Float32, reflect.Float64:
+		types = []string{"number"}
+	default:
+		return bson.NewDocument()
+	}
+	if nullable {
+		types = append(types, "null")
+	}
+	schema := bson.NewDocument(stringsElement("bsonType", types))
+	return schema.Append(rest...)
+}
+
+// structSchema is the properties of a struct type, and which of them are
+// required.
+func structSchema(t reflect.Type) (*bson.Document, []string) {
+	properties := bson.NewDocument()
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := bsonKey(f)
+		if key == "" {
+			continue
+		}
+		schema := typeSchema(f.Type)
+		for _, opt := range strings.Split(f.Tag.Get("schema"), ",") {
+			switch {
+			case opt == "required":
+				required = append(required, key)
+			case opt == "money":
+				schema.Append(bson.EC.String("pattern", moneyPattern))
+			case opt == "price":
+				schema.Append(bson.EC.String("pattern", pricePattern))
+			case strings.HasPrefix(opt, "enum="):
+				schema.Append(stringsElement("enum", strings.Split(strings.TrimPrefix(opt, "enum="), "|")))
+			}
+		}
+		properties.Append(bson.EC.SubDocument(key, schema))
+	}
+	return properties, required
+}
+
+func bsonTypeName(v *bson.Value) string {
+	switch v.Type() {
+	case bson.TypeDouble:
+		return "double"
+	case bson.TypeString:
+		return "string"
+	case bson.TypeEmbeddedDocument:
+		return "object"
+	case bson.TypeArray:
+		return "array"
+	case bson.TypeObjectID:
+		return "objectId"
+	case bson.TypeBoolean:
+		return "bool"
+	case bson.TypeDateTime:
+		return "date"
+	case bson.TypeNull:
+		return "null"
+	case bson.TypeInt32:
+		return "int"
+	case bson.TypeInt64:
+		return "long"
+	case bson.TypeDecimal128:
+		return "decimal"
+	default:
+		return v.Type().String()
+	}
+}
+
+func schemaStrings(schema *bson.Document, key string) []string {
+	values := make([]string, 0)
+	v, err := schema.LookupErr(key)
+	if err != nil || v.Type() != bson.TypeArray {
+		return values
+	}
+	itr, err := v.MutableArray().Iterator()
+	if err != nil {
+		return values
+	}
+	for itr.Next() {
+		values = append(values, itr.Value().StringValue())
+	}
+	return values
+}
+
+func schemaPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// schemaProblems says why v doesn't match schema, the same way the server
+// would decide it, which doesn't say.
+func schemaProblems(schema *bson.Document, v *bson.Value, path string) []string {
+	name := bsonTypeName(v)
+	if types := schemaStrings(schema, "bsonType"); len(types) > 0 {
+		ok := false
+		for _, t := range types {
+			switch {
+			case t == name:
+				ok = true
+			case t == "number" && (name == "double" || name == "int" || name == "long" || name == "decimal"):
+				ok = true
+			}
+		}
+		if !ok {
+			return []string{fmt.Sprintf("%s is %s, not %s", path, name, strings.Join(types, " or "))}
+		}
+	}
+
+	problems := make([]string, 0)
+	if pattern, err := schema.LookupErr("pattern"); err == nil && name == "string" {
+		if !regexp.MustCompile(pattern.StringValue()).MatchString(v.StringValue()) {
+			problems = append(problems, fmt.Sprintf("%s is %q, which doesn't match %s", path, v.StringValue(), pattern.StringValue()))
+		}
+	}
+	if enum := schemaStrings(schema, "enum"); len(enum) > 0 && name == "string" {
+		ok := false
+		for _, value := range enum {
+			ok = ok || value == v.StringValue()
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s is %q, not one of %s", path, v.StringValue(), strings.Join(enum, ", ")))
+		}
+	}
+
+	switch name {
+	case "object":
+		doc := v.MutableDocument()
+		for _, key := range schemaStrings(schema, "required") {
+			if _, err := doc.LookupErr(key); err != nil {
+				problems = append(problems, schemaPath(path, key)+" is missing")
+			}
+		}
+		properties := subdocument(schema, "properties")
+		additional := subdocument(schema, "additionalProperties")
+		itr := doc.Iterator()
+		for itr.Next() {
+			elem := itr.Element()
+			fieldSchema := additional
+			if properties != nil {
+				if s := subdocument(properties, elem.Key()); s != nil {
+					fieldSchema = s
+				}
+			}
+			if fieldSchema != nil {
+				problems = append(problems, schemaProblems(fieldSchema, elem.Value(), schemaPath(path, elem.Key()))...)
+			}
+		}
+	case "array":
+		items := subdocument(schema, "items")
+		itr, err := v.MutableArray().Iterator()
+		if items == nil || err != nil {
+			break
+		}
+		for i := 0; itr.Next(); i++ {
+			problems = append(problems, schemaProblems(items, itr.Value(), fmt.Sprintf("%s.%d", path, i))...)
+		}
+	}
+	return problems
+}
+
+// schemaFailure is a document that fails its collection's validator.
+type schemaFailure struct {
+	coll     string
+	id       string
+	problems []string
+}
+
+func (f schemaFailure) String() string {
+	return fmt.Sprintf("%s %s: %s", f.coll, f.id, strings.Join(f.problems, "; "))
+}
+
+// failingDocuments counts the documents in coll that fail schema and
+// explains up to limit of them.
+func failingDocuments(ctx context.Context, coll string, schema *bson.Document, limit int64) (int64, []schemaFailure, error) {
+	filter := bson.NewDocument(bson.EC.ArrayFromElements("$nor",
+		bson.VC.DocumentFromElements(bson.EC.SubDocument("$jsonSchema", schema)),
+	))
+	failures := make([]schemaFailure, 0)
+	total, err := database.Collection(coll).Count(ctx, filter)
+	if err != nil || total == 0 || limit == 0 {
+		return total, failures, err
+	}
+	cur, err := database.Collection(coll).Find(ctx, filter, findopt.Limit(limit))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		doc := bson.NewDocument()
+		if err := cur.Decode(doc); err != nil {
+			return 0, nil, err
+		}
+		id := "(no _id)"
+		if elem, err := doc.LookupElementErr("_id"); err == nil {
+			id = elementJSON(elem)
+			if elem.Value().Type() == bson.TypeObjectID {
+				id = elem.Value().ObjectID().Hex()
+			}
+		}
+		problems := schemaProblems(schema, bson.VC.Document(doc), "")
+		if len(problems) == 0 {
+			problems = []string{"fails the validator"}
+		}
+		failures = append(failures, schemaFailure{coll, id, problems})
+	}
+	return total, failures, cur.Err()
+}
+
+// applySchema sets coll's validator, creating coll if it isn't there yet.
+func applySchema(ctx context.Context, coll string, schema *bson.Document, action string) error {
+	_, err := database.RunCommand(ctx, bson.NewDocument(bson.EC.String("create", coll)))
+	if e, ok := err.(command.Error); err != nil && !(ok && e.Code == 48) { // NamespaceExists
+		return err
+	}
+	_, err = database.RunCommand(ctx, bson.NewDocument(
+		bson.EC.String("collMod", coll),
+		bson.EC.SubDocumentFromElements("validator", bson.EC.SubDocument("$jsonSchema", schema)),
+		bson.EC.String("validationLevel", "moderate"),
+		bson.EC.String("validationAction", action),
+	))
+	return err
+}
+
+// dropSchema takes coll's validator off, for a migration down that writes
+// what it would reject. The next start or tacos-api schema puts it back.
+func dropSchema(ctx context.Context, coll string) error {
+	_, err := database.RunCommand(ctx, bson.NewDocument(
+		bson.EC.String("collMod", coll),
+		bson.EC.SubDocument("validator", bson.NewDocument()),
+	))
+	if e, ok := err.(command.Error); ok && e.Code == 26 { // NamespaceNotFound
+		return nil
+	}
+	return err
+}
+
+func schemaAction() (string, error) {
+	action := getEnv("SCHEMA_VALIDATION", "error")
+	switch action {
+	case "error", "warn", "off":
+		return action, nil
+	default:
+		return "", fmt.Errorf("bad SCHEMA_VALIDATION %q, want error, warn or off", action)
+	}
+}
+
+// runSchema is tacos-api schema ...
+func runSchema(ctx context.Context, args []string) error {
+	check := len(args) == 1 && args[0] == "check"
+	if len(args) > 0 && !check {
+		return fmt.Errorf("usage: tacos-api schema [check]")
+	}
+	action, err := schemaAction()
+	if err != nil {
+		return err
+	}
+	failing := int64(0)
+	for _, c := range schemaColls {
+		schema := typeSchema(c.model)
+		if !check && action != "off" {
+			if err := applySchema(ctx, c.coll, schema, action); err != nil {
+				return fmt.Errorf("applying the %s validator: %s", c.coll, err)
+			}
+			fmt.Printf("%s: validator applied, validationAction %s\n", c.coll, action)
+		}
+		total, failures, err := failingDocuments(ctx, c.coll, schema, schemaReportLimit)
+		if err != nil {
+			return fmt.Errorf("checking %s: %s", c.coll, err)
+		}
+		for _, f := range failures {
+			fmt.Println(f)
+		}
+		if total > int64(len(failures)) {
+			fmt.Printf("%s: and %d more\n", c.coll, total-int64(len(failures)))
+		}
+		failing += total
+	}
+	if check && failing > 0 {
+		return fmt.Errorf("%d documents fail validation", failing)
+	}
+	return nil
+}
+
+// setupSchemas applies the validators at startup, logging how many
+// documents fail them rather than refusing to start over it.
+func setupSchemas() error {
+	action, err := schemaAction()
+	if err != nil {
+		return err
+	}
+	if action == "off" {
+		return nil
+	}
+	ctx := context.Background()
+	for _, c := range schemaColls {
+		schema := typeSchema(c.model)
+		if err := applySchema(ctx, c.coll, schema, action); err != nil {
+			log.Printf("applying the %s validator: %s", c.coll, err)
+			continue
+		}
+		total, _, err := failingDocuments(ctx, c.coll, schema, 0)
+		if err != nil {
+			log.Printf("checking %s against its validator: %s", c.coll, err)
+			continue
+		}
+		if total > 0 {
+			log.Printf("%d %s fail validation, see tacos-api schema check", total, c.coll)
+		}
+	}
+	return nil
+}
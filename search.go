@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// searchHit is one store or menu item matching a search. Text scores come
+// from two collections with their own statistics, so mixing them by score
+// is approximate, but the weights are the same on both sides: names count
+// ten times as much as anything else.
+type searchHit struct {
+	Kind      string  `json:"kind"` // store or item
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Slug      string  `json:"slug"`
+	Store     string  `json:"store"`
+	StoreName string  `json:"store_name"`
+	Score     float64 `json:"score"`
+	Snippet   string  `json:"snippet"` // HTML, matches wrapped in <em>
+}
+
+const (
+	searchLimit   = 20
+	snippetLength = 120
+)
+
+// handleSearch is GET /api/v1/search?q=...; &type= narrows to a store type,
+// &city=, &state= and &zip= to a location, &limit= caps the results.
+func handleSearch(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "GET" {
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+		return
+	}
+	query := req.URL.Query()
+	q := strings.TrimSpace(query.Get("q"))
+	if q == "" {
+		httpError("q is required")
+		return
+	}
+	limit := searchLimit
+	if param := query.Get("limit"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 1 || n > 100 {
+			httpError("limit must be between 1 and 100")
+			return
+		}
+		limit = n
+	}
+	log.Printf("search: %s", q)
+
+	// the filters are on stores; items are filtered by which stores pass
+	storeFilter := bson.NewDocument()
+	for _, key := range []string{"type", "city", "state", "zip"} {
+		if value := query.Get(key); value != "" {
+			storeFilter.Append(bson.EC.String(key, value))
+		}
+	}
+	ctx := context.Background()
+
+	terms := searchTerms(q)
+	hits := make([]searchHit, 0)
+
+	textFilter := storeFilter.Copy().Append(textSearch(q), notDeleted())
+	cur, err := storesColl.Find(ctx, textFilter, textOptions(limit)...)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var store struct {
+			ID    objectid.ObjectID `bson:"_id"`
+			Name  string            `bson:"name"`
+			Slug  string            `bson:"slug"`
+			City  string            `bson:"city"`
+			Score float64           `bson:"score"`
+		}
+		if err := cur.Decode(&store); err != nil {
+			httpError(err.Error())
+			return
+		}
+		hits = append(hits, searchHit{
+			Kind:      "store",
+			ID:        store.ID.Hex(),
+			Name:      store.Name,
+			Slug:      store.Slug,
+			Store:     store.ID.Hex(),
+			StoreName: store.Name,
+			Score:     store.Score,
+			Snippet:   highlight(strings.Join([]string{store.Name, store.City}, ", "), terms),
+		})
+	}
+	if err := cur.Err(); err != nil {
+		httpError(err.Error())
+		return
+	}
+
+	itemFilter := bson.NewDocument(textSearch(q), notDeleted())
+	if storeFilter.Len() > 0 {
+		ids, err := searchStoreIDs(ctx, storeFilter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		itemFilter.Append(bson.EC.SubDocumentFromElements("store", bson.EC.ArrayFromElements("$in", ids...)))
+	}
+	items, err := menuItemsColl.Find(ctx, itemFilter, textOptions(limit)...)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	defer items.Close(ctx)
+	itemStores := make([]objectid.ObjectID, 0)
+	for items.Next(ctx) {
+		var item struct {
+			ID    objectid.ObjectID `bson:"_id"`
+			Store objectid.ObjectID `bson:"store"`
+			Name  string            `bson:"name"`
+			Slug  string            `bson:"slug"`
+			Descr string            `bson:"descr"`
+			Score float64           `bson:"score"`
+		}
+		if err := items.Decode(&item); err != nil {
+			httpError(err.Error())
+			return
+		}
+		text := item.Descr
+		if !containsTerm(text, terms) {
+			text = item.Name
+		}
+		hits = append(hits, searchHit{
+			Kind:    "item",
+			ID:      item.ID.Hex(),
+			Name:    item.Name,
+			Slug:    item.Slug,
+			Store:   item.Store.Hex(),
+			Score:   item.Score,
+			Snippet: highlight(text, terms),
+		})
+		itemStores = append(itemStores, item.Store)
+	}
+	if err := items.Err(); err != nil {
+		httpError(err.Error())
+		return
+	}
+	names, err := storeNames(ctx, itemStores)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	for i := range hits {
+		if hits[i].Kind == "item" {
+			hits[i].StoreName = names[hits[i].Store]
+		}
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(hits)
+}
+
+// searchStoreIDs is the ids of the stores passing filter, to filter items by.
+func searchStoreIDs(ctx context.Context, filter *bson.Document) ([]*bson.Value, error) {
+	cur, err := storesColl.Find(ctx, filter.Copy().Append(notDeleted()),
+		findopt.Projection(bson.NewDocument(bson.EC.Int32("_id", 1))))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	ids := make([]*bson.Value, 0)
+	for cur.Next(ctx) {
+		var store struct {
+			ID objectid.ObjectID `bson:"_id"`
+		}
+		if err := cur.Decode(&store); err != nil {
+			return nil, err
+		}
+		ids = append(ids, bson.VC.ObjectID(store.ID))
+	}
+	return ids, cur.Err()
+}
+
+// storeNames is the names of the stores in oids, by hex id.
+func storeNames(ctx context.Context, oids []objectid.ObjectID) (map[string]string, error) {
+	names := make(map[string]string)
+	if len(oids) == 0 {
+		return names, nil
+	}
+	ids := make([]*bson.Value, 0, len(oids))
+	for _, oid := range oids {
+		ids = append(ids, bson.VC.ObjectID(oid))
+	}
+	cur, err := storesColl.Find(ctx,
+		bson.NewDocument(bson.EC.SubDocumentFromElements("_id", bson.EC.ArrayFromElements("$in", ids...))),
+		findopt.Projection(bson.NewDocument(bson.EC.Int32("name", 1))))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var store struct {
+			ID   objectid.ObjectID `bson:"_id"`
+			Name string            `bson:"name"`
+		}
+		if err := cur.Decode(&store); err != nil {
+			return nil, err
+		}
+		names[store.ID.Hex()] = store.Name
+	}
+	return names, cur.Err()
+}
+
+func textSearch(q string) *bson.Element {
+	return bson.EC.SubDocumentFromElements("$text", bson.EC.String("$search", q))
+}
+
+func textOptions(limit int) []findopt.Find {
+	score := bson.NewDocument(bson.EC.SubDocumentFromElements("score", bson.EC.String("$meta", "textScore")))
+	return []findopt.Find{
+		findopt.Projection(score),
+		findopt.Sort(score.Copy()),
+		findopt.Limit(int64(limit)),
+	}
+}
+
+// searchTerms picks the words out of a query the way $text does, minus
+// negated ones, lower-cased and with a plural s dropped so "tacos" finds
+// "taco".
+func searchTerms(q string) []string {
+	terms := make([]string, 0)
+	for _, word := range strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-'
+	}) {
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		word = strings.ToLower(strings.Trim(word, "-"))
+		if len(word) > 3 {
+			word = strings.TrimSuffix(word, "s")
+		}
+		if word != "" {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+func containsTerm(text string, terms []string) bool {
+	lower := strings.ToLower(text)
+	for _, term := range terms {
+		if strings.Contains(lower, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// highlight cuts a snippet of text around the first match and wraps every
+// word starting with a term in <em>. The text is escaped, the result is
+// safe to drop into a page. Offsets are in runes, not bytes, so a cut
+// never lands inside a multi-byte character.
+func highlight(text string, terms []string) string {
+	runes := []rune(text)
+	// lower-cased rune by rune so it lines up with runes, strings.ToLower
+	// can change the length
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	start := -1
+	for _, term := range terms {
+		if i := runeIndex(lower, []rune(term)); i >= 0 && (start < 0 || i < start) {
+			start = i
+		}
+	}
+	prefix, suffix := "", ""
+	if len(runes) > snippetLength {
+		from := 0
+		if start > snippetLength/3 {
+			from = start - snippetLength/3
+			// don't cut a word in half
+			for from < start && runes[from-1] != ' ' {
+				from++
+			}
+			prefix = "…"
+		}
+		to := from + snippetLength
+		if to < len(runes) {
+			// back to a space if there's one, text without any (a URL,
+			// Chinese) is cut where it is
+			for cut := to; cut > from; cut-- {
+				if runes[cut] == ' ' {
+					to = cut
+					break
+				}
+			}
+			suffix = "…"
+		} else {
+			to = len(runes)
+		}
+		text = string(runes[from:to])
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	word := make([]rune, 0)
+	flush := func() {
+		w := string(word)
+		match := false
+		for _, term := range terms {
+			if strings.HasPrefix(strings.ToLower(w), term) {
+				match = true
+				break
+			}
+		}
+		if match {
+			b.WriteString("<em>" + html.EscapeString(w) + "</em>")
+		} else {
+			b.WriteString(html.EscapeString(w))
+		}
+		word = word[:0]
+	}
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			word = append(word, r)
+			continue
+		}
+		flush()
+		b.WriteString(html.EscapeString(string(r)))
+	}
+	flush()
+	b.WriteString(suffix)
+	return b.String()
+}
+
+// runeIndex is strings.Index for runes.
+func runeIndex(s, sub []rune) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		match := true
+		for j := range sub {
+			if s[i+j] != sub[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+func setupSearch() {
+	http.HandleFunc("/api/v1/search", handleSearch)
+}
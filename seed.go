@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// The demo stores, loaded by tacos-api migrate seed. Stores are found by
+// slug and items by slug within their store, and only what isn't there
+// yet is added, so seeding again changes nothing, even after edits.
+
+type seedStore struct {
+	Type, Name, Address, City, State, Zip string
+	Items                                 []seedItem
+}
+
+type seedItem struct {
+	Type, Name, Descr, Price string
+}
+
+var seedStores = []seedStore{
+	{
+		Type: "tacos", Name: "Silly Tacos", Address: "222 Taco Terrace", City: "Nashua", State: "NH", Zip: "03062",
+		Items: []seedItem{
+			{"base", "Soft taco shell", "Our soft taco shell is made from 100% hand-spun artisinal bleached paperboard", "1.00"},
+			{"base", "Hard taco shell", "", ".50"},
+			{"base", "Bowl", "", ".00"},
+			{"filling", "Chicken", "", "2.00"},
+			{"filling", "Beef", "", "2.00"},
+			{"filling", "Fish", "", "3.00"},
+			{"topping", "Mild salsa", "", ".00"},
+			{"topping", "Hot salsa", "", ".00"},
+			{"topping", "Cheese", "", ".00"},
+			{"topping", "Lettuce", "", ".00"},
+		},
+	},
+	{
+		Type: "icecream", Name: "Chilly Willy", Address: "Fifteen Frozen Blvd", City: "Nashua", State: "NH", Zip: "03062",
+		Items: []seedItem{
+			{"base", "Plain cone", "", "1.00"},
+			{"base", "Sugar cone", "", "1.00"},
+			{"base", "Bowl", "", ".00"},
+			{"filling", "Vanilla scoop", "", "2.00"},
+			{"filling", "Chocolate scoop", "", "2.00"},
+			{"filling", "Coffee scoop", "", "2.00"},
+			{"topping", "Whipped cream", "", ".50"},
+			{"topping", "Nuts", "", ".50"},
+			{"topping", "Cherry", "A cherry on top - of course you deserve it!", ".00"},
+			{"topping", "Chocolate sprinkles", "", ".00"},
+			{"topping", "Rainbow sprinkles", "", ".00"},
+		},
+	},
+	{
+		Type: "other", Name: "Bob's Burgers", Address: "3 Pickle Place", City: "Nashua", State: "NH", Zip: "03062",
+		Items: []seedItem{
+			{"base", "Sesame seed bun", "", ".50"},
+			{"base", "Gluten free bun", "", "1.00"},
+			{"filling", "100% beef patty", "", "4.00"},
+			{"filling", "Veggie burger", "", "4.00"},
+			{"topping", "Cheese", "", ".25"},
+			{"topping", "Relish", "", ".00"},
+			{"topping", "Onion, chopped", "", ".00"},
+		},
+	},
+}
+
+// seedUpsert adds doc unless filter finds it, true if it did.
+func seedUpsert(ctx context.Context, coll string, filter, doc *bson.Document) (bool, error) {
+	result, err := database.Collection(coll).UpdateOne(ctx, filter,
+		bson.NewDocument(bson.EC.SubDocument("$setOnInsert", doc)),
+		updateopt.Upsert(true))
+	if err != nil {
+		return false, err
+	}
+	return result.UpsertedID != nil, nil
+}
+
+func seedDemo(ctx context.Context) error {
+	stores, items := 0, 0
+	for _, s := range seedStores {
+		slug := slugify(s.Name)
+		added, err := seedUpsert(ctx, "stores", bson.NewDocument(bson.EC.String("slug", slug)), bson.NewDocument(
+			bson.EC.String("type", s.Type),
+			bson.EC.String("name", s.Name),
+			bson.EC.String("slug", slug),
+			bson.EC.String("address", s.Address),
+			bson.EC.String("city", s.City),
+			bson.EC.String("state", s.State),
+			bson.EC.String("zip", s.Zip),
+		))
+		if err != nil {
+			return err
+		}
+		if added {
+			stores++
+		}
+		var store struct {
+			ID objectid.ObjectID `bson:"_id"`
+		}
+		err = database.Collection("stores").FindOne(ctx, bson.NewDocument(bson.EC.String("slug", slug))).Decode(&store)
+		if err != nil {
+			return err
+		}
+		for _, item := range s.Items {
+			itemSlug := slugify(item.Name)
+			added, err := seedUpsert(ctx, "menu_items",
+				bson.NewDocument(bson.EC.ObjectID("store", store.ID), bson.EC.String("slug", itemSlug)),
+				bson.NewDocument(
+					bson.EC.ObjectID("store", store.ID),
+					bson.EC.String("type", item.Type),
+					bson.EC.String("name", item.Name),
+					bson.EC.String("slug", itemSlug),
+					bson.EC.String("descr", item.Descr),
+					bson.EC.String("price", item.Price),
+				))
+			if err != nil {
+				return err
+			}
+			if added {
+				items++
+			}
+		}
+	}
+	log.Printf("seeded %d stores and %d menu items, the rest were there already", stores, items)
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// Stores and menu items get a slug from their name when they're created.
+// Store slugs are unique overall, item slugs within their store. A slug
+// stays put when the name changes; changing it on purpose with PATCH moves
+// the old one into old_slugs, and lookups by an old slug redirect.
+
+// reservedItemSlugs are paths under /api/v1/stores/{id}/menu/ that aren't
+// items.
+var reservedItemSlugs = map[string]bool{"import": true, "export": true}
+
+// slugFolds spells the common accented Latin letters in ASCII.
+var slugFolds = []struct{ from, to string }{
+	{"àáâãäåāăą", "a"}, {"çćĉċč", "c"}, {"ďđð", "d"}, {"èéêëēĕėęě", "e"},
+	{"ĝğġģ", "g"}, {"ĥħ", "h"}, {"ìíîïĩīĭįı", "i"}, {"ĵ", "j"}, {"ķ", "k"},
+	{"ĺļľŀł", "l"}, {"ñńņňŉ", "n"}, {"òóôõöøōŏő", "o"}, {"ŕŗř", "r"},
+	{"śŝşšș", "s"}, {"ţťŧț", "t"}, {"ùúûüũūŭůűų", "u"}, {"ŵ", "w"},
+	{"ýÿŷ", "y"}, {"źżž", "z"},
+	{"æ", "ae"}, {"œ", "oe"}, {"ß", "ss"}, {"þ", "th"},
+}
+
+func slugFold(r rune) (string, bool) {
+	if r < unicode.MaxASCII {
+		return "", false
+	}
+	for _, fold := range slugFolds {
+		if strings.ContainsRune(fold.from, r) {
+			return fold.to, true
+		}
+	}
+	return "", false
+}
+
+// slugify turns "Bob's Burgers" into "bobs-burgers" and "Jalapeño
+// Poppers" into "jalapeno-poppers". Letters it can't spell in ASCII are
+// dropped like punctuation.
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		fold, folds := slugFold(r)
+		switch {
+		case folds || r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			if folds {
+				b.WriteString(fold)
+			} else {
+				b.WriteRune(r)
+			}
+		case r == '\'' || r == '’':
+			// keep "bobs" together
+		default:
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// uniqueSlug finds a free slug for name in coll, among the documents that
+// match scope. skip is the document being changed, which may keep its own;
+// a name with nothing to make a slug from gets skip's id as one.
+func uniqueSlug(ctx context.Context, coll *mongo.Collection, scope *bson.Document, name string, skip objectid.ObjectID) (string, error) {
+	base := slugify(name)
+	if base == "" && skip != objectid.NilObjectID {
+		base = skip.Hex()
+	}
+	if base == "" {
+		return "", fmt.Errorf("can't make a slug from %q", name)
+	}
+	for n := 1; ; n++ {
+		slug := base
+		if n > 1 {
+			slug = fmt.Sprintf("%s-%d", base, n)
+		}
+		if coll == menuItemsColl && reservedItemSlugs[slug] {
+			continue
+		}
+		filter := scope.Copy().Append(
+			bson.EC.SubDocumentFromElements("_id", bson.EC.ObjectID("$ne", skip)),
+			bson.EC.ArrayFromElements("$or",
+				bson.VC.DocumentFromElements(bson.EC.String("slug", slug)),
+				bson.VC.DocumentFromElements(bson.EC.String("old_slugs", slug)),
+			),
+		)
+		count, err := coll.Count(ctx, filter)
+		if err != nil {
+			return "", err
+		}
+		if count == 0 {
+			return slug, nil
+		}
+	}
+}
+
+// slugHistory goes alongside the $set of a new slug and keeps the old one
+// around for redirects.
+func slugHistory(old string) *bson.Element {
+	return bson.EC.SubDocumentFromElements("$addToSet", bson.EC.String("old_slugs", old))
+}
+
+// findBySlug finds the document in scope whose slug, current or old, is
+// slug. moved is set when it was an old one.
+func findBySlug(ctx context.Context, coll *mongo.Collection, scope *bson.Document, slug string, out interface{}) (moved bool, err error) {
+	filter := scope.Copy().Append(bson.EC.String("slug", slug))
+	err = coll.FindOne(ctx, filter).Decode(out)
+	if err != mongo.ErrNoDocuments {
+		return false, err
+	}
+	filter = scope.Copy().Append(bson.EC.String("old_slugs", slug))
+	err = coll.FindOne(ctx, filter).Decode(out)
+	return err == nil, err
+}
+
+// resolveStore takes a store id or slug from req's path. A soft-deleted
+// store isn't found unless req asked for ?include_deleted=true.
+func resolveStore(req *http.Request, idOrSlug string) (*Store, bool, error) {
+	ctx := req.Context()
+	var store Store
+	moved, err := findBySlug(ctx, storesColl, liveFilter(req, bson.NewDocument()), idOrSlug, &store)
+	if err == mongo.ErrNoDocuments {
+		oid, hexErr := objectid.FromHex(idOrSlug)
+		if hexErr != nil {
+			return nil, false, fmt.Errorf("store %s not found", idOrSlug)
+		}
+		err = storesColl.FindOne(ctx, liveFilter(req, bson.NewDocument(bson.EC.ObjectID("_id", oid)))).Decode(&store)
+		if err == mongo.ErrNoDocuments {
+			return nil, false, fmt.Errorf("store %s not found", idOrSlug)
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	store.IDStr = store.ID.Hex()
+	return &store, moved, nil
+}
+
+// handleStoreBySlug is GET /api/v1/stores/by-slug/{slug}
+func handleStoreBySlug(res http.ResponseWriter, req *http.Request, slug string) {
+	if req.Method != "GET" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	log.Printf("slug param: %s", slug)
+	var store Store
+	moved, err := findBySlug(context.Background(), storesColl, liveFilter(req, bson.NewDocument()), slug, &store)
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(res, req)
+		return
+	}
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	if moved {
+		http.Redirect(res, req, "/api/v1/stores/by-slug/"+store.Slug, http.StatusMovedPermanently)
+		return
+	}
+	store.IDStr = store.ID.Hex()
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(store)
+}
+
+// handleStoreMenu is GET /api/v1/stores/{slug}/menu/{itemSlug}, either slug
+// may be an old one or an id. The menu's import and export are here too.
+func handleStoreMenu(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+	if len(rest) == 1 && reservedItemSlugs[rest[0]] {
+		handleMenuTransfer(res, req, storeID, rest[0])
+		return
+	}
+
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "GET" || len(rest) != 1 {
+		httpError(fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path))
+		return
+	}
+	store, storeMoved, err := resolveStore(req, storeID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	var item menuItem
+	scope := liveFilter(req, bson.NewDocument(bson.EC.ObjectID("store", store.ID)))
+	itemMoved, err := findBySlug(context.Background(), menuItemsColl, scope, rest[0], &item)
+	if err == mongo.ErrNoDocuments {
+		oid, hexErr := objectid.FromHex(rest[0])
+		if hexErr != nil {
+			http.NotFound(res, req)
+			return
+		}
+		itemMoved = true
+		err = menuItemsColl.FindOne(context.Background(), scope.Append(bson.EC.ObjectID("_id", oid))).Decode(&item)
+	}
+	if err == mongo.ErrNoDocuments {
+		http.NotFound(res, req)
+		return
+	}
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	if (storeMoved || itemMoved || storeID != store.Slug) && store.Slug != "" && item.Slug != "" {
+		http.Redirect(res, req, fmt.Sprintf("/api/v1/stores/%s/menu/%s", store.Slug, item.Slug), http.StatusMovedPermanently)
+		return
+	}
+	item.fill()
+	item.Images = imageURLs(item.Images)
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(item)
+}
+
+// backfillSlugs gives documents from before slugs one, so the unique
+// indexes cover everything. It's migration 1.
+func backfillSlugs(ctx context.Context) error {
+	missing := bson.NewDocument(bson.EC.SubDocumentFromElements("slug", bson.EC.Boolean("$exists", false)))
+	cur, err := storesColl.Find(ctx, missing)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var store Store
+		if err := cur.Decode(&store); err != nil {
+			return err
+		}
+		slug, err := uniqueSlug(ctx, storesColl, bson.NewDocument(), store.Name, store.ID)
+		if err != nil {
+			log.Printf("store %s: %s", store.ID.Hex(), err)
+			continue
+		}
+		_, err = storesColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", store.ID)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("slug", slug))))
+		if err != nil {
+			return err
+		}
+	}
+	if err := cur.Err(); err != nil {
+		return err
+	}
+
+	items, err := menuItemsColl.Find(ctx, missing)
+	if err != nil {
+		return err
+	}
+	defer items.Close(ctx)
+	for items.Next(ctx) {
+		var item struct {
+			ID    objectid.ObjectID `bson:"_id"`
+			Store objectid.ObjectID `bson:"store"`
+			Name  string            `bson:"name"`
+		}
+		if err := items.Decode(&item); err != nil {
+			return err
+		}
+		scope := bson.NewDocument(bson.EC.ObjectID("store", item.Store))
+		slug, err := uniqueSlug(ctx, menuItemsColl, scope, item.Name, item.ID)
+		if err != nil {
+			log.Printf("menu item %s: %s", item.ID.Hex(), err)
+			continue
+		}
+		_, err = menuItemsColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", item.ID)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.String("slug", slug))))
+		if err != nil {
+			return err
+		}
+	}
+	return items.Err()
+}
+
+func setupSlugs() {
+	storeRoutes["menu"] = handleStoreMenu
+}
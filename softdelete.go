@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// DELETE doesn't remove stores and menu items, it sets their deleted_at
+// (unix seconds) and they drop out of listings, menus and search; orders
+// keep pointing at something. ?include_deleted=true lists them anyway and
+// POST .../restore brings one back. By default deleting a store deletes
+// its items along with it, at the same second, and restoring the store
+// restores those but not items deleted before it; see integrity.go for the
+// other policies. The purge job removes for good whatever was deleted over
+// SOFT_DELETE_RETENTION ago (720h, 0 keeps everything). Purging goes by the
+// same policies, and under the default restrict ones a store or menu item
+// that was ever ordered, even once long ago, is never purged: the retention
+// only clears what no order points at. Orders aren't purged, so that's for
+// good unless orders.store and order_items.item are made cascade, which
+// takes the order history with them.
+
+const purgeEvery = time.Hour
+
+// notDeleted filters out soft-deleted documents; null matches a missing
+// deleted_at too.
+func notDeleted() *bson.Element {
+	return bson.EC.Null("deleted_at")
+}
+
+// liveFilter is filter without soft-deleted documents, unless req asked
+// for ?include_deleted=true.
+func liveFilter(req *http.Request, filter *bson.Document) *bson.Document {
+	if req.URL.Query().Get("include_deleted") == "true" {
+		return filter
+	}
+	return filter.Append(notDeleted())
+}
+
+func deletedSetter(at int64) *bson.Document {
+	return bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Int64("deleted_at", at)))
+}
+
+func restoredSetter() *bson.Document {
+	return bson.NewDocument(bson.EC.SubDocumentFromElements("$unset", bson.EC.String("deleted_at", "")))
+}
+
+// softDeleteItem marks a menu item deleted, 0 if there's no such item or
+// it already is. What points at it follows its policy, see integrity.go.
+func softDeleteItem(tx *txn, oid objectid.ObjectID) (int64, error) {
+	store, err := itemStore(tx, oid)
+	if err == errNoDocument {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	deleted, err := tx.updateOne(menuItemsColl,
+		bson.NewDocument(bson.EC.ObjectID("_id", oid), notDeleted()),
+		deletedSetter(now))
+	if err != nil || deleted == 0 {
+		return 0, err
+	}
+	if err := deleteRefs(tx, menuItemsColl, oid, now); err != nil {
+		return 0, err
+	}
+	return deleted, menuChanged(tx, store, oid, "deleted")
+}
+
+// softDeleteStore marks a store deleted, 0 if there's no such store or it
+// already is. Its menu items and orders follow their policies.
+func softDeleteStore(tx *txn, oid objectid.ObjectID) (int64, error) {
+	now := time.Now().Unix()
+	deleted, err := tx.updateOne(storesColl,
+		bson.NewDocument(bson.EC.ObjectID("_id", oid), notDeleted()),
+		deletedSetter(now))
+	if err != nil || deleted == 0 {
+		return 0, err
+	}
+	return deleted, deleteRefs(tx, storesColl, oid, now)
+}
+
+// restoreStore brings back a deleted store and the items deleted with it.
+func restoreStore(tx *txn, oid objectid.ObjectID) error {
+	var store struct {
+		DeletedAt int64 `bson:"deleted_at"`
+	}
+	err := tx.findOne(storesColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &store)
+	if err == errNoDocument {
+		return fmt.Errorf("store %s not found", oid.Hex())
+	}
+	if err != nil {
+		return err
+	}
+	if store.DeletedAt == 0 {
+		return fmt.Errorf("store %s isn't deleted", oid.Hex())
+	}
+	_, err = tx.updateOne(storesColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), restoredSetter())
+	if err != nil {
+		return err
+	}
+	items, err := tx.find(menuItemsColl, bson.NewDocument(
+		bson.EC.ObjectID("store", oid),
+		bson.EC.Int64("deleted_at", store.DeletedAt),
+	))
+	if err != nil {
+		return err
+	}
+	for _, rdr := range items {
+		var item menuItem
+		if err := bson.Unmarshal(rdr, &item); err != nil {
+			return err
+		}
+		_, err := tx.updateOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", item.ID)), restoredSetter())
+		if err != nil {
+			return err
+		}
+		if err := menuChanged(tx, oid, item.ID, "restored"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreItem brings back a deleted menu item, if its store isn't deleted.
+func restoreItem(tx *txn, oid objectid.ObjectID) error {
+	var item struct {
+		Store     objectid.ObjectID `bson:"store"`
+		DeletedAt int64             `bson:"deleted_at"`
+	}
+	err := tx.findOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &item)
+	if err == errNoDocument {
+		return fmt.Errorf("menu item %s not found", oid.Hex())
+	}
+	if err != nil {
+		return err
+	}
+	if item.DeletedAt == 0 {
+		return fmt.Errorf("menu item %s isn't deleted", oid.Hex())
+	}
+	if item.Store != objectid.NilObjectID {
+		var store struct {
+			DeletedAt int64 `bson:"deleted_at"`
+		}
+		err := tx.findOne(storesColl, bson.NewDocument(bson.EC.ObjectID("_id", item.Store)), &store)
+		if err != nil && err != errNoDocument {
+			return err
+		}
+		if store.DeletedAt != 0 {
+			return fmt.Errorf("store %s is deleted, restore it first", item.Store.Hex())
+		}
+	}
+	_, err = tx.updateOne(menuItemsColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), restoredSetter())
+	if err != nil {
+		return err
+	}
+	return menuChanged(tx, item.Store, oid, "restored")
+}
+
+// handleRestore is POST /api/v1/stores/{id}/restore and POST
+// /api/v1/menu/{id}/restore.
+func handleRestore(res http.ResponseWriter, req *http.Request, coll *mongo.Collection, id string) {
+	if req.Method != "POST" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), 405)
+		return
+	}
+	oid, err := objectid.FromHex(id)
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	err = runTxn(context.Background(), func(tx *txn) error {
+		before, err := auditBefore(tx, coll, oid)
+		if err != nil {
+			return err
+		}
+		if coll == storesColl {
+			err = restoreStore(tx, oid)
+		} else {
+			err = restoreItem(tx, oid)
+		}
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, req, coll, oid, auditRestore, before)
+	})
+	if err != nil {
+		http.Error(res, err.Error(), 409)
+		return
+	}
+	log.Printf("restored %s %s", coll.Name(), id)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// purgeDeleted removes stores and items deleted before cutoff, one at a
+// time so one that's still pointed at doesn't hold up the rest.
+func purgeDeleted(ctx context.Context, cutoff int64) error {
+	expired := bson.NewDocument(bson.EC.SubDocumentFromElements("deleted_at",
+		bson.EC.Int64("$gt", 0),
+		bson.EC.Int64("$lt", cutoff),
+	))
+	for _, coll := range []*mongo.Collection{storesColl, menuItemsColl} {
+		cur, err := coll.Find(ctx, expired)
+		if err != nil {
+			return err
+		}
+		ids := make([]objectid.ObjectID, 0)
+		for cur.Next(ctx) {
+			var d refDoc
+			if err := cur.Decode(&d); err != nil {
+				cur.Close(ctx)
+				return err
+			}
+			ids = append(ids, d.ID)
+		}
+		err = cur.Err()
+		cur.Close(ctx)
+		if err != nil {
+			return err
+		}
+
+		purged, kept, failed := 0, 0, 0
+		for _, oid := range ids {
+			err := runTxn(ctx, func(tx *txn) error {
+				return hardDelete(tx, coll, oid)
+			})
+			if _, ok := err.(*restrictError); ok {
+				kept++
+				continue
+			}
+			if err != nil {
+				log.Printf("purging %s %s: %s", docNoun(coll), oid.Hex(), err)
+				failed++
+				continue
+			}
+			purged++
+		}
+		if purged > 0 || kept > 0 || failed > 0 {
+			log.Printf("purged %d deleted %s, kept %d still pointed at, %d failed", purged, coll.Name(), kept, failed)
+		}
+	}
+	return nil
+}
+
+// purgeForever purges every purgeEvery until ctx is done.
+func purgeForever(ctx context.Context, retention time.Duration) {
+	tick := time.NewTicker(purgeEvery)
+	defer tick.Stop()
+	for {
+		if err := purgeDeleted(ctx, time.Now().Add(-retention).Unix()); err != nil {
+			log.Printf("purging deleted stores and items: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+func setupSoftDelete() error {
+	retention, err := time.ParseDuration(getEnv("SOFT_DELETE_RETENTION", "720h"))
+	if err != nil {
+		return fmt.Errorf("bad SOFT_DELETE_RETENTION: %s", err)
+	}
+
+	storeRoutes["restore"] = func(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+		if len(rest) != 0 {
+			http.Error(res, fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path), 404)
+			return
+		}
+		handleRestore(res, req, storesColl, storeID)
+	}
+
+	if retention > 0 {
+		go purgeForever(context.Background(), retention)
+	}
+	return nil
+}
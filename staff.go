@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+)
+
+// Staff sign requests with the token they got when they were added, in an
+// X-Staff-Token header. Where a header can't be set (a browser EventSource
+// or websocket) they POST /api/v1/staff/ticket first and put the ticket it
+// returns in ?ticket=; it's good once, for staffTicketTTL, so the token
+// itself never ends up in a URL or a log. Only hashes of tokens and tickets
+// are stored. Roles are ranked, each
+// can do what the ones below it can; a member with a store only counts at
+// that store.
+//
+// Adding staff takes an admin. A new database gets its first one from the
+// command line, where whoever runs it already has the keys:
+//
+//	tacos-api staff admin NAME   add an admin and print their token
+
+const (
+	roleCashier = "cashier"
+	roleManager = "manager"
+	roleAdmin   = "admin"
+)
+
+var roleRanks = map[string]int{
+	roleCashier: 1,
+	roleManager: 2,
+	roleAdmin:   3,
+}
+
+type staffMember struct {
+	ID      objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr   string            `bson:"-" json:"id"`
+	Name    string            `bson:"name" json:"name"`
+	Role    string            `bson:"role" json:"role"`
+	Store   string            `bson:"-" json:"store"` // empty for every store
+	StoreID objectid.ObjectID `bson:"store" json:"-"`
+	Active  bool              `bson:"active" json:"active"`
+	Token   string            `bson:"-" json:"token,omitempty"` // only when added
+}
+
+var staffColl *mongo.Collection
+
+// staffTicketTTL is how long a ticket is good for; it only has to last
+// until the stream or socket it's for opens.
+const staffTicketTTL = 30 * time.Second
+
+var staffTicketsColl *mongo.Collection
+
+func (s *staffMember) fill() {
+	s.IDStr = s.ID.Hex()
+	if s.StoreID != objectid.NilObjectID {
+		s.Store = s.StoreID.Hex()
+	}
+}
+
+// can says whether s has at least role, at store if it isn't nil.
+func (s *staffMember) can(role string, store objectid.ObjectID) bool {
+	if roleRanks[s.Role] < roleRanks[role] {
+		return false
+	}
+	return s.StoreID == objectid.NilObjectID || store == objectid.NilObjectID || s.StoreID == store
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// staffFor is the member whose token req carries, nil if there's none.
+func staffFor(req *http.Request) (*staffMember, error) {
+	token := req.Header.Get("X-Staff-Token")
+	if token == "" {
+		if ticket := req.URL.Query().Get("ticket"); ticket != "" {
+			return redeemTicket(req.Context(), ticket)
+		}
+		return nil, nil
+	}
+	var s staffMember
+	err := staffColl.FindOne(req.Context(), bson.NewDocument(
+		bson.EC.String("token", hashToken(token)),
+		bson.EC.Boolean("active", true),
+	)).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("unknown staff token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.fill()
+	return &s, nil
+}
+
+// redeemTicket is the member ticket was issued to, using it up.
+func redeemTicket(ctx context.Context, ticket string) (*staffMember, error) {
+	var t struct {
+		Staff objectid.ObjectID `bson:"staff"`
+	}
+	err := staffTicketsColl.FindOneAndDelete(ctx, bson.NewDocument(
+		bson.EC.String("_id", hashToken(ticket)),
+		// the TTL index only sweeps now and then
+		bson.EC.SubDocumentFromElements("created", bson.EC.Time("$gt", time.Now().Add(-staffTicketTTL))),
+	)).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("unknown or used staff ticket")
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s staffMember
+	err = staffColl.FindOne(ctx, bson.NewDocument(
+		bson.EC.ObjectID("_id", t.Staff),
+		bson.EC.Boolean("active", true),
+	)).Decode(&s)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("unknown or used staff ticket")
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.fill()
+	return &s, nil
+}
+
+// staffError is a request turned away for want of a role, a 403.
+type staffError struct {
+	msg string
+}
+
+func (e *staffError) Error() string {
+	return e.msg
+}
+
+// checkStaff fails unless s, who may be nil, has role at store.
+func checkStaff(s *staffMember, role string, store objectid.ObjectID) error {
+	if s == nil {
+		return &staffError{fmt.Sprintf("this needs a %s's X-Staff-Token", role)}
+	}
+	if !s.can(role, store) {
+		return &staffError{fmt.Sprintf("%s is a %s, this needs a %s", s.Name, s.Role, role)}
+	}
+	return nil
+}
+
+// requireStaff is staffFor, failing unless the member has role at store.
+func requireStaff(req *http.Request, role string, store objectid.ObjectID) (*staffMember, error) {
+	s, err := staffFor(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStaff(s, role, store); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// actor names whoever is making req for history and logs.
+func actor(s *staffMember) string {
+	if s == nil {
+		return "customer"
+	}
+	return fmt.Sprintf("%s (%s %s)", s.Name, s.Role, s.IDStr)
+}
+
+// handleStaff is /api/v1/staff: GET lists staff, PUT adds one and returns
+// their token, DELETE /{id} deactivates them. All of it needs an admin.
+func handleStaff(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	ctx := context.Background()
+	if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	staffID := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/api/v1/staff"), "/")
+	switch req.Method {
+	case "GET":
+		cur, err := staffColl.Find(ctx, nil)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		defer cur.Close(ctx)
+		list := make([]staffMember, 0)
+		for cur.Next(ctx) {
+			var s staffMember
+			if err := cur.Decode(&s); err != nil {
+				httpError(err.Error())
+				return
+			}
+			s.fill()
+			list = append(list, s)
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case "PUT":
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var s staffMember
+		err := decoder.Decode(&s)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if s.Store != "" {
+			s.StoreID, err = objectid.FromHex(s.Store)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		if err := addStaff(ctx, &s); err != nil {
+			httpError(err.Error())
+			return
+		}
+		log.Printf("added %s %s", s.Role, s.Name)
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("Cache-Control", "no-store") // it has their token
+		json.NewEncoder(res).Encode(s)
+
+	case "DELETE":
+		oid, err := objectid.FromHex(staffID)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		result, err := staffColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.Boolean("active", false))))
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("result: %+v\n", result)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+	}
+}
+
+// handleStaffTicket is POST /api/v1/staff/ticket, a ticket for whoever's
+// X-Staff-Token signs it. Tickets don't get more tickets.
+func handleStaffTicket(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, fmt.Sprintf("Unexpected method %s", req.Method), http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Header.Get("X-Staff-Token") == "" {
+		http.Error(res, "this needs an X-Staff-Token", http.StatusForbidden)
+		return
+	}
+	s, err := staffFor(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	ticket := hex.EncodeToString(secret)
+	now := time.Now()
+	_, err = staffTicketsColl.InsertOne(req.Context(), bson.NewDocument(
+		bson.EC.String("_id", hashToken(ticket)),
+		bson.EC.ObjectID("staff", s.ID),
+		bson.EC.Time("created", now),
+	))
+	if err != nil {
+		http.Error(res, err.Error(), 500)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(res).Encode(struct {
+		Ticket  string `json:"ticket"`
+		Expires int64  `json:"expires"` // unix
+	}{ticket, now.Add(staffTicketTTL).Unix()})
+}
+
+// addStaff validates s and stores them, with a new token in s.Token.
+func addStaff(ctx context.Context, s *staffMember) error {
+	if s.Name == "" {
+		return fmt.Errorf("Name is required")
+	}
+	if roleRanks[s.Role] == 0 {
+		return fmt.Errorf("Unknown role %s", s.Role)
+	}
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	s.Token = hex.EncodeToString(secret)
+	inserter := bson.NewDocument(
+		bson.EC.String("name", s.Name),
+		bson.EC.String("role", s.Role),
+		bson.EC.String("token", hashToken(s.Token)),
+		bson.EC.Boolean("active", true),
+	)
+	if s.StoreID != objectid.NilObjectID {
+		inserter.Append(bson.EC.ObjectID("store", s.StoreID))
+	}
+	result, err := staffColl.InsertOne(ctx, inserter)
+	if err != nil {
+		return err
+	}
+	s.ID = result.InsertedID.(objectid.ObjectID)
+	s.Active = true
+	s.fill()
+	return nil
+}
+
+// runStaff is tacos-api staff ...
+func runStaff(ctx context.Context, args []string) error {
+	if len(args) != 2 || args[0] != "admin" {
+		return fmt.Errorf("usage: tacos-api staff admin NAME")
+	}
+	staffColl = database.Collection("staff")
+	s := staffMember{Name: args[1], Role: roleAdmin}
+	if err := addStaff(ctx, &s); err != nil {
+		return err
+	}
+	log.Printf("added %s %s", s.Role, s.Name)
+	fmt.Println(s.Token)
+	return nil
+}
+
+func setupStaff() {
+	staffColl = database.Collection("staff")
+	staffTicketsColl = database.Collection("staff_tickets")
+
+	http.HandleFunc("/api/v1/staff", handleStaff)
+	http.HandleFunc("/api/v1/staff/", handleStaff)
+	http.HandleFunc("/api/v1/staff/ticket", handleStaffTicket)
+}
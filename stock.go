@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/updateopt"
+)
+
+// stockLevel is how much of a menu item a store has left. A tracked level
+// counts down as orders are submitted; an untracked one is just the
+// available flag staff flip when the kitchen runs out (86'd). Items with no
+// level at all are always available.
+type stockLevel struct {
+	Item      string `json:"item"`
+	Tracked   bool   `json:"tracked"`
+	Qty       int    `json:"qty"`
+	Available bool   `json:"available"`
+}
+
+// stockRecord is a stock level as stored.
+type stockRecord struct {
+	ID        objectid.ObjectID `bson:"_id"`
+	Store     objectid.ObjectID `bson:"store"`
+	Item      objectid.ObjectID `bson:"item"`
+	Tracked   bool              `bson:"tracked"`
+	Qty       int               `bson:"qty"`
+	Available bool              `bson:"available"`
+}
+
+func (s *stockRecord) inStock() bool {
+	return s.Available && (!s.Tracked || s.Qty > 0)
+}
+
+var stockColl *mongo.Collection
+
+// handleStock is the staff side: /api/v1/stores/{id}/stock[/{itemId}].
+// Changing levels takes a manager at the store.
+func handleStock(res http.ResponseWriter, req *http.Request, storeID string, rest []string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	storeOid, err := objectid.FromHex(storeID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	if req.Method != "GET" {
+		if _, err := requireStaff(req, roleManager, storeOid); err != nil {
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	switch req.Method {
+	case "GET": // list stock levels for store
+		list, err := stockLevels(context.Background(), storeOid)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case "PUT": // set stock level: a qty to count it down, or just available
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var body struct {
+			Item      string `json:"item"`
+			Qty       *int   `json:"qty"`
+			Available *bool  `json:"available"`
+		}
+		err := decoder.Decode(&body)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("stock: %+v\n", body)
+		result, err := setStock(context.Background(), storeOid, body.Item, body.Qty, body.Available)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		events.publish(stockKey(storeOid))
+		fmt.Printf("result: %+v\n", result)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	case "PATCH": // adjust a counted level by a delta, item id in path
+		if len(rest) == 0 {
+			httpError("Item id is required")
+			return
+		}
+		itemOid, err := storeMenuItem(storeOid, rest[0])
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var body struct {
+			Adjust int `json:"adjust"`
+		}
+		err = decoder.Decode(&body)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		filter := bson.NewDocument(
+			bson.EC.ObjectID("store", storeOid),
+			bson.EC.ObjectID("item", itemOid),
+			bson.EC.Boolean("tracked", true),
+		)
+		if body.Adjust < 0 {
+			filter.Append(bson.EC.SubDocumentFromElements("qty", bson.EC.Int32("$gte", int32(-body.Adjust))))
+		}
+		setter := bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("qty", int32(body.Adjust))))
+		result, err := stockColl.UpdateOne(context.Background(), filter, setter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if result.MatchedCount == 0 {
+			httpError("Item is not counted or has too little stock")
+			return
+		}
+		events.publish(stockKey(storeOid))
+		fmt.Printf("result: %+v\n", result)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	case "DELETE": // stop tracking an item, item id in path
+		if len(rest) == 0 {
+			httpError("Item id is required")
+			return
+		}
+		log.Printf("delete param: %s", rest[0])
+		itemOid, err := objectid.FromHex(rest[0])
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		deleter := bson.NewDocument(
+			bson.EC.ObjectID("store", storeOid),
+			bson.EC.ObjectID("item", itemOid),
+		)
+		result, err := stockColl.DeleteOne(context.Background(), deleter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		events.publish(stockKey(storeOid))
+		fmt.Printf("result: %+v\n", result)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+	}
+}
+
+// setStock sets an item's level at store: a qty to count it down, or just
+// whether it's available.
+func setStock(ctx context.Context, store objectid.ObjectID, itemID string, qty *int, available *bool) (*mongo.UpdateResult, error) {
+	itemOid, err := storeMenuItem(store, itemID)
+	if err != nil {
+		return nil, err
+	}
+	isAvailable := true
+	if available != nil {
+		isAvailable = *available
+	}
+	updates := []*bson.Element{bson.EC.Boolean("available", isAvailable)}
+	if qty != nil {
+		if *qty < 0 {
+			return nil, fmt.Errorf("qty may not be negative")
+		}
+		updates = append(updates, bson.EC.Boolean("tracked", true), bson.EC.Int32("qty", int32(*qty)))
+	} else if available != nil {
+		updates = append(updates, bson.EC.Boolean("tracked", false), bson.EC.Int32("qty", 0))
+	} else {
+		return nil, fmt.Errorf("one of qty or available is required")
+	}
+	filter := bson.NewDocument(
+		bson.EC.ObjectID("store", store),
+		bson.EC.ObjectID("item", itemOid),
+	)
+	setter := bson.NewDocument(bson.EC.SubDocumentFromElements("$set", updates...))
+	fmt.Printf("setter: %+v\n", setter)
+	return stockColl.UpdateOne(ctx, filter, setter, updateopt.Upsert(true))
+}
+
+// stockLevels is the store's stock levels as staff see them.
+func stockLevels(ctx context.Context, store objectid.ObjectID) ([]stockLevel, error) {
+	levels, err := loadStock(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]stockLevel, 0, len(levels))
+	for _, level := range levels {
+		list = append(list, stockLevel{
+			Item:      level.Item.Hex(),
+			Tracked:   level.Tracked,
+			Qty:       level.Qty,
+			Available: level.Available,
+		})
+	}
+	return list, nil
+}
+
+// storeMenuItem checks that itemID is one of the store's menu items.
+func storeMenuItem(store objectid.ObjectID, itemID string) (objectid.ObjectID, error) {
+	oid, err := objectid.FromHex(itemID)
+	if err != nil {
+		return oid, err
+	}
+	filter := bson.NewDocument(
+		bson.EC.ObjectID("_id", oid),
+		bson.EC.ObjectID("store", store),
+		notDeleted(),
+	)
+	n, err := menuItemsColl.Count(context.Background(), filter)
+	if err != nil {
+		return oid, err
+	}
+	if n == 0 {
+		return oid, fmt.Errorf("item %s is not on this store's menu", itemID)
+	}
+	return oid, nil
+}
+
+// loadStock returns the store's stock levels keyed by item id.
+func loadStock(ctx context.Context, store objectid.ObjectID) (map[objectid.ObjectID]stockRecord, error) {
+	cur, err := stockColl.Find(ctx, bson.NewDocument(bson.EC.ObjectID("store", store)))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	levels := make(map[objectid.ObjectID]stockRecord)
+	for cur.Next(ctx) {
+		var level stockRecord
+		err := cur.Decode(&level)
+		if err != nil {
+			return nil, err
+		}
+		levels[level.Item] = level
+	}
+	return levels, cur.Err()
+}
+
+// reserveStock takes the items on a bill out of the store's stock, failing
+// the whole submission if any of them has run out.
+func reserveStock(tx *txn, store objectid.ObjectID, b *bill) error {
+	for item, count := range billCounts(b) {
+		var level stockRecord
+		filter := bson.NewDocument(
+			bson.EC.ObjectID("store", store),
+			bson.EC.ObjectID("item", item),
+		)
+		err := tx.findOne(stockColl, filter, &level)
+		if err == errNoDocument {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !level.Available {
+			return fmt.Errorf("%s is sold out", billName(b, item))
+		}
+		if !level.Tracked {
+			continue
+		}
+		guard := bson.NewDocument(
+			bson.EC.ObjectID("_id", level.ID),
+			bson.EC.SubDocumentFromElements("qty", bson.EC.Int32("$gte", int32(count))),
+		)
+		dec := bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("qty", int32(-count))))
+		matched, err := tx.updateOne(stockColl, guard, dec)
+		if err != nil {
+			return err
+		}
+		if matched == 0 {
+			return fmt.Errorf("only %d %s left", level.Qty, billName(b, item))
+		}
+	}
+	return nil
+}
+
+// releaseStock puts a cancelled order's items back.
+func releaseStock(tx *txn, store objectid.ObjectID, b *bill) error {
+	for item, count := range billCounts(b) {
+		filter := bson.NewDocument(
+			bson.EC.ObjectID("store", store),
+			bson.EC.ObjectID("item", item),
+			bson.EC.Boolean("tracked", true),
+		)
+		inc := bson.NewDocument(bson.EC.SubDocumentFromElements("$inc", bson.EC.Int32("qty", int32(count))))
+		_, err := tx.updateOne(stockColl, filter, inc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func billCounts(b *bill) map[objectid.ObjectID]int {
+	counts := make(map[objectid.ObjectID]int)
+	for _, line := range b.Lines {
+		oid, err := objectid.FromHex(line.Item)
+		if err != nil {
+			continue
+		}
+		counts[oid] += line.Count
+	}
+	return counts
+}
+
+func billName(b *bill, item objectid.ObjectID) string {
+	for _, line := range b.Lines {
+		if line.Item == item.Hex() {
+			return line.Name
+		}
+	}
+	return item.Hex()
+}
+
+func setupStock() {
+	stockColl = database.Collection("stock")
+
+	storeRoutes["stock"] = handleStock
+}
@@ -9,6 +9,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/mongodb/mongo-go-driver/bson"
 	"github.com/mongodb/mongo-go-driver/bson/objectid"
@@ -17,19 +18,63 @@ import (
 
 // Store is a store
 type Store struct {
-	ID      objectid.ObjectID `bson:"_id"`
-	IDStr   string            `json:"id"`
-	Type    string            `json:"type"`
+	ID      objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr   string            `bson:"-" json:"id"`
+	Type    string            `json:"type" schema:"required,enum=tacos|icecream|other"`
 	Name    string            `json:"name"`
+	Slug    string            `json:"slug" schema:"required"`
 	Address string            `json:"address"`
 	City    string            `json:"city"`
 	State   string            `json:"state"`
 	Zip     string            `json:"zip"`
+	TZ      string            `json:"tz"` // IANA zone, e.g. America/New_York
+	Fees    []storeFee        `json:"fees"`
+	Shifts  []storeShift      `json:"shifts"` // for the tip report
+
+	DeletedAt int64 `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"` // unix, 0 unless soft-deleted
+}
+
+// validate checks a store that's about to be written.
+func (s *Store) validate() error {
+	switch s.Type {
+	case "tacos", "icecream", "other":
+	case "":
+		return fmt.Errorf("Type is required")
+	default:
+		return fmt.Errorf("Type must be one of tacos, icecream, other")
+	}
+	if s.TZ != "" {
+		if _, err := time.LoadLocation(s.TZ); err != nil {
+			return err
+		}
+	}
+	for i := range s.Fees {
+		if err := s.Fees[i].validate(); err != nil {
+			return err
+		}
+	}
+	return validateShifts(s.Shifts)
 }
 
 var storesColl *mongo.Collection
 
+// storeRoutes handles /api/v1/stores/{id}/{name}/..., keyed by name. The
+// handler gets the store id and whatever follows the name.
+var storeRoutes = map[string]func(res http.ResponseWriter, req *http.Request, storeID string, rest []string){}
+
 func handleStores(res http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/api/v1/stores/"), "/")
+	if len(parts) == 2 && parts[0] == "by-slug" {
+		handleStoreBySlug(res, req, parts[1])
+		return
+	}
+	if len(parts) > 1 {
+		if route, ok := storeRoutes[parts[1]]; ok {
+			route(res, req, parts[0], parts[2:])
+			return
+		}
+	}
+
 	httpError := func(msg string) {
 		// todo: restrict this to debug only
 		_, callerFile, callerLine, ok := runtime.Caller(1)
@@ -41,10 +86,10 @@ func handleStores(res http.ResponseWriter, req *http.Request) {
 	}
 
 	switch req.Method {
-	case "GET": // list stores unless ID is specified
+	case "GET": // list stores unless ID is specified, ?include_deleted=true lists deleted ones too
 		storeID := strings.TrimPrefix(req.URL.Path, "/api/v1/stores/")
 		if storeID == "/api/v1/stores" {
-			cur, err := storesColl.Find(context.Background(), nil)
+			cur, err := storesColl.Find(context.Background(), liveFilter(req, bson.NewDocument()))
 			if err != nil {
 				httpError(err.Error())
 				return
@@ -92,7 +137,6 @@ func handleStores(res http.ResponseWriter, req *http.Request) {
 		}
 
 	case "PUT": // add store
-		// todo: make sure everything is specified and valid
 		decoder := json.NewDecoder(req.Body)
 		defer req.Body.Close()
 		var store Store
@@ -102,55 +146,42 @@ func handleStores(res http.ResponseWriter, req *http.Request) {
 			return
 		}
 		fmt.Printf("store: %+v\n", store)
-		inserts := make([]*bson.Element, 0)
-		if store.Type != "" {
-			inserts = append(inserts, bson.EC.String("type", store.Type))
-			switch store.Type {
-			case "tacos", "icecream", "other":
-				break
-			default:
-				httpError("Type must be one of tacos, icecream, other")
-				return
-			}
-		} else {
-			httpError("Type is required")
+		if err := store.validate(); err != nil {
+			httpError(err.Error())
 			return
 		}
-		if store.Name != "" {
-			inserts = append(inserts, bson.EC.String("name", store.Name))
-		}
-		if store.Address != "" {
-			inserts = append(inserts, bson.EC.String("address", store.Address))
+		// the slug comes from the name unless the client picked one
+		slugBase := store.Name
+		if store.Slug != "" {
+			slugBase = store.Slug
 		}
-		if store.City != "" {
-			inserts = append(inserts, bson.EC.String("city", store.City))
-		}
-		if store.State != "" {
-			inserts = append(inserts, bson.EC.String("state", store.State))
-		}
-		if store.Zip != "" {
-			inserts = append(inserts, bson.EC.String("zip", store.Zip))
+		store.ID = objectid.New()
+		store.Slug, err = uniqueSlug(context.Background(), storesColl, bson.NewDocument(), slugBase, store.ID)
+		if err != nil {
+			httpError(err.Error())
+			return
 		}
-		fmt.Printf("inserts: %+v\n", inserts)
-		inserter := bson.NewDocument()
-		for _, update := range inserts {
-			inserter.Append(update)
+		store.DeletedAt = 0
+		inserter, err := bson.NewDocumentEncoder().EncodeDocument(&store)
+		if err != nil {
+			httpError(err.Error())
+			return
 		}
 		fmt.Printf("inserter: %+v\n", inserter)
-		result, err := storesColl.InsertOne(context.Background(), inserter, nil)
+		err = runTxn(context.Background(), func(tx *txn) error {
+			if _, err := tx.insertOne(storesColl, inserter); err != nil {
+				return err
+			}
+			return recordAudit(tx, req, storesColl, store.ID, auditCreate, nil)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
-		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
-		if oid, ok := result.InsertedID.(objectid.ObjectID); ok {
-			json.NewEncoder(res).Encode(insert{oid.Hex()})
-		} else {
-			json.NewEncoder(res).Encode(result)
-		}
+		json.NewEncoder(res).Encode(insert{store.ID.Hex()})
 
-	case "PATCH": // edit store, id in path
+	case "PATCH": // edit store, id in path, with a JSON merge patch (see patch.go)
 		storeID := strings.TrimPrefix(req.URL.Path, "/api/v1/stores/")
 		log.Printf("patch param: %s", storeID)
 		oid, err := objectid.FromHex(storeID)
@@ -158,47 +189,66 @@ func handleStores(res http.ResponseWriter, req *http.Request) {
 			httpError(err.Error())
 			return
 		}
-		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid))
-		decoder := json.NewDecoder(req.Body)
-		defer req.Body.Close()
-		var store Store
-		err = decoder.Decode(&store)
+		patch, err := readPatch(req)
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		updater := bson.NewDocument(bson.EC.ObjectID("_id", oid), notDeleted())
 		fmt.Printf("updater: %+v\n", updater)
-		updates := make([]*bson.Element, 0)
-		if store.Type != "" {
-			httpError("Store type may not be changed")
-		}
-		if store.Name != "" {
-			updates = append(updates, bson.EC.String("name", store.Name))
-		}
-		if store.Address != "" {
-			updates = append(updates, bson.EC.String("address", store.Address))
-		}
-		if store.City != "" {
-			updates = append(updates, bson.EC.String("city", store.City))
-		}
-		if store.State != "" {
-			updates = append(updates, bson.EC.String("state", store.State))
-		}
-		if store.Zip != "" {
-			updates = append(updates, bson.EC.String("zip", store.Zip))
-		}
-		fmt.Printf("updates: %+v\n", updates)
-		subdoc := bson.NewDocument()
-		for _, update := range updates {
-			subdoc.Append(update)
-		}
-		setter := bson.NewDocument(bson.EC.SubDocument("$set", subdoc))
-		fmt.Printf("setter: %+v\n", setter)
-		result, err := storesColl.UpdateOne(context.Background(), updater, setter, nil)
+		var matched int64
+		err = runTxn(context.Background(), func(tx *txn) error {
+			before, err := auditBefore(tx, storesColl, oid)
+			if err != nil {
+				return err
+			}
+			var current Store
+			err = tx.findOne(storesColl, updater, &current)
+			if err == errNoDocument {
+				matched = 0
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			current.IDStr = current.ID.Hex()
+			var store Store
+			if err := applyPatch(patch, &current, &store); err != nil {
+				return err
+			}
+			store.ID, store.DeletedAt = current.ID, current.DeletedAt
+			if store.Type != current.Type {
+				return fmt.Errorf("Store type may not be changed")
+			}
+			if err := store.validate(); err != nil {
+				return err
+			}
+			// renaming keeps the slug, it only changes when asked
+			if store.Slug != current.Slug {
+				store.Slug, err = uniqueSlug(tx.ctx, storesColl, bson.NewDocument(), store.Slug, oid)
+				if err != nil {
+					return err
+				}
+			}
+			setter, err := updateFor(&store)
+			if err != nil {
+				return err
+			}
+			if store.Slug != current.Slug && current.Slug != "" {
+				setter.Append(slugHistory(current.Slug))
+			}
+			fmt.Printf("setter: %+v\n", setter)
+			matched, err = tx.updateOne(storesColl, updater, setter)
+			if err != nil || matched == 0 {
+				return err
+			}
+			return recordAudit(tx, req, storesColl, oid, auditUpdate, before)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		result := &mongo.UpdateResult{MatchedCount: matched, ModifiedCount: matched}
 		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(res).Encode(result)
@@ -211,12 +261,23 @@ func handleStores(res http.ResponseWriter, req *http.Request) {
 			httpError(err.Error())
 			return
 		}
-		deleter := bson.NewDocument(bson.EC.ObjectID("_id", oid))
-		result, err := storesColl.DeleteOne(context.Background(), deleter, nil)
+		var deleted int64
+		err = runTxn(context.Background(), func(tx *txn) error {
+			before, err := auditBefore(tx, storesColl, oid)
+			if err != nil {
+				return err
+			}
+			deleted, err = softDeleteStore(tx, oid)
+			if err != nil || deleted == 0 {
+				return err
+			}
+			return recordAudit(tx, req, storesColl, oid, auditDelete, before)
+		})
 		if err != nil {
 			httpError(err.Error())
 			return
 		}
+		result := &mongo.DeleteResult{DeletedCount: deleted}
 		fmt.Printf("result: %+v\n", result)
 		res.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(res).Encode(result)
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Tax rates live in tax_rates, one document per version of a jurisdiction's
+// rates. A jurisdiction is a state, or a ZIP within it when the local rate
+// differs. Rates are never edited: a change is a new version with the date
+// it takes effect, so an order can always be priced with the rates of its
+// day. The rate used is copied onto the order when it's submitted.
+//
+// Rates are percents with up to four decimals ("8.875"), per tax category.
+// Items are "prepared" unless their tax_category says otherwise; a category
+// with no rate is not taxed.
+
+type taxRate struct {
+	ID        objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr     string            `bson:"-" json:"id"`
+	State     string            `bson:"state" json:"state"`
+	Zip       string            `bson:"zip" json:"zip"` // empty for the whole state
+	Name      string            `bson:"name" json:"name"`
+	Version   int               `bson:"version" json:"version"`
+	Effective string            `bson:"effective" json:"effective"` // YYYY-MM-DD
+	Rates     map[string]string `bson:"rates" json:"rates"`         // percent by category
+	Rounding  string            `bson:"rounding" json:"rounding"`
+	PerLine   bool              `bson:"per_line" json:"per_line"` // round each line, not each category
+}
+
+const defaultTaxCategory = "prepared"
+
+// taxVersionTries is how many times adding a rate counts the versions
+// again after losing a race for one.
+const taxVersionTries = 5
+
+var taxCategories = map[string]bool{
+	"prepared": true, // hot food, anything served to eat there
+	"packaged": true, // sealed pints and the like
+	"grocery":  true,
+	"exempt":   true,
+}
+
+// rounding rules for fractions of a cent
+var taxRoundings = map[string]bool{
+	"half_up":   true,
+	"half_even": true,
+	"up":        true,
+	"down":      true,
+}
+
+var taxRatesColl *mongo.Collection
+
+func (r *taxRate) validate() error {
+	r.State = strings.ToUpper(strings.TrimSpace(r.State))
+	r.Zip = strings.TrimSpace(r.Zip)
+	if r.State == "" {
+		return fmt.Errorf("state is required")
+	}
+	if _, err := time.Parse(dateLayout, r.Effective); err != nil {
+		return fmt.Errorf("effective must be a date like 2018-07-01")
+	}
+	if r.Rounding == "" {
+		r.Rounding = "half_up"
+	}
+	if !taxRoundings[r.Rounding] {
+		return fmt.Errorf("unknown rounding %q, expected one of %s", r.Rounding, strings.Join(sortedKeys(taxRoundings), ", "))
+	}
+	if len(r.Rates) == 0 {
+		return fmt.Errorf("rates are required")
+	}
+	for category, rate := range r.Rates {
+		if !taxCategories[category] {
+			return fmt.Errorf("unknown tax category %q, expected one of %s", category, strings.Join(sortedKeys(taxCategories), ", "))
+		}
+		units, err := parseFixed(rate, 4)
+		if err != nil {
+			return fmt.Errorf("rate for %s: %s", category, err)
+		}
+		if units < 0 || units > 100*10000 {
+			return fmt.Errorf("rate for %s must be between 0 and 100", category)
+		}
+	}
+	return nil
+}
+
+func (r *taxRate) rateElements() []*bson.Element {
+	rates := bson.NewDocument()
+	for _, category := range sortedRates(r.Rates) {
+		rates.Append(bson.EC.String(category, r.Rates[category]))
+	}
+	return []*bson.Element{
+		bson.EC.String("state", r.State),
+		bson.EC.String("zip", r.Zip),
+		bson.EC.String("name", r.Name),
+		bson.EC.Int32("version", int32(r.Version)),
+		bson.EC.String("effective", r.Effective),
+		bson.EC.SubDocument("rates", rates),
+		bson.EC.String("rounding", r.Rounding),
+		bson.EC.Boolean("per_line", r.PerLine),
+	}
+}
+
+func sortedRates(rates map[string]string) []string {
+	keys := make([]string, 0, len(rates))
+	for k := range rates {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// findTaxRate picks the rates in force at store on day (YYYY-MM-DD): the
+// store's ZIP if it has its own, else its state. nil if neither has any.
+func findTaxRate(tx *txn, store *Store, day string) (*taxRate, error) {
+	docs, err := tx.find(taxRatesColl, bson.NewDocument(
+		bson.EC.String("state", strings.ToUpper(store.State)),
+		bson.EC.SubDocumentFromElements("zip", bson.EC.ArrayFromElements("$in",
+			bson.VC.String(store.Zip), bson.VC.String(""))),
+		bson.EC.SubDocumentFromElements("effective", bson.EC.String("$lte", day)),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var best *taxRate
+	for _, doc := range docs {
+		var r taxRate
+		if err := bson.Unmarshal(doc, &r); err != nil {
+			return nil, err
+		}
+		if best == nil || later(&r, best) {
+			best = &r
+		}
+	}
+	if best != nil {
+		best.IDStr = best.ID.Hex()
+	}
+	return best, nil
+}
+
+// later says whether a should be used over b: ZIP over state, then the
+// latest effective date, then the latest version.
+func later(a, b *taxRate) bool {
+	if (a.Zip != "") != (b.Zip != "") {
+		return a.Zip != ""
+	}
+	if a.Effective != b.Effective {
+		return a.Effective > b.Effective
+	}
+	return a.Version > b.Version
+}
+
+// applyTax adds the tax on b to it, one charge per taxed category. Any
+// discounts are spread over the lines in proportion to their totals first,
+// so tax is on what the customer actually pays.
+func applyTax(tx *txn, order *orderRecord, b *bill) error {
+	if order.Store == nil {
+		return nil
+	}
+	var store Store
+	err := tx.findOne(storesColl, bson.NewDocument(bson.EC.ObjectID("_id", *order.Store)), &store)
+	if err == errNoDocument {
+		return fmt.Errorf("store %s no longer exists", order.Store.Hex())
+	}
+	if err != nil {
+		return err
+	}
+	day := time.Now().In(zoneOrUTC(store.TZ)).Format(dateLayout)
+	rate, err := findTaxRate(tx, &store, day)
+	if err != nil || rate == nil {
+		return err
+	}
+	b.TaxRate = rate
+
+	subtotal, err := parseCents(b.Subtotal)
+	if err != nil {
+		return err
+	}
+	var discount int64
+	for _, charge := range b.Discounts {
+		cents, err := parseCents(charge.Amount)
+		if err != nil {
+			return err
+		}
+		discount += cents
+	}
+
+	// numerators are cents × rate units, 10^6 of them to the cent
+	const perCent = 100 * 10000
+	owed := make(map[string]int64)
+	bases := make(map[string]int64)
+	spread := int64(0)
+	for i, line := range b.Lines {
+		oid, _ := objectid.FromHex(line.Item)
+		category := b.menu[oid].TaxCategory
+		if category == "" {
+			category = defaultTaxCategory
+		}
+		units, err := parseFixed(rate.Rates[category], 4)
+		if err != nil {
+			return err
+		}
+		amount, err := parseCents(line.Total)
+		if err != nil {
+			return err
+		}
+		if subtotal > 0 {
+			share := discount * amount / subtotal
+			if i == len(b.Lines)-1 {
+				share = discount - spread
+			}
+			spread += share
+			amount += share
+		}
+		if amount <= 0 || units == 0 {
+			continue
+		}
+		bases[category] += amount
+		if rate.PerLine {
+			owed[category] += roundTax(amount*units, perCent, rate.Rounding) * perCent
+		} else {
+			owed[category] += amount * units
+		}
+	}
+	for _, category := range sortedTaxBases(bases) {
+		cents := roundTax(owed[category], perCent, rate.Rounding)
+		if cents == 0 {
+			continue
+		}
+		descr := fmt.Sprintf("%s %s%% on %s", category, rate.Rates[category], formatCents(bases[category]))
+		if rate.Name != "" {
+			descr = rate.Name + ", " + descr
+		}
+		b.Tax = append(b.Tax, billCharge{
+			Code:   category,
+			Descr:  descr,
+			Amount: formatCents(cents),
+		})
+	}
+	return nil
+}
+
+func sortedTaxBases(bases map[string]int64) []string {
+	keys := make([]string, 0, len(bases))
+	for k := range bases {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// roundTax divides n by d, rounding the way the jurisdiction says to. n
+// and d are never negative.
+func roundTax(n, d int64, rounding string) int64 {
+	q, r := n/d, n%d
+	switch rounding {
+	case "down":
+	case "up":
+		if r > 0 {
+			q++
+		}
+	case "half_even":
+		if 2*r > d || (2*r == d && q%2 == 1) {
+			q++
+		}
+	default: // half_up
+		if 2*r >= d {
+			q++
+		}
+	}
+	return q
+}
+
+func taxRateElement(r *taxRate) *bson.Element {
+	if r == nil {
+		return bson.EC.Null("tax_rate")
+	}
+	return bson.EC.SubDocumentFromElements("tax_rate",
+		append([]*bson.Element{bson.EC.ObjectID("_id", r.ID)}, r.rateElements()...)...)
+}
+
+// handleTaxRates is /api/v1/tax/rates. GET lists every version, &state=
+// and &zip= narrow it, &at=YYYY-MM-DD shows only what's in force that day.
+// PUT adds a new version of a jurisdiction's rates, which takes an admin.
+func handleTaxRates(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if req.Method != "GET" {
+		if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+			http.Error(res, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	switch req.Method {
+	case "GET": // list rates
+		query := req.URL.Query()
+		filter := bson.NewDocument()
+		if state := query.Get("state"); state != "" {
+			filter.Append(bson.EC.String("state", strings.ToUpper(state)))
+		}
+		if zip := query.Get("zip"); zip != "" {
+			filter.Append(bson.EC.String("zip", zip))
+		}
+		at := query.Get("at")
+		if at != "" {
+			filter.Append(bson.EC.SubDocumentFromElements("effective", bson.EC.String("$lte", at)))
+		}
+		sorter := bson.NewDocument(
+			bson.EC.Int32("state", 1),
+			bson.EC.Int32("zip", 1),
+			bson.EC.Int32("effective", -1),
+			bson.EC.Int32("version", -1),
+		)
+		cur, err := taxRatesColl.Find(context.Background(), filter, findopt.Sort(sorter))
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		defer cur.Close(context.Background())
+		list := make([]taxRate, 0)
+		seen := make(map[string]bool)
+		for cur.Next(context.Background()) {
+			var r taxRate
+			err := cur.Decode(&r)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			if at != "" {
+				// newest first, so the first of each is the one in force
+				if seen[r.State+"/"+r.Zip] {
+					continue
+				}
+				seen[r.State+"/"+r.Zip] = true
+			}
+			r.IDStr = r.ID.Hex()
+			list = append(list, r)
+		}
+		if err := cur.Err(); err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case "PUT": // add a version
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var r taxRate
+		err := decoder.Decode(&r)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("tax rate: %+v\n", r)
+		if err := r.validate(); err != nil {
+			httpError(err.Error())
+			return
+		}
+		// two PUTs at once can pick the same version, the unique index
+		// turns the second away and it counts again
+		jurisdiction := bson.NewDocument(bson.EC.String("state", r.State), bson.EC.String("zip", r.Zip))
+		var result *mongo.InsertOneResult
+		for try := 0; ; try++ {
+			count, err := taxRatesColl.Count(context.Background(), jurisdiction)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			r.Version = int(count) + 1
+			result, err = taxRatesColl.InsertOne(context.Background(), bson.NewDocument(r.rateElements()...))
+			if isDuplicateKey(err) && try < taxVersionTries {
+				continue
+			}
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+			break
+		}
+		res.Header().Set("Content-Type", "application/json")
+		if oid, ok := result.InsertedID.(objectid.ObjectID); ok {
+			json.NewEncoder(res).Encode(insert{oid.Hex()})
+		} else {
+			json.NewEncoder(res).Encode(result)
+		}
+
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+	}
+}
+
+func setupTax() {
+	taxRatesColl = database.Collection("tax_rates")
+
+	http.HandleFunc("/api/v1/tax/rates", handleTaxRates)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// storeFee is a charge a store adds to every order, like a packaging fee:
+// either Amount, or Percent of the subtotal. Fees go on after discounts and
+// aren't taxed.
+type storeFee struct {
+	Code    string `json:"code"`
+	Descr   string `json:"descr"`
+	Amount  string `json:"amount" bson:"amount,omitempty" schema:"price"`
+	Percent string `json:"percent" bson:"percent,omitempty"` // up to two decimals, "2.5"
+}
+
+// storeShift names a stretch of the day for the tip report, read in the
+// store's time zone like an availWindow. From later than Until runs past
+// midnight and counts toward the day it started.
+type storeShift struct {
+	Name  string   `json:"name"`
+	Days  []string `json:"days"`
+	From  string   `json:"from"`
+	Until string   `json:"until"`
+}
+
+// orderTip is what the customer chose to tip, Percent of the subtotal or a
+// fixed Amount.
+type orderTip struct {
+	Percent int    `bson:"percent" json:"percent"`
+	Amount  string `bson:"amount,omitempty" json:"amount" schema:"money"` // empty for a percent
+}
+
+func (f *storeFee) validate() error {
+	if f.Code == "" {
+		return fmt.Errorf("fees need a code")
+	}
+	if (f.Amount == "") == (f.Percent == "") {
+		return fmt.Errorf("fee %s needs an amount or a percent", f.Code)
+	}
+	amount, err := parseCents(f.Amount)
+	if err != nil {
+		return fmt.Errorf("fee %s: %s", f.Code, err)
+	}
+	percent, err := parseFixed(f.Percent, 2)
+	if err != nil {
+		return fmt.Errorf("fee %s: %s", f.Code, err)
+	}
+	// a negative fee would be a discount that gets around the promo limits
+	if amount+percent <= 0 {
+		return fmt.Errorf("fee %s has to be more than 0", f.Code)
+	}
+	return nil
+}
+
+// charge is f on a bill with subtotal after discounts.
+func (f *storeFee) charge(subtotal int64) billCharge {
+	var cents int64
+	if f.Percent != "" {
+		hundredths, _ := parseFixed(f.Percent, 2)
+		cents = (subtotal*hundredths + 5000) / 10000
+	} else {
+		cents, _ = parseCents(f.Amount)
+	}
+	descr := f.Descr
+	if descr == "" {
+		descr = f.Code
+	}
+	return billCharge{Code: f.Code, Descr: descr, Amount: formatCents(cents)}
+}
+
+func (s *storeShift) window() *availWindow {
+	return &availWindow{Days: s.Days, From: s.From, Until: s.Until}
+}
+
+// validateShifts checks shifts, writing their clocks out in full.
+func validateShifts(shifts []storeShift) error {
+	for i := range shifts {
+		s := &shifts[i]
+		if s.Name == "" {
+			return fmt.Errorf("shifts need a name")
+		}
+		w := s.window()
+		if err := w.validate(); err != nil {
+			return fmt.Errorf("shift %s: %s", s.Name, err)
+		}
+		s.From, s.Until = w.From, w.Until
+	}
+	return nil
+}
+
+// shiftAt names the shift local falls in and the day it started on. The
+// first matching shift wins; "unscheduled" if none does.
+func shiftAt(shifts []storeShift, local time.Time) (string, string) {
+	for _, s := range shifts {
+		if !s.window().contains(local) {
+			continue
+		}
+		day := local
+		if _, _, _, yesterday := s.window().span(local); yesterday {
+			day = local.AddDate(0, 0, -1)
+		}
+		return s.Name, day.Format(dateLayout)
+	}
+	return "unscheduled", local.Format(dateLayout)
+}
+
+// applyFees adds the store's fees to b.
+func applyFees(tx *txn, order *orderRecord, b *bill) error {
+	if order.Store == nil {
+		return nil
+	}
+	var store Store
+	err := tx.findOne(storesColl, bson.NewDocument(bson.EC.ObjectID("_id", *order.Store)), &store)
+	if err == errNoDocument {
+		return fmt.Errorf("store %s no longer exists", order.Store.Hex())
+	}
+	if err != nil || len(store.Fees) == 0 {
+		return err
+	}
+	subtotal, err := parseCents(b.Subtotal)
+	if err != nil {
+		return err
+	}
+	for _, charge := range b.Discounts {
+		cents, _ := parseCents(charge.Amount)
+		subtotal += cents
+	}
+	for _, f := range store.Fees {
+		b.Fees = append(b.Fees, f.charge(subtotal))
+	}
+	return nil
+}
+
+// applyTip adds the order's tip to b. Percent tips are on the subtotal
+// before discounts, the way people work them out at the table.
+func applyTip(order *orderRecord, b *bill) error {
+	if order.Tip == nil {
+		return nil
+	}
+	var cents int64
+	descr := "Tip"
+	if order.Tip.Percent > 0 {
+		subtotal, err := parseCents(b.Subtotal)
+		if err != nil {
+			return err
+		}
+		cents = (subtotal*int64(order.Tip.Percent) + 50) / 100
+		descr = fmt.Sprintf("Tip %d%%", order.Tip.Percent)
+	} else {
+		var err error
+		cents, err = parseCents(order.Tip.Amount)
+		if err != nil {
+			return err
+		}
+	}
+	if cents > 0 {
+		b.Tips = append(b.Tips, billCharge{Code: "tip", Descr: descr, Amount: formatCents(cents)})
+	}
+	return nil
+}
+
+// handleOrderTip is /api/v1/order/{id}/tip on an open order: POST
+// {percent} or {amount} sets the tip, DELETE takes it off.
+func handleOrderTip(res http.ResponseWriter, req *http.Request, orderID string) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	oid, err := objectid.FromHex(orderID)
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	var update *bson.Document
+	switch req.Method {
+	case "POST":
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var tip orderTip
+		err := decoder.Decode(&tip)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("tip: %+v\n", tip)
+		amount, err := parseCents(tip.Amount)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if (tip.Percent != 0) == (tip.Amount != "") || tip.Percent < 0 || tip.Percent > 100 || amount < 0 {
+			httpError("Tip needs a percent between 0 and 100 or an amount")
+			return
+		}
+		if tip.Amount != "" {
+			tip.Amount = formatCents(amount)
+		}
+		set := bson.NewDocument(bson.EC.Int32("percent", int32(tip.Percent)))
+		if tip.Amount != "" {
+			set.Append(bson.EC.String("amount", tip.Amount))
+		}
+		update = bson.NewDocument(bson.EC.SubDocumentFromElements("$set", bson.EC.SubDocument("tip", set)))
+	case "DELETE":
+		update = bson.NewDocument(bson.EC.SubDocumentFromElements("$unset", bson.EC.String("tip", "")))
+	default:
+		httpError(fmt.Sprintf("Unexpected method %s", req.Method))
+		return
+	}
+
+	var b *bill
+	err = runTxn(req.Context(), func(tx *txn) error {
+		filter := bson.NewDocument(
+			bson.EC.ObjectID("_id", oid),
+			bson.EC.SubDocumentFromElements("state", bson.EC.ArrayFromElements("$in",
+				bson.VC.String(orderOpen), bson.VC.Null())),
+		)
+		matched, err := tx.updateOne(ordersColl, filter, update)
+		if err != nil {
+			return err
+		}
+		if matched == 0 {
+			return fmt.Errorf("order %s isn't open", orderID)
+		}
+		var order orderRecord
+		if err := tx.findOne(ordersColl, bson.NewDocument(bson.EC.ObjectID("_id", oid)), &order); err != nil {
+			return err
+		}
+		b, err = priceOrder(tx, &order)
+		return err
+	})
+	if err != nil {
+		httpError(err.Error())
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(b)
+}
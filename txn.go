@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/core/command"
+	"github.com/mongodb/mongo-go-driver/core/connection"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/sessionopt"
+)
+
+// Multi-document writes (order submission and friends) go through runTxn.
+//
+// The vendored driver (0.0.11) knows about sessions but not transactions, so
+// when the deployment supports them (replica set or mongos, wire version 7+,
+// i.e. MongoDB 4.0) we drive the transaction ourselves: every statement is
+// sent with RunCommand on a session, carrying txnNumber/autocommit, and the
+// unit ends with commitTransaction or abortTransaction.
+//
+// A standalone mongod can't run transactions at all. There the same callback
+// runs against the plain collections and every write records a compensating
+// undo step; if the callback fails the undo steps are replayed newest first.
+// That keeps a failed submission from leaving half its writes behind, but it
+// is not isolated: other requests can see the intermediate state, and a crash
+// halfway through leaves it there. Set MONGO_TXN=off to force the fallback,
+// e.g. when pointing a replica set build at an old server.
+
+var txnSupported bool
+
+// txnNumbers must only ever grow for a given server session, and the driver
+// pools server sessions between clients, so one counter is shared by all.
+var txnNumbers = time.Now().UnixNano()
+
+const txnMaxAttempts = 3
+
+var errNoDocument = errors.New("document not found")
+
+type txn struct {
+	ctx     context.Context
+	sess    *mongo.Session
+	number  int64
+	started bool
+	undo    []func(context.Context) error
+
+	// run once the unit of work has been committed
+	afterCommit []func()
+}
+
+func (tx *txn) committed() {
+	for _, fn := range tx.afterCommit {
+		fn()
+	}
+}
+
+func detectTxnSupport() {
+	if getEnv("MONGO_TXN", "auto") == "off" {
+		log.Println("transactions disabled by MONGO_TXN")
+		return
+	}
+	rdr, err := database.RunCommand(context.Background(), bson.NewDocument(bson.EC.Int32("isMaster", 1)))
+	if err != nil {
+		log.Printf("isMaster failed, transactions disabled: %s", err)
+		return
+	}
+	wire := int32(0)
+	if elem, err := rdr.Lookup("maxWireVersion"); err == nil {
+		wire = elem.Value().Int32()
+	}
+	_, rsErr := rdr.Lookup("setName")
+	mongos := false
+	if elem, err := rdr.Lookup("msg"); err == nil {
+		mongos = elem.Value().StringValue() == "isdbgrid"
+	}
+	txnSupported = wire >= 7 && (rsErr == nil || mongos)
+	fmt.Printf("Transactions supported: %v (wire version %d)\n", txnSupported, wire)
+}
+
+// runTxn runs fn as one unit of work. Transient failures (write conflicts,
+// dropped connections) restart the whole callback, so fn must not have side
+// effects outside the txn it is handed.
+func runTxn(ctx context.Context, fn func(tx *txn) error) error {
+	if !txnSupported {
+		tx := &txn{ctx: ctx}
+		err := fn(tx)
+		if err != nil {
+			tx.rollback()
+			return err
+		}
+		tx.committed()
+		return nil
+	}
+
+	sess, err := client.StartSession(sessionopt.CausalConsistency(false))
+	if err != nil {
+		return err
+	}
+	defer sess.EndSession()
+
+	for attempt := 1; ; attempt++ {
+		tx := &txn{ctx: ctx, sess: sess, number: atomic.AddInt64(&txnNumbers, 1)}
+		err = fn(tx)
+		if err == nil {
+			err = tx.commit()
+		}
+		if err == nil {
+			tx.committed()
+			return nil
+		}
+		tx.abort()
+		if !isTransientTxnError(err) || attempt == txnMaxAttempts {
+			return err
+		}
+		log.Printf("retrying transaction after transient error: %s", err)
+	}
+}
+
+// isTransientTxnError reports whether the whole transaction can be retried.
+// The driver drops the server's errorLabels, so we go by error code.
+func isTransientTxnError(err error) bool {
+	switch e := err.(type) {
+	case command.Error:
+		switch e.Code {
+		case 112, // WriteConflict
+			251, // NoSuchTransaction
+			24,  // LockTimeout
+			246: // SnapshotUnavailable
+			return true
+		}
+	case connection.NetworkError, connection.Error:
+		return true
+	}
+	return false
+}
+
+func (tx *txn) commit() error {
+	if !tx.started {
+		return nil
+	}
+	var err error
+	for i := 0; i < txnMaxAttempts; i++ {
+		_, err = tx.admin(bson.NewDocument(bson.EC.Int32("commitTransaction", 1)))
+		if err == nil {
+			return nil
+		}
+		// the commit may have been applied before the connection dropped,
+		// and commitTransaction is safe to repeat, so keep asking
+		if _, ok := err.(connection.NetworkError); !ok {
+			return err
+		}
+	}
+	return err
+}
+
+func (tx *txn) abort() {
+	if !tx.started {
+		return
+	}
+	_, err := tx.admin(bson.NewDocument(bson.EC.Int32("abortTransaction", 1)))
+	if err != nil {
+		log.Printf("abortTransaction: %s", err)
+	}
+}
+
+func (tx *txn) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](context.Background()); err != nil {
+			log.Printf("rollback step failed: %s", err)
+		}
+	}
+}
+
+func (tx *txn) admin(cmd *bson.Document) (bson.Reader, error) {
+	cmd.Append(
+		bson.EC.Int64("txnNumber", tx.number),
+		bson.EC.Boolean("autocommit", false),
+	)
+	return client.Database("admin").RunCommand(tx.ctx, cmd, tx.sess)
+}
+
+// run sends one statement of the transaction, tagging the first one with
+// startTransaction.
+func (tx *txn) run(cmd *bson.Document) (bson.Reader, error) {
+	cmd.Append(
+		bson.EC.Int64("txnNumber", tx.number),
+		bson.EC.Boolean("autocommit", false),
+	)
+	if !tx.started {
+		cmd.Append(bson.EC.Boolean("startTransaction", true))
+	}
+	rdr, err := database.RunCommand(tx.ctx, cmd, tx.sess)
+	if err != nil {
+		return nil, err
+	}
+	tx.started = true
+	if elem, err := rdr.Lookup("writeErrors", "0"); err == nil {
+		we := elem.Value().MutableDocument()
+		return nil, command.Error{
+			Code:    we.Lookup("code").Int32(),
+			Message: we.Lookup("errmsg").StringValue(),
+		}
+	}
+	return rdr, nil
+}
+
+func (tx *txn) find(coll *mongo.Collection, filter *bson.Document) ([]bson.Reader, error) {
+	if filter == nil {
+		filter = bson.NewDocument()
+	}
+	docs := make([]bson.Reader, 0)
+	if tx.sess == nil {
+		cur, err := coll.Find(tx.ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		defer cur.Close(tx.ctx)
+		for cur.Next(tx.ctx) {
+			rdr, err := cur.DecodeBytes()
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, rdr)
+		}
+		return docs, cur.Err()
+	}
+
+	// transactions run on the primary and need the whole result up front,
+	// a getMore inside the transaction isn't worth the trouble here
+	rdr, err := tx.run(bson.NewDocument(
+		bson.EC.String("find", coll.Name()),
+		bson.EC.SubDocument("filter", filter),
+		bson.EC.Boolean("singleBatch", true),
+		bson.EC.Int32("batchSize", 10000),
+	))
+	if err != nil {
+		return nil, err
+	}
+	elem, err := rdr.Lookup("cursor", "firstBatch")
+	if err != nil {
+		return nil, err
+	}
+	itr, err := elem.Value().MutableArray().Iterator()
+	if err != nil {
+		return nil, err
+	}
+	for itr.Next() {
+		raw, err := itr.Value().MutableDocument().MarshalBSON()
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, bson.Reader(raw))
+	}
+	return docs, itr.Err()
+}
+
+// findOne decodes the first match into out, or returns errNoDocument.
+func (tx *txn) findOne(coll *mongo.Collection, filter *bson.Document, out interface{}) error {
+	docs, err := tx.find(coll, filter)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return errNoDocument
+	}
+	return bson.Unmarshal(docs[0], out)
+}
+
+// insertOne adds doc, giving it an _id first if it doesn't have one.
+func (tx *txn) insertOne(coll *mongo.Collection, doc *bson.Document) (objectid.ObjectID, error) {
+	var oid objectid.ObjectID
+	if elem, err := doc.LookupElementErr("_id"); err == nil {
+		oid = elem.Value().ObjectID()
+	} else {
+		oid = objectid.New()
+		doc.Prepend(bson.EC.ObjectID("_id", oid))
+	}
+
+	if tx.sess == nil {
+		_, err := coll.InsertOne(tx.ctx, doc)
+		if err != nil {
+			return oid, err
+		}
+		tx.undo = append(tx.undo, func(ctx context.Context) error {
+			_, err := coll.DeleteOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid)))
+			return err
+		})
+		return oid, nil
+	}
+
+	_, err := tx.run(bson.NewDocument(
+		bson.EC.String("insert", coll.Name()),
+		bson.EC.ArrayFromElements("documents", bson.VC.Document(doc)),
+	))
+	return oid, err
+}
+
+// updateOne applies update to the first match and returns how many documents
+// matched, so callers can use the filter as a guard.
+func (tx *txn) updateOne(coll *mongo.Collection, filter, update *bson.Document) (int64, error) {
+	if tx.sess == nil {
+		before := bson.NewDocument()
+		err := coll.FindOne(tx.ctx, filter).Decode(before)
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		id := before.Lookup("_id")
+		// pin the update to the document we saved, the filter may match
+		// another one by now
+		pinned := filter.Copy().Set(bson.EC.Interface("_id", id.Interface()))
+		result, err := coll.UpdateOne(tx.ctx, pinned, update)
+		if err != nil {
+			return 0, err
+		}
+		if result.MatchedCount > 0 {
+			tx.undo = append(tx.undo, func(ctx context.Context) error {
+				_, err := coll.ReplaceOne(ctx, bson.NewDocument(bson.EC.Interface("_id", id.Interface())), before)
+				return err
+			})
+		}
+		return result.MatchedCount, nil
+	}
+
+	rdr, err := tx.run(bson.NewDocument(
+		bson.EC.String("update", coll.Name()),
+		bson.EC.ArrayFromElements("updates", bson.VC.DocumentFromElements(
+			bson.EC.SubDocument("q", filter),
+			bson.EC.SubDocument("u", update),
+		)),
+	))
+	if err != nil {
+		return 0, err
+	}
+	elem, err := rdr.Lookup("n")
+	if err != nil {
+		return 0, err
+	}
+	return int64(elem.Value().Int32()), nil
+}
+
+// isDuplicateKey reports whether err is a unique index turning a write away.
+func isDuplicateKey(err error) bool {
+	switch e := err.(type) {
+	case mongo.WriteErrors:
+		for _, we := range e {
+			if we.Code == 11000 {
+				return true
+			}
+		}
+	case command.Error:
+		return e.Code == 11000
+	}
+	return false
+}
+
+// deleteOne removes the first match and returns how many were removed.
+func (tx *txn) deleteOne(coll *mongo.Collection, filter *bson.Document) (int64, error) {
+	if tx.sess == nil {
+		before := bson.NewDocument()
+		err := coll.FindOne(tx.ctx, filter).Decode(before)
+		if err == mongo.ErrNoDocuments {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		id := before.Lookup("_id")
+		result, err := coll.DeleteOne(tx.ctx, bson.NewDocument(bson.EC.Interface("_id", id.Interface())))
+		if err != nil {
+			return 0, err
+		}
+		if result.DeletedCount > 0 {
+			tx.undo = append(tx.undo, func(ctx context.Context) error {
+				_, err := coll.InsertOne(ctx, before)
+				return err
+			})
+		}
+		return result.DeletedCount, nil
+	}
+
+	rdr, err := tx.run(bson.NewDocument(
+		bson.EC.String("delete", coll.Name()),
+		bson.EC.ArrayFromElements("deletes", bson.VC.DocumentFromElements(
+			bson.EC.SubDocument("q", filter),
+			bson.EC.Int32("limit", 1),
+		)),
+	))
+	if err != nil {
+		return 0, err
+	}
+	elem, err := rdr.Lookup("n")
+	if err != nil {
+		return 0, err
+	}
+	return int64(elem.Value().Int32()), nil
+}
@@ -0,0 +1,797 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+	"github.com/mongodb/mongo-go-driver/mongo"
+	"github.com/mongodb/mongo-go-driver/mongo/findopt"
+)
+
+// Webhooks tell partners about orders and menus. Events come from the
+// outbox relay, which writes a delivery for each subscribed hook, and a
+// worker POSTs them:
+//
+//	{"id":"<event id>","event":"order.submitted","store":"...","at":1700000000,"data":{...}}
+//
+// The event id is the same for every hook and every retry, so receivers
+// can drop repeats. Each request is signed with the hook's secret:
+//
+//	X-Webhook-Signature: t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">
+//
+// Anything but a 2xx is retried, 30s after the first try and doubling up to
+// 6h, and after webhookMaxAttempts the delivery moves to the dead letters,
+// where it stays until someone retries it. It stays in the deliveries too,
+// marked dead, so the same event coming round again isn't queued twice.
+
+// webhook events
+const (
+	webhookOrderCreated   = "order.created"
+	webhookOrderSubmitted = "order.submitted"
+	webhookOrderCompleted = "order.completed" // picked up
+	webhookOrderCancelled = "order.cancelled"
+	webhookMenuChanged    = "menu.changed"
+	webhookPing           = "ping" // only sent by the test endpoint
+)
+
+var webhookEvents = map[string]bool{
+	webhookOrderCreated:   true,
+	webhookOrderSubmitted: true,
+	webhookOrderCompleted: true,
+	webhookOrderCancelled: true,
+	webhookMenuChanged:    true,
+}
+
+// delivery states
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+const (
+	webhookMaxAttempts = 8
+	webhookFirstRetry  = 30 * time.Second
+	webhookMaxRetry    = 6 * time.Hour
+	webhookTimeout     = 10 * time.Second
+	webhookLease       = 2 * time.Minute // a claimed delivery isn't due again until then
+	webhookSenders     = 8
+)
+
+type webhook struct {
+	ID      objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr   string            `bson:"-" json:"id"`
+	URL     string            `bson:"url" json:"url"`
+	Events  []string          `bson:"events" json:"events"` // all of them if empty
+	Store   string            `bson:"-" json:"store"`       // empty for every store
+	StoreID objectid.ObjectID `bson:"store" json:"-"`
+	Secret  string            `bson:"secret" json:"secret,omitempty"` // only when added
+	Active  bool              `bson:"active" json:"active"`
+	Created int64             `bson:"created" json:"created"`
+}
+
+type webhookTry struct {
+	At     int64  `bson:"at" json:"at"`
+	Status int    `bson:"status" json:"status,omitempty"`
+	Error  string `bson:"error" json:"error,omitempty"`
+	Millis int64  `bson:"millis" json:"millis"`
+}
+
+type webhookDelivery struct {
+	ID        objectid.ObjectID `bson:"_id" json:"-"`
+	IDStr     string            `bson:"-" json:"id"`
+	Hook      objectid.ObjectID `bson:"hook" json:"-"`
+	HookStr   string            `bson:"-" json:"hook"`
+	Event     string            `bson:"event" json:"event"`
+	EventID   string            `bson:"event_id" json:"event_id"`
+	Body      string            `bson:"body" json:"body"`
+	State     string            `bson:"state" json:"state"`
+	Attempts  int               `bson:"attempts" json:"attempts"`
+	Next      int64             `bson:"next" json:"next,omitempty"` // when it's due, while pending
+	Tries     []webhookTry      `bson:"tries" json:"tries"`
+	Created   int64             `bson:"created" json:"created"`
+	Delivered int64             `bson:"delivered" json:"delivered,omitempty"`
+	Died      int64             `bson:"died" json:"died,omitempty"`
+	Reason    string            `bson:"reason" json:"reason,omitempty"` // why it's dead
+}
+
+type webhookPayload struct {
+	ID    string          `json:"id"`
+	Event string          `json:"event"`
+	Store string          `json:"store,omitempty"`
+	At    int64           `json:"at"`
+	Data  json.RawMessage `json:"data"`
+}
+
+var webhooksColl *mongo.Collection
+var deliveriesColl *mongo.Collection
+var deadLettersColl *mongo.Collection
+
+var webhookPoke = make(chan struct{}, 1)
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+func (h *webhook) fill() {
+	h.IDStr = h.ID.Hex()
+	if h.StoreID != objectid.NilObjectID {
+		h.Store = h.StoreID.Hex()
+	}
+}
+
+func (h *webhook) wants(p *webhookPayload) bool {
+	if !h.Active {
+		return false
+	}
+	if h.StoreID != objectid.NilObjectID && h.StoreID.Hex() != p.Store {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, event := range h.Events {
+		if event == p.Event {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *webhookDelivery) fill() {
+	d.IDStr = d.ID.Hex()
+	d.HookStr = d.Hook.Hex()
+	if d.Tries == nil {
+		d.Tries = make([]webhookTry, 0)
+	}
+}
+
+// queueWebhooks adds a delivery of p for every hook that wants it. The
+// event id is unique per hook, so doing this again for the same event adds
+// nothing twice.
+func queueWebhooks(ctx context.Context, p *webhookPayload) error {
+	hooks, err := loadWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	queued := false
+	for i := range hooks {
+		if !hooks[i].wants(p) {
+			continue
+		}
+		_, err := addDelivery(ctx, &hooks[i], p, time.Now())
+		if isDuplicateKey(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("queueing %s for %s: %s", p.Event, hooks[i].URL, err)
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case webhookPoke <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+func loadWebhooks(ctx context.Context) ([]webhook, error) {
+	cur, err := webhooksColl.Find(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	list := make([]webhook, 0)
+	for cur.Next(ctx) {
+		var h webhook
+		if err := cur.Decode(&h); err != nil {
+			return nil, err
+		}
+		h.fill()
+		list = append(list, h)
+	}
+	return list, cur.Err()
+}
+
+func findWebhook(ctx context.Context, oid objectid.ObjectID) (*webhook, error) {
+	var h webhook
+	err := webhooksColl.FindOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", oid))).Decode(&h)
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("webhook %s not found", oid.Hex())
+	}
+	if err != nil {
+		return nil, err
+	}
+	h.fill()
+	return &h, nil
+}
+
+// addDelivery records that p is owed to h, due at due.
+func addDelivery(ctx context.Context, h *webhook, p *webhookPayload, due time.Time) (*webhookDelivery, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	d := &webhookDelivery{
+		ID:      objectid.New(),
+		Hook:    h.ID,
+		Event:   p.Event,
+		EventID: p.ID,
+		Body:    string(body),
+		State:   deliveryPending,
+		Next:    due.Unix(),
+		Created: time.Now().Unix(),
+	}
+	_, err = deliveriesColl.InsertOne(ctx, bson.NewDocument(
+		bson.EC.ObjectID("_id", d.ID),
+		bson.EC.ObjectID("hook", d.Hook),
+		bson.EC.String("event", d.Event),
+		bson.EC.String("event_id", d.EventID),
+		bson.EC.String("body", d.Body),
+		bson.EC.String("state", d.State),
+		bson.EC.Int32("attempts", 0),
+		bson.EC.Int64("next", d.Next),
+		bson.EC.Array("tries", bson.NewArray()),
+		bson.EC.Int64("created", d.Created),
+	))
+	if err != nil {
+		return nil, err
+	}
+	d.fill()
+	return d, nil
+}
+
+// deliverWebhooks sends deliveries as they come due, a few at a time.
+func deliverWebhooks(ctx context.Context) {
+	senders := make(chan struct{}, webhookSenders)
+	tick := time.NewTicker(5 * time.Second)
+	defer tick.Stop()
+	for {
+		for {
+			due, err := claimDeliveries(ctx, webhookSenders)
+			if err != nil {
+				log.Printf("claiming webhook deliveries: %s", err)
+				break
+			}
+			for i := range due {
+				senders <- struct{}{}
+				go func(d *webhookDelivery) {
+					defer func() { <-senders }()
+					if err := attemptDelivery(ctx, d); err != nil {
+						log.Printf("webhook delivery %s: %s", d.IDStr, err)
+					}
+				}(&due[i])
+			}
+			if len(due) < webhookSenders {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		case <-webhookPoke:
+		}
+	}
+}
+
+// claimDeliveries takes up to limit due deliveries, pushing each one's due
+// time out by webhookLease so other replicas leave it alone meanwhile.
+func claimDeliveries(ctx context.Context, limit int64) ([]webhookDelivery, error) {
+	now := time.Now()
+	cur, err := deliveriesColl.Find(ctx, bson.NewDocument(
+		bson.EC.String("state", deliveryPending),
+		bson.EC.SubDocumentFromElements("next", bson.EC.Int64("$lte", now.Unix())),
+	), findopt.Sort(bson.NewDocument(bson.EC.Int32("next", 1))), findopt.Limit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	claimed := make([]webhookDelivery, 0)
+	for cur.Next(ctx) {
+		var d webhookDelivery
+		if err := cur.Decode(&d); err != nil {
+			return nil, err
+		}
+		result, err := deliveriesColl.UpdateOne(ctx,
+			bson.NewDocument(
+				bson.EC.ObjectID("_id", d.ID),
+				bson.EC.String("state", deliveryPending),
+				bson.EC.Int64("next", d.Next),
+			),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set",
+				bson.EC.Int64("next", now.Add(webhookLease).Unix()))))
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 1 {
+			d.fill()
+			claimed = append(claimed, d)
+		}
+	}
+	return claimed, cur.Err()
+}
+
+// webhookBackoff is how long to wait after the attempts'th failure.
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookFirstRetry
+	for i := 1; i < attempts && wait < webhookMaxRetry; i++ {
+		wait *= 2
+	}
+	if wait > webhookMaxRetry {
+		wait = webhookMaxRetry
+	}
+	// spread out retries of everything that failed together
+	return wait + time.Duration(mrand.Int63n(int64(wait/10)+1))
+}
+
+func webhookSignature(secret string, at int64, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.%s", at, body)
+	return fmt.Sprintf("t=%d,v1=%s", at, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// attemptDelivery sends a claimed delivery once and records how it went.
+func attemptDelivery(ctx context.Context, d *webhookDelivery) error {
+	h, err := findWebhook(ctx, d.Hook)
+	if err != nil {
+		return deadLetter(ctx, d, err.Error())
+	}
+	if !h.Active {
+		return deadLetter(ctx, d, "webhook is inactive")
+	}
+
+	start := time.Now()
+	try := webhookTry{At: start.Unix()}
+	req, err := http.NewRequest("POST", h.URL, strings.NewReader(d.Body))
+	if err != nil {
+		return deadLetter(ctx, d, err.Error())
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tacos-api-webhooks")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.IDStr)
+	req.Header.Set("X-Webhook-Signature", webhookSignature(h.Secret, start.Unix(), d.Body))
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		try.Error = err.Error()
+	} else {
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+		res.Body.Close()
+		try.Status = res.StatusCode
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			try.Error = res.Status
+		}
+	}
+	try.Millis = int64(time.Since(start) / time.Millisecond)
+	d.Attempts++
+	d.Tries = append(d.Tries, try)
+
+	sets := []*bson.Element{bson.EC.Int32("attempts", int32(d.Attempts))}
+	switch {
+	case try.Error == "":
+		d.State = deliveryDelivered
+		d.Delivered = time.Now().Unix()
+		d.Next = 0
+		sets = append(sets,
+			bson.EC.String("state", d.State),
+			bson.EC.Int64("delivered", d.Delivered),
+			bson.EC.Int64("next", 0),
+		)
+	case d.Attempts < webhookMaxAttempts:
+		d.Next = time.Now().Add(webhookBackoff(d.Attempts)).Unix()
+		sets = append(sets, bson.EC.Int64("next", d.Next))
+	}
+	_, err = deliveriesColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", d.ID)),
+		bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$set", sets...),
+			bson.EC.SubDocumentFromElements("$push", bson.EC.SubDocumentFromElements("tries",
+				bson.EC.Int64("at", try.At),
+				bson.EC.Int32("status", int32(try.Status)),
+				bson.EC.String("error", try.Error),
+				bson.EC.Int64("millis", try.Millis),
+			)),
+		))
+	if err != nil {
+		return err
+	}
+	if try.Error != "" && d.Attempts >= webhookMaxAttempts {
+		return deadLetter(ctx, d, fmt.Sprintf("gave up after %d attempts: %s", d.Attempts, try.Error))
+	}
+	return nil
+}
+
+// deadLetter moves a delivery out of the queue for good, or until someone
+// retries it. What's left in the queue is marked dead, it holds the
+// delivery's (hook, event_id) so queueWebhooks doesn't add it again.
+func deadLetter(ctx context.Context, d *webhookDelivery, reason string) error {
+	log.Printf("webhook delivery %s is dead: %s", d.IDStr, reason)
+	now := time.Now().Unix()
+	return runTxn(ctx, func(tx *txn) error {
+		filter := bson.NewDocument(bson.EC.ObjectID("_id", d.ID))
+		docs, err := tx.find(deliveriesColl, filter)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil // someone else got there first
+		}
+		doc, err := bson.ReadDocument(docs[0])
+		if err != nil {
+			return err
+		}
+		doc.Set(bson.EC.String("state", deliveryDead))
+		doc.Set(bson.EC.Int64("died", now))
+		doc.Set(bson.EC.String("reason", reason))
+		doc.Delete("next")
+		if _, err := tx.insertOne(deadLettersColl, doc); err != nil {
+			return err
+		}
+		_, err = tx.updateOne(deliveriesColl, filter, bson.NewDocument(
+			bson.EC.SubDocumentFromElements("$set",
+				bson.EC.String("state", deliveryDead),
+				bson.EC.Int64("died", now),
+				bson.EC.String("reason", reason),
+			),
+			bson.EC.SubDocumentFromElements("$unset", bson.EC.String("next", "")),
+		))
+		return err
+	})
+}
+
+// reviveDelivery puts a dead letter back in the queue with its attempts
+// reset, due now.
+func reviveDelivery(ctx context.Context, oid objectid.ObjectID) error {
+	return runTxn(ctx, func(tx *txn) error {
+		filter := bson.NewDocument(bson.EC.ObjectID("_id", oid))
+		docs, err := tx.find(deadLettersColl, filter)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return fmt.Errorf("dead letter %s not found", oid.Hex())
+		}
+		doc, err := bson.ReadDocument(docs[0])
+		if err != nil {
+			return err
+		}
+		doc.Set(bson.EC.String("state", deliveryPending))
+		doc.Set(bson.EC.Int32("attempts", 0))
+		doc.Set(bson.EC.Int64("next", time.Now().Unix()))
+		doc.Delete("died")
+		doc.Delete("reason")
+		// the dead one left in the queue, if it's still there
+		if _, err := tx.deleteOne(deliveriesColl, filter); err != nil {
+			return err
+		}
+		if _, err := tx.insertOne(deliveriesColl, doc); err != nil {
+			return err
+		}
+		_, err = tx.deleteOne(deadLettersColl, filter)
+		return err
+	})
+}
+
+func listDeliveries(ctx context.Context, coll *mongo.Collection, filter *bson.Document, limit int64) ([]webhookDelivery, error) {
+	cur, err := coll.Find(ctx, filter,
+		findopt.Sort(bson.NewDocument(bson.EC.Int32("created", -1))),
+		findopt.Limit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	list := make([]webhookDelivery, 0)
+	for cur.Next(ctx) {
+		var d webhookDelivery
+		if err := cur.Decode(&d); err != nil {
+			return nil, err
+		}
+		d.fill()
+		list = append(list, d)
+	}
+	return list, cur.Err()
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("webhook url must be http or https, not %q", raw)
+	}
+	return nil
+}
+
+func validateWebhookEvents(list []string) error {
+	for _, event := range list {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown webhook event %q", event)
+		}
+	}
+	return nil
+}
+
+func eventsElement(list []string) *bson.Element {
+	values := make([]*bson.Value, 0, len(list))
+	for _, event := range list {
+		values = append(values, bson.VC.String(event))
+	}
+	return bson.EC.ArrayFromElements("events", values...)
+}
+
+// handleWebhooks is /api/v1/webhooks, for admins:
+//
+//	GET                          list hooks
+//	PUT {url,events,store}       add one, the response has its secret
+//	GET|PATCH|DELETE /{id}       one hook; PATCH takes url, events, active
+//	GET /{id}/deliveries         the delivery log, newest first, ?state=
+//	POST /{id}/test              send a ping now and return how it went
+//	GET /{id}/dead               dead letters
+//	POST /{id}/dead/{delivery}   retry a dead letter
+func handleWebhooks(res http.ResponseWriter, req *http.Request) {
+	httpError := func(msg string) {
+		// todo: restrict this to debug only
+		_, callerFile, callerLine, ok := runtime.Caller(1)
+		if ok {
+			split := strings.Split(path.Base(callerFile), ".")
+			msg += fmt.Sprintf(" at %s:%d", split[0], callerLine)
+		}
+		http.Error(res, msg, 500)
+	}
+
+	if _, err := requireStaff(req, roleAdmin, objectid.NilObjectID); err != nil {
+		http.Error(res, err.Error(), http.StatusForbidden)
+		return
+	}
+	ctx := req.Context()
+	var parts []string
+	if rest := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v1/webhooks"), "/"); rest != "" {
+		parts = strings.Split(rest, "/")
+	}
+	var hook *webhook
+	if len(parts) > 0 {
+		oid, err := objectid.FromHex(parts[0])
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		hook, err = findWebhook(ctx, oid)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+	}
+
+	switch {
+	case req.Method == "GET" && len(parts) == 0:
+		list, err := loadWebhooks(ctx)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		for i := range list {
+			list[i].Secret = ""
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case req.Method == "PUT" && len(parts) == 0:
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var h webhook
+		err := decoder.Decode(&h)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if err := validateWebhookURL(h.URL); err != nil {
+			httpError(err.Error())
+			return
+		}
+		if err := validateWebhookEvents(h.Events); err != nil {
+			httpError(err.Error())
+			return
+		}
+		if h.Events == nil {
+			h.Events = make([]string, 0)
+		}
+		if h.Store != "" {
+			h.StoreID, err = objectid.FromHex(h.Store)
+			if err != nil {
+				httpError(err.Error())
+				return
+			}
+		}
+		secret := make([]byte, 24)
+		if _, err := rand.Read(secret); err != nil {
+			httpError(err.Error())
+			return
+		}
+		h.Secret = hex.EncodeToString(secret)
+		h.Active = true
+		h.Created = time.Now().Unix()
+		inserter := bson.NewDocument(
+			bson.EC.String("url", h.URL),
+			eventsElement(h.Events),
+			bson.EC.String("secret", h.Secret),
+			bson.EC.Boolean("active", true),
+			bson.EC.Int64("created", h.Created),
+		)
+		if h.StoreID != objectid.NilObjectID {
+			inserter.Append(bson.EC.ObjectID("store", h.StoreID))
+		}
+		result, err := webhooksColl.InsertOne(ctx, inserter)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		h.ID = result.InsertedID.(objectid.ObjectID)
+		h.fill()
+		log.Printf("added webhook %s for %s", h.IDStr, h.URL)
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("Cache-Control", "no-store") // it has the secret
+		json.NewEncoder(res).Encode(h)
+
+	case req.Method == "GET" && len(parts) == 1:
+		hook.Secret = ""
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(hook)
+
+	case req.Method == "PATCH" && len(parts) == 1:
+		decoder := json.NewDecoder(req.Body)
+		defer req.Body.Close()
+		var body struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+			Active *bool    `json:"active"`
+		}
+		if err := decoder.Decode(&body); err != nil {
+			httpError(err.Error())
+			return
+		}
+		updates := make([]*bson.Element, 0)
+		if body.URL != "" {
+			if err := validateWebhookURL(body.URL); err != nil {
+				httpError(err.Error())
+				return
+			}
+			updates = append(updates, bson.EC.String("url", body.URL))
+		}
+		if body.Events != nil {
+			if err := validateWebhookEvents(body.Events); err != nil {
+				httpError(err.Error())
+				return
+			}
+			updates = append(updates, eventsElement(body.Events))
+		}
+		if body.Active != nil {
+			updates = append(updates, bson.EC.Boolean("active", *body.Active))
+		}
+		if len(updates) == 0 {
+			httpError("One of url, events or active is required")
+			return
+		}
+		result, err := webhooksColl.UpdateOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", hook.ID)),
+			bson.NewDocument(bson.EC.SubDocumentFromElements("$set", updates...)))
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		fmt.Printf("result: %+v\n", result)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	case req.Method == "DELETE" && len(parts) == 1:
+		// its pending deliveries go to the dead letters when they come due
+		result, err := webhooksColl.DeleteOne(ctx, bson.NewDocument(bson.EC.ObjectID("_id", hook.ID)))
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		log.Printf("removed webhook %s for %s", hook.IDStr, hook.URL)
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(result)
+
+	case req.Method == "GET" && len(parts) == 2 && (parts[1] == "deliveries" || parts[1] == "dead"):
+		coll := deliveriesColl
+		if parts[1] == "dead" {
+			coll = deadLettersColl
+		}
+		filter := bson.NewDocument(bson.EC.ObjectID("hook", hook.ID))
+		if state := req.URL.Query().Get("state"); state != "" {
+			filter.Append(bson.EC.String("state", state))
+		}
+		limit := int64(100)
+		if param := req.URL.Query().Get("limit"); param != "" {
+			n, err := strconv.ParseInt(param, 10, 64)
+			if err != nil || n < 1 {
+				httpError(fmt.Sprintf("Bad limit %q", param))
+				return
+			}
+			limit = n
+		}
+		list, err := listDeliveries(ctx, coll, filter, limit)
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(list)
+
+	case req.Method == "POST" && len(parts) == 2 && parts[1] == "test":
+		data := struct {
+			Hook string `json:"hook"`
+		}{hook.IDStr}
+		body, _ := json.Marshal(data)
+		p := webhookPayload{
+			ID:    objectid.New().Hex(),
+			Event: webhookPing,
+			Store: hook.Store,
+			At:    time.Now().Unix(),
+			Data:  body,
+		}
+		// due after the lease, as if it had just been claimed; if this try
+		// fails it's retried like any other delivery
+		d, err := addDelivery(ctx, hook, &p, time.Now().Add(webhookLease))
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if err := attemptDelivery(ctx, d); err != nil {
+			httpError(err.Error())
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(d)
+
+	case req.Method == "POST" && len(parts) == 3 && parts[1] == "dead":
+		oid, err := objectid.FromHex(parts[2])
+		if err != nil {
+			httpError(err.Error())
+			return
+		}
+		if err := reviveDelivery(ctx, oid); err != nil {
+			httpError(err.Error())
+			return
+		}
+		select {
+		case webhookPoke <- struct{}{}:
+		default:
+		}
+		res.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(res).Encode(insert{oid.Hex()})
+
+	default:
+		httpError(fmt.Sprintf("Unexpected %s %s", req.Method, req.URL.Path))
+	}
+}
+
+func setupWebhooks() {
+	webhooksColl = database.Collection("webhooks")
+	deliveriesColl = database.Collection("webhook_deliveries")
+	deadLettersColl = database.Collection("webhook_dead_letters")
+
+	go deliverWebhooks(context.Background())
+
+	http.HandleFunc("/api/v1/webhooks", handleWebhooks)
+	http.HandleFunc("/api/v1/webhooks/", handleWebhooks)
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Just enough of RFC 6455 for the store dashboards: the server side of the
+// handshake, text and binary messages (fragmented or not), ping, pong and
+// close. No extensions, so no compression.
+//
+// A browser sends its page's Origin with the handshake, and any page can
+// try to open a socket, so only origins on the same host as the API or
+// listed in WS_ORIGINS (comma separated, like https://kitchen.example.com)
+// get one. Clients that aren't browsers send no Origin and aren't checked.
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsMaxMessage = 64 << 10
+	wsGUID       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// close codes
+const (
+	wsNormal       = 1000
+	wsGoingAway    = 1001
+	wsProtocolErr  = 1002
+	wsBadData      = 1007 // not UTF-8 in a text message
+	wsPolicy       = 1008
+	wsTooBig       = 1009
+	wsInternalErr  = 1011
+	wsNoStatusSent = 1005
+)
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	// one writer at a time, control frames can come from the reader
+	mu sync.Mutex
+
+	// called on each pong, to keep the read deadline moving
+	onPong func()
+}
+
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// wsUpgrade answers the opening handshake and takes over the connection.
+// On failure it has already replied with an error.
+func wsUpgrade(res http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	fail := func(msg string) (*wsConn, error) {
+		http.Error(res, msg, http.StatusBadRequest)
+		return nil, fmt.Errorf("websocket handshake: %s", strings.ToLower(msg))
+	}
+	if req.Method != "GET" {
+		return fail("Websocket needs a GET")
+	}
+	if !wsOriginAllowed(req) {
+		http.Error(res, "Origin not allowed", http.StatusForbidden)
+		return nil, fmt.Errorf("websocket handshake: origin %s not allowed", req.Header.Get("Origin"))
+	}
+	if !headerHas(req.Header, "Connection", "upgrade") || !headerHas(req.Header, "Upgrade", "websocket") {
+		return fail("Not a websocket upgrade")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		res.Header().Set("Sec-WebSocket-Version", "13")
+		return fail("Unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return fail("Bad Sec-WebSocket-Key")
+	}
+	hijacker, ok := res.(http.Hijacker)
+	if !ok {
+		http.Error(res, "Websockets aren't supported here", 500)
+		return nil, fmt.Errorf("websocket handshake: can't hijack")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, r: rw.Reader}, nil
+}
+
+// wsOriginAllowed checks req's Origin, see the top of the file.
+func wsOriginAllowed(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	for _, allowed := range strings.Split(getEnv("WS_ORIGINS", ""), ",") {
+		if allowed = strings.TrimSpace(allowed); allowed != "" && strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerHas looks for token in a comma separated header, ignoring case.
+func headerHas(h http.Header, name, token string) bool {
+	for _, value := range h[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readFrame reads one frame, unmasked.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		return fin, 0, nil, &wsCloseError{wsProtocolErr, "reserved bits set"}
+	}
+	opcode = head[0] & 0x0f
+	if head[1]&0x80 == 0 {
+		return fin, opcode, nil, &wsCloseError{wsProtocolErr, "client frames must be masked"}
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= wsClose && (length > 125 || !fin) {
+		return fin, opcode, nil, &wsCloseError{wsProtocolErr, "bad control frame"}
+	}
+	if length > wsMaxMessage {
+		return fin, opcode, nil, &wsCloseError{wsTooBig, "message too big"}
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.r, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage reads the next text or binary message, answering pings and
+// closes along the way. After a close it returns a *wsCloseError.
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if closeErr, ok := err.(*wsCloseError); ok {
+			c.Close(closeErr.Code, closeErr.Reason)
+			return 0, nil, err
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload, 10*time.Second); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			if c.onPong != nil {
+				c.onPong()
+			}
+			continue
+		case wsClose:
+			code := wsNoStatusSent
+			reason := ""
+			if len(payload) >= 2 {
+				if !utf8.Valid(payload[2:]) {
+					c.Close(wsBadData, "close reason isn't UTF-8")
+					return 0, nil, &wsCloseError{wsBadData, "close reason isn't UTF-8"}
+				}
+				code = int(binary.BigEndian.Uint16(payload))
+				reason = string(payload[2:])
+			}
+			c.Close(wsNormal, "")
+			return 0, nil, &wsCloseError{code, reason}
+		case wsText, wsBinary:
+			if message != nil {
+				c.Close(wsProtocolErr, "expected a continuation")
+				return 0, nil, &wsCloseError{wsProtocolErr, "expected a continuation"}
+			}
+			opcode = op
+			message = payload
+		case wsContinuation:
+			if message == nil {
+				c.Close(wsProtocolErr, "unexpected continuation")
+				return 0, nil, &wsCloseError{wsProtocolErr, "unexpected continuation"}
+			}
+			message = append(message, payload...)
+			if len(message) > wsMaxMessage {
+				c.Close(wsTooBig, "message too big")
+				return 0, nil, &wsCloseError{wsTooBig, "message too big"}
+			}
+		default:
+			c.Close(wsProtocolErr, "unknown opcode")
+			return 0, nil, &wsCloseError{wsProtocolErr, "unknown opcode"}
+		}
+		if fin {
+			if opcode == wsText && !utf8.Valid(message) {
+				c.Close(wsBadData, "text message isn't UTF-8")
+				return 0, nil, &wsCloseError{wsBadData, "text message isn't UTF-8"}
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// writeFrame sends one whole frame, giving up after timeout so one stuck
+// client can't hold a goroutine forever.
+func (c *wsConn) writeFrame(opcode byte, payload []byte, timeout time.Duration) error {
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = header[:4]
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header[1] = 127
+		header = header[:10]
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(payload)
+	return err
+}
+
+func (c *wsConn) WriteText(data []byte, timeout time.Duration) error {
+	return c.writeFrame(wsText, data, timeout)
+}
+
+func (c *wsConn) Ping(timeout time.Duration) error {
+	return c.writeFrame(wsPing, nil, timeout)
+}
+
+// SetReadDeadline bounds how long the next read may wait.
+func (c *wsConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Close sends a close frame, best effort, and drops the connection.
+func (c *wsConn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+	c.writeFrame(wsClose, payload, time.Second)
+	return c.conn.Close()
+}